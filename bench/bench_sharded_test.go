@@ -0,0 +1,61 @@
+package bench
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+var gomaxprocs = []int{1, 2, 4, 8, 16, 32, 64, 96}
+
+var implementations = []struct {
+	name string
+	new  func(limit int) semaphore.Semaphore
+}{
+	{"New", semaphore.New},
+	{"NewSharded", func(limit int) semaphore.Semaphore { return semaphore.NewSharded(limit, 0) }},
+}
+
+// benchmarkGOMAXPROCS runs bench for every implementation with every GOMAXPROCS value,
+// e.g. go test -bench 'GOMAXPROCS/procs=96/'
+func benchmarkGOMAXPROCS(b *testing.B, bench func(b *testing.B, sem semaphore.Semaphore), limit int) {
+	for _, procs := range gomaxprocs {
+		for _, impl := range implementations {
+			b.Run(fmt.Sprintf("procs=%d/%s", procs, impl.name), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				// shards are created for the current GOMAXPROCS
+				sem := impl.new(limit)
+				b.ResetTimer()
+				bench(b, sem)
+				b.StopTimer()
+
+				if sem.GetCount() != 0 {
+					b.Error("semaphore must have count = 0")
+				}
+			})
+		}
+	}
+}
+
+func acquireRelease(b *testing.B, sem semaphore.Semaphore) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sem.Acquire(nil, 1)
+			sem.Release(1)
+		}
+	})
+}
+
+func BenchmarkGOMAXPROCS_Acquire_Release_under_limit(b *testing.B) {
+	benchmarkGOMAXPROCS(b, acquireRelease, 1<<20)
+}
+
+func BenchmarkGOMAXPROCS_Acquire_Release_near_limit(b *testing.B) {
+	benchmarkGOMAXPROCS(b, acquireRelease, 64)
+}
+
+func BenchmarkGOMAXPROCS_Acquire_Release_over_limit(b *testing.B) {
+	benchmarkGOMAXPROCS(b, acquireRelease, 4)
+}
@@ -0,0 +1,58 @@
+package bench
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// criticalSection simulates a short critical section
+func criticalSection(d time.Duration) {
+	for start := time.Now(); time.Since(start) < d; {
+	}
+}
+
+func benchmarkShortCriticalSection(b *testing.B, sem semaphore.Semaphore, hold time.Duration) {
+	const goroutines = 16
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < b.N/goroutines+1; j++ {
+				sem.Acquire(nil, 1)
+				criticalSection(hold)
+				sem.Release(1)
+			}
+			wg.Done()
+		}()
+	}
+
+	b.ResetTimer()
+	close(c) // start
+	wg.Wait()
+
+	if sem.GetCount() != 0 {
+		b.Error("semaphore must have count = 0")
+	}
+}
+
+func BenchmarkSemaphore_short_critical_section_park(b *testing.B) {
+	benchmarkShortCriticalSection(b, semaphore.New(4), time.Microsecond)
+}
+
+func BenchmarkSemaphore_short_critical_section_adaptive_spin(b *testing.B) {
+	benchmarkShortCriticalSection(b, semaphore.NewWithOptions(4, semaphore.WithAdaptiveSpin(0)), time.Microsecond)
+}
+
+func BenchmarkSemaphore_long_critical_section_park(b *testing.B) {
+	benchmarkShortCriticalSection(b, semaphore.New(4), 100*time.Microsecond)
+}
+
+func BenchmarkSemaphore_long_critical_section_adaptive_spin(b *testing.B) {
+	benchmarkShortCriticalSection(b, semaphore.NewWithOptions(4, semaphore.WithAdaptiveSpin(0)), 100*time.Microsecond)
+}
@@ -0,0 +1,34 @@
+package semaphore_test
+
+import (
+	"testing"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/semaphoretest"
+)
+
+func TestConformance_New(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return semaphore.New(limit)
+	})
+}
+
+func TestConformance_New_adaptive_spin(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return semaphore.NewWithOptions(limit, semaphore.WithAdaptiveSpin(0))
+	})
+}
+
+func TestConformance_NewSharded(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return semaphore.NewSharded(limit, 4)
+	}, semaphoretest.WithReleaseLowerBound())
+}
+
+func TestConformance_Group(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		g := semaphore.NewGroup()
+		g.New(2, 2) // idle sibling
+		return g.New(limit, 0)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// ExclusiveAcquirer is implemented by semaphores supporting shared/exclusive (reader/writer) mode,
+// the Semaphore returned by New implements it.
+// Acquire and TryAcquire are shared acquisitions, many of them can hold the semaphore at once.
+// An exclusive acquisition holds the whole semaphore limit, so it runs alone.
+type ExclusiveAcquirer interface {
+	// AcquireExclusive waits until the whole current limit is free and takes it, blocking only until ctx is done.
+	// While an exclusive waiter is queued new shared acquisitions are blocked, so writers are not starved.
+	// Exclusive acquisitions are served one at a time.
+	// If the limit is raised by SetLimit while the exclusive holder runs, shared acquisitions stay blocked
+	// until ReleaseExclusive; if the limit is lowered, the count stays over the limit until ReleaseExclusive.
+	AcquireExclusive(ctx context.Context) error
+
+	// ReleaseExclusive releases the exclusive holding and wakes up the waiters.
+	ReleaseExclusive()
+}
+
+func (s *semaphore) AcquireExclusive(ctx context.Context) error {
+	var ctxDoneCh <-chan struct{}
+	if ctx != nil {
+		ctxDoneCh = ctx.Done()
+	}
+
+	// block new shared acquisitions
+	atomic.AddInt32(&s.exclusive, 1)
+	if len(s.upgradeCh) > 0 {
+		// the waiting upgrade holds entries this acquisition waits for, let it fail
+		s.broadcast()
+	}
+
+	// wait for the previous exclusive holder
+	select {
+	case s.exclusiveCh <- struct{}{}:
+	case <-ctxDoneCh:
+		s.leaveExclusive()
+		return ctx.Err()
+	}
+
+	for {
+		// check if context is done
+		select {
+		case <-ctxDoneCh:
+			<-s.exclusiveCh
+			s.leaveExclusive()
+			return ctx.Err()
+		default:
+		}
+
+		// get current semaphore count and limit
+		state := atomic.LoadUint64(&s.state)
+		count := state & 0xFFFFFFFF
+		limit := state >> 32
+
+		if count == 0 {
+			if atomic.CompareAndSwapUint64(&s.state, state, limit<<32+limit) {
+				// acquired
+				s.exclusiveHeld = limit
+				atomic.StoreInt32(&s.exclusiveHolding, 1)
+				return nil
+			}
+
+			// CAS failed, try again
+			continue
+		}
+
+		// shared holders are still running, let's wait
+		broadcastCh := s.getBroadcastCh()
+
+		// ensure that the state is the same as when we first checked; this
+		// ensures that the broadcastCh will eventually be closed by a Release.
+		if atomic.LoadUint64(&s.state) != state {
+			continue
+		}
+
+		select {
+		// check if context is done
+		case <-ctxDoneCh:
+			<-s.exclusiveCh
+			s.leaveExclusive()
+			return ctx.Err()
+		// waiting for broadcast signal
+		case <-broadcastCh:
+		}
+	}
+}
+
+func (s *semaphore) ReleaseExclusive() {
+	if !atomic.CompareAndSwapInt32(&s.exclusiveHolding, 1, 0) {
+		panic("semaphore exclusive release without exclusive acquire")
+	}
+	held := s.exclusiveHeld
+	for {
+		state := atomic.LoadUint64(&s.state)
+		if atomic.CompareAndSwapUint64(&s.state, state, state-held) {
+			break
+		}
+	}
+	<-s.exclusiveCh
+	s.leaveExclusive()
+}
+
+// leaveExclusive unblocks shared acquisitions blocked by the exclusive waiter or holder.
+func (s *semaphore) leaveExclusive() {
+	atomic.AddInt32(&s.exclusive, -1)
+	s.broadcast()
+}
@@ -0,0 +1,188 @@
+package semaphore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_AcquireExclusive(t *testing.T) {
+	sem := New(3)
+	ex := sem.(ExclusiveAcquirer)
+
+	if err := ex.AcquireExclusive(nil); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 3, 3)
+
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+
+	ex.ReleaseExclusive()
+	checkLimitAndCount(t, sem, 3, 0)
+
+	if !(sem.TryAcquire(1) == true) {
+		t.Fail()
+	}
+	checkLimitAndCount(t, sem, 3, 1)
+}
+
+func TestSemaphore_AcquireExclusive_waits_for_shared(t *testing.T) {
+	sem := New(3)
+	ex := sem.(ExclusiveAcquirer)
+	sem.Acquire(nil, 1)
+
+	acquired := make(chan struct{})
+	go func() {
+		ex.AcquireExclusive(nil)
+		close(acquired)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// queued exclusive waiter blocks new shared acquisitions
+	if !(sem.TryAcquire(1) == false) {
+		t.Error("shared acquisition must be blocked by exclusive waiter")
+	}
+	select {
+	case <-acquired:
+		t.Fatal("exclusive acquired while shared holder runs")
+	default:
+	}
+
+	sem.Release(1)
+	<-acquired
+	checkLimitAndCount(t, sem, 3, 3)
+
+	ex.ReleaseExclusive()
+	checkLimitAndCount(t, sem, 3, 0)
+}
+
+func TestSemaphore_AcquireExclusive_ctx_done(t *testing.T) {
+	sem := New(2)
+	ex := sem.(ExclusiveAcquirer)
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exErr := make(chan error)
+	go func() {
+		exErr <- ex.AcquireExclusive(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// shared waiter is blocked by exclusive waiter
+	sharedAcquired := make(chan struct{})
+	go func() {
+		sem.Acquire(nil, 1)
+		close(sharedAcquired)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-sharedAcquired:
+		t.Fatal("shared acquisition must be blocked by exclusive waiter")
+	default:
+	}
+
+	cancel()
+	if err := <-exErr; err != context.Canceled {
+		t.Error("Error is not context.Canceled")
+	}
+	select {
+	case <-sharedAcquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shared waiter is not woken up after exclusive waiter is cancelled")
+	}
+	checkLimitAndCount(t, sem, 2, 2)
+}
+
+func TestSemaphore_AcquireExclusive_SetLimit(t *testing.T) {
+	sem := New(2)
+	ex := sem.(ExclusiveAcquirer)
+	ex.AcquireExclusive(nil)
+
+	// raising limit doesn't let shared holders in
+	sem.SetLimit(4)
+	checkLimitAndCount(t, sem, 4, 2)
+	if !(sem.TryAcquire(1) == false) {
+		t.Error("shared acquisition must be blocked by exclusive holder")
+	}
+
+	// lowering limit keeps the count over limit
+	sem.SetLimit(1)
+	checkLimitAndCount(t, sem, 1, 2)
+
+	ex.ReleaseExclusive()
+	checkLimitAndCount(t, sem, 1, 0)
+
+	// the next exclusive holder takes the new limit
+	ex.AcquireExclusive(nil)
+	checkLimitAndCount(t, sem, 1, 1)
+	ex.ReleaseExclusive()
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestSemaphore_ReleaseExclusive_without_AcquireExclusive_panic_expected(t *testing.T) {
+	sem := New(1)
+	sem.Acquire(nil, 1)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected")
+		}
+	}()
+	sem.(ExclusiveAcquirer).ReleaseExclusive()
+}
+
+func TestSemaphore_AcquireExclusive_contention(t *testing.T) {
+	sem := New(5)
+	ex := sem.(ExclusiveAcquirer)
+	var shared, exclusive int32
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < 1000; j++ {
+				if err := sem.Acquire(nil, 1); err != nil {
+					panic(err)
+				}
+				atomic.AddInt32(&shared, 1)
+				if atomic.LoadInt32(&exclusive) != 0 {
+					t.Error("shared holder runs together with exclusive holder")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&shared, -1)
+				sem.Release(1)
+			}
+			wg.Done()
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < 100; j++ {
+				if err := ex.AcquireExclusive(nil); err != nil {
+					panic(err)
+				}
+				if atomic.AddInt32(&exclusive, 1) != 1 || atomic.LoadInt32(&shared) != 0 {
+					t.Error("exclusive holder doesn't run alone")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&exclusive, -1)
+				ex.ReleaseExclusive()
+			}
+			wg.Done()
+		}()
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkLimitAndCount(t, sem, 5, 0)
+}
@@ -1,3 +1,3 @@
 module github.com/marusama/semaphore/v2
 
-go 1.11
+go 1.18
@@ -0,0 +1,316 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Group is a set of sibling semaphores sharing their capacity.
+// Every semaphore of the group has a guaranteed limit and may borrow entries left unused by its siblings,
+// up to its own cap. When a sibling needs its guaranteed entries again, borrowing stops,
+// entries released by the borrowers are returned to it, and the borrowers' permits acquired by
+// AcquirePermit are revoked like on a lowered limit, so the borrowed entries are reclaimed.
+//
+// The semaphores of a group implement Semaphore, StatsReporter, PermitAcquirer and Borrower.
+// Their GetLimit and SetLimit are the guaranteed limit, the count may be above it while borrowing.
+// Acquisitions within the current share of a semaphore are lock-free, only the others are serialized by the group.
+type Group struct {
+	mu      sync.Mutex
+	members []*groupMember
+	total   int // sum of guaranteed limits
+
+	// unbalanced is set while some semaphore waits or has a limit different from its guaranteed one,
+	// then releases rebalance the limits
+	unbalanced int32
+}
+
+// Borrower is implemented by the semaphores of a Group.
+type Borrower interface {
+	// GetBorrowed returns the number of occupied entries over the guaranteed limit, borrowed from siblings.
+	GetBorrowed() int
+}
+
+// groupMember is a semaphore of a Group, the limit of its underlying semaphore is its current share.
+type groupMember struct {
+	g   *Group
+	sem *semaphore
+
+	// set under the group lock
+	guaranteed int
+	maxBorrow  int
+	demand     int // entries wanted by waiting calls
+}
+
+// NewGroup creates an empty Group.
+func NewGroup() *Group {
+	return &Group{}
+}
+
+// New adds a semaphore with the guaranteed limit to the group,
+// it may borrow up to maxBorrow entries from its siblings.
+func (g *Group) New(limit, maxBorrow int) Semaphore {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	if maxBorrow < 0 {
+		panic("maxBorrow must not be negative")
+	}
+	m := &groupMember{
+		g:          g,
+		sem:        New(0).(*semaphore),
+		guaranteed: limit,
+		maxBorrow:  maxBorrow,
+	}
+	m.sem.onRelease = g.released
+
+	g.mu.Lock()
+	g.members = append(g.members, m)
+	g.total += limit
+	g.rebalance()
+	g.mu.Unlock()
+	return m
+}
+
+// released is called after every release of a semaphore.
+func (s *semaphore) released() {
+	if s.onRelease != nil {
+		s.onRelease()
+	}
+}
+
+// released rebalances the limits after a release if anything is borrowed or wanted.
+func (g *Group) released() {
+	if atomic.LoadInt32(&g.unbalanced) == 0 {
+		return
+	}
+	g.mu.Lock()
+	g.rebalance()
+	g.mu.Unlock()
+}
+
+// rebalance shares the total capacity among the semaphores, the lock must be held.
+// Occupied entries stay where they are, free ones go first to the semaphores waiting within their guaranteed limit,
+// then, if there are no such semaphores, to the borrowing ones within their caps,
+// and the rest back to the semaphores below their guaranteed limit.
+// If a semaphore waits within its guaranteed limit, borrowers are limited to their guaranteed limit,
+// which is below their count, so they can't acquire until they release the borrowed entries.
+func (g *Group) rebalance() {
+	ms := g.members
+	counts := make([]int, len(ms))
+	targets := make([]int, len(ms))
+	free := g.total
+	for i, m := range ms {
+		counts[i] = m.sem.GetCount()
+		free -= counts[i]
+		// occupied entries stay where they are, but not over the cap, e.g. after lowering the guaranteed limit
+		targets[i] = counts[i]
+		if max := m.guaranteed + m.maxBorrow; targets[i] > max {
+			targets[i] = max
+		}
+	}
+	give := func(i, want int) {
+		if want > free {
+			want = free
+		}
+		if want > 0 {
+			targets[i] += want
+			free -= want
+		}
+	}
+
+	// guaranteed entries of waiting semaphores
+	unmet := false
+	for i, m := range ms {
+		want := m.guaranteed
+		if need := counts[i] + m.demand; need < want {
+			want = need
+		}
+		give(i, want-targets[i])
+		if targets[i] < want {
+			unmet = true
+		}
+	}
+
+	if unmet {
+		// reclaim borrowed entries
+		for i, m := range ms {
+			if targets[i] > m.guaranteed {
+				targets[i] = m.guaranteed
+			}
+		}
+	} else {
+		// borrowing
+		for i, m := range ms {
+			want := m.guaranteed + m.maxBorrow
+			if need := counts[i] + m.demand; need < want {
+				want = need
+			}
+			give(i, want-targets[i])
+		}
+	}
+
+	// unused guaranteed entries, so that acquisitions within them don't need the group
+	for i, m := range ms {
+		give(i, m.guaranteed-targets[i])
+	}
+
+	// lower the limits first, the freed entries are given to others only after that
+	unbalanced := false
+	for i, m := range ms {
+		if targets[i] < m.sem.GetLimit() {
+			if targets[i] < counts[i] {
+				// reclaimed or over the cap, revokes permits over the limit
+				m.sem.SetLimit(targets[i])
+			} else {
+				m.sem.shrinkLimit(targets[i])
+			}
+		}
+		if targets[i] != m.guaranteed || m.demand > 0 {
+			unbalanced = true
+		}
+	}
+	free = g.total
+	for _, m := range ms {
+		if used := m.sem.GetCount(); used > m.sem.GetLimit() {
+			free -= used
+		} else {
+			free -= m.sem.GetLimit()
+		}
+	}
+	for i, m := range ms {
+		limit := m.sem.GetLimit()
+		if targets[i] <= limit {
+			continue
+		}
+		// entries up to the count are occupied already
+		occupied := m.sem.GetCount()
+		if occupied < limit {
+			occupied = limit
+		}
+		newLimit := targets[i]
+		if newLimit > occupied+free {
+			newLimit = occupied + free
+		}
+		if newLimit > limit {
+			m.sem.SetLimit(newLimit)
+			if newLimit > occupied {
+				free -= newLimit - occupied
+			}
+		}
+	}
+
+	if unbalanced {
+		atomic.StoreInt32(&g.unbalanced, 1)
+	} else {
+		atomic.StoreInt32(&g.unbalanced, 0)
+	}
+}
+
+// shrinkLimit lowers the limit to limit, or to the count if it's higher.
+func (s *semaphore) shrinkLimit(limit int) {
+	s.newLimitReq(limit)
+	for {
+		state := atomic.LoadUint64(&s.state)
+		newLimit := uint64(limit)
+		if count := state & 0xFFFFFFFF; count > newLimit {
+			newLimit = count
+		}
+		if atomic.CompareAndSwapUint64(&s.state, state, newLimit<<32+state&0xFFFFFFFF) {
+			return
+		}
+	}
+}
+
+// want registers the demand of n entries and rebalances, the returned function unregisters it.
+func (m *groupMember) want(n int) func() {
+	g := m.g
+	g.mu.Lock()
+	m.demand += n
+	g.rebalance()
+	g.mu.Unlock()
+	return func() {
+		g.mu.Lock()
+		m.demand -= n
+		g.rebalance()
+		g.mu.Unlock()
+	}
+}
+
+func (m *groupMember) Acquire(ctx context.Context, n int) error {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	// done context fails even if entries are free, like the semaphore does
+	if ctx != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if m.sem.TryAcquire(n) {
+		return nil
+	}
+	defer m.want(n)()
+	return m.sem.Acquire(ctx, n)
+}
+
+func (m *groupMember) TryAcquire(n int) bool {
+	if m.sem.TryAcquire(n) {
+		return true
+	}
+	defer m.want(n)()
+	return m.sem.TryAcquire(n)
+}
+
+func (m *groupMember) AcquirePermit(ctx context.Context, n int, opts ...PermitOption) (*Permit, error) {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	if p := m.sem.tryAcquirePermit(ctx, n, opts); p != nil {
+		return p, nil
+	}
+	defer m.want(n)()
+	return m.sem.AcquirePermit(ctx, n, opts...)
+}
+
+func (m *groupMember) Release(n int) int {
+	return m.sem.Release(n)
+}
+
+// SetLimit changes the guaranteed limit.
+func (m *groupMember) SetLimit(limit int) {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	g := m.g
+	g.mu.Lock()
+	g.total += limit - m.guaranteed
+	m.guaranteed = limit
+	g.rebalance()
+	g.mu.Unlock()
+}
+
+// GetLimit returns the guaranteed limit.
+func (m *groupMember) GetLimit() int {
+	g := m.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return m.guaranteed
+}
+
+func (m *groupMember) GetCount() int {
+	return m.sem.GetCount()
+}
+
+func (m *groupMember) GetBorrowed() int {
+	if borrowed := m.GetCount() - m.GetLimit(); borrowed > 0 {
+		return borrowed
+	}
+	return 0
+}
+
+func (m *groupMember) Stats() Stats {
+	return m.sem.Stats()
+}
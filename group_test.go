@@ -0,0 +1,254 @@
+package semaphore
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func checkBorrowed(t *testing.T, sem Semaphore, borrowed int) {
+	t.Helper()
+	if b := sem.(Borrower).GetBorrowed(); b != borrowed {
+		t.Error("semaphore must have borrowed = ", borrowed, ", but has ", b)
+	}
+}
+
+func TestGroup_borrow(t *testing.T) {
+	g := NewGroup()
+	a := g.New(2, 2)
+	b := g.New(2, 0)
+
+	for i := 0; i < 4; i++ {
+		if !a.TryAcquire(1) {
+			t.Fatal("borrowing expected")
+		}
+	}
+	if a.TryAcquire(1) {
+		t.Error("borrowing over the cap")
+	}
+	checkLimitAndCount(t, a, 2, 4)
+	checkBorrowed(t, a, 2)
+	if b.TryAcquire(1) {
+		t.Error("capacity is borrowed")
+	}
+	checkLimitAndCount(t, b, 2, 0)
+
+	// borrowed entries are returned
+	a.Release(3)
+	checkBorrowed(t, a, 0)
+	if !b.TryAcquire(2) {
+		t.Error("capacity must be returned")
+	}
+	a.Release(1)
+	b.Release(2)
+	checkLimitAndCount(t, a, 2, 0)
+	checkLimitAndCount(t, b, 2, 0)
+}
+
+func TestGroup_no_borrow(t *testing.T) {
+	g := NewGroup()
+	a := g.New(2, 0)
+	g.New(2, 2)
+
+	if !a.TryAcquire(2) || a.TryAcquire(1) {
+		t.Error("only the guaranteed limit expected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := a.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	checkLimitAndCount(t, a, 2, 2)
+}
+
+func TestGroup_owner_first(t *testing.T) {
+	g := NewGroup()
+	a := g.New(1, 3)
+	b := g.New(3, 0)
+
+	a.Acquire(nil, 4)
+	checkBorrowed(t, a, 3)
+
+	acquired := make(chan struct{})
+	go func() {
+		b.Acquire(nil, 2)
+		close(acquired)
+	}()
+	for b.(StatsReporter).Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the owner waits, so borrowing stops
+	a.Release(1)
+	if a.TryAcquire(1) {
+		t.Error("borrowing while the owner waits")
+	}
+	a.Release(1)
+	<-acquired
+	checkLimitAndCount(t, b, 3, 2)
+	checkLimitAndCount(t, a, 1, 2)
+	checkBorrowed(t, a, 1)
+}
+
+func TestGroup_reclaim_permits(t *testing.T) {
+	g := NewGroup()
+	a := g.New(1, 2)
+	b := g.New(2, 0)
+
+	own, err := a.(PermitAcquirer).AcquirePermit(nil, 1)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	borrowed, err := a.(PermitAcquirer).AcquirePermit(nil, 2)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkBorrowed(t, a, 2)
+
+	acquired := make(chan struct{})
+	go func() {
+		b.Acquire(nil, 1)
+		close(acquired)
+	}()
+
+	// the owner needs its entries, the newest permit is revoked
+	select {
+	case <-borrowed.Context().Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("borrowed permit must be reclaimed")
+	}
+	checkRevoked(t, own, false)
+	borrowed.Release()
+	<-acquired
+	checkLimitAndCount(t, a, 1, 1)
+	checkLimitAndCount(t, b, 2, 1)
+	own.Release()
+}
+
+func TestGroup_AcquirePermit_free_entries(t *testing.T) {
+	g := NewGroup()
+	a := g.New(2, 2)
+	g.New(2, 0)
+
+	// free entries are taken without registering demand, which takes the group lock
+	acquired := make(chan *Permit)
+	g.mu.Lock()
+	go func() {
+		p, _ := a.(PermitAcquirer).AcquirePermit(nil, 1)
+		acquired <- p
+	}()
+	var p *Permit
+	select {
+	case p = <-acquired:
+	case <-time.After(10 * time.Second):
+		t.Fatal("AcquirePermit of free entries must not wait for the group")
+	}
+	g.mu.Unlock()
+	checkLimitAndCount(t, a, 2, 1)
+	checkBorrowed(t, a, 0)
+	p.Release()
+	checkLimitAndCount(t, a, 2, 0)
+}
+
+func TestGroup_SetLimit(t *testing.T) {
+	g := NewGroup()
+	a := g.New(2, 10)
+	b := g.New(2, 0)
+
+	b.SetLimit(5)
+	checkLimitAndCount(t, b, 5, 0)
+	if !a.TryAcquire(7) || a.TryAcquire(1) {
+		t.Error("borrowing of the raised limit expected")
+	}
+	a.Release(7)
+
+	b.SetLimit(0)
+	if !a.TryAcquire(2) || a.TryAcquire(1) {
+		t.Error("nothing to borrow expected")
+	}
+	a.Release(2)
+}
+
+func TestGroup_concurrent(t *testing.T) {
+	g := NewGroup()
+	guaranteed := []int{3, 2, 1}
+	caps := []int{2, 0, 5}
+	sems := make([]Semaphore, len(guaranteed))
+	for i := range sems {
+		sems[i] = g.New(guaranteed[i], caps[i])
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := make([]int, len(sems))
+	var overLimit bool
+	for w := 0; w < 12; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			i := w % len(sems)
+			sem := sems[i]
+			for j := 0; j < 300; j++ {
+				n := 1 + r.Intn(2)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				err := sem.Acquire(ctx, n)
+				cancel()
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				counts[i] += n
+				total := 0
+				for k, c := range counts {
+					total += c
+					if c > guaranteed[k]+caps[k] {
+						overLimit = true
+					}
+				}
+				if total > 6 {
+					overLimit = true
+				}
+				mu.Unlock()
+
+				runtime.Gosched()
+
+				mu.Lock()
+				counts[i] -= n
+				mu.Unlock()
+				sem.Release(n)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if overLimit {
+		t.Error("capacity exceeded")
+	}
+	for i, sem := range sems {
+		checkLimitAndCount(t, sem, guaranteed[i], 0)
+	}
+}
+
+func TestGroup_panic_expected(t *testing.T) {
+	tests := []func(){
+		func() { NewGroup().New(-1, 0) },
+		func() { NewGroup().New(1, -1) },
+		func() { NewGroup().New(1, 0).SetLimit(-1) },
+		func() { NewGroup().New(1, 0).Acquire(nil, 0) },
+		func() { NewGroup().New(1, 0).(PermitAcquirer).AcquirePermit(nil, 0) },
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			test()
+		}()
+	}
+}
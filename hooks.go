@@ -0,0 +1,37 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import "github.com/marusama/semaphore/v2/internal/testhooks"
+
+func init() {
+	testhooks.New = func(limit int, hooks *testhooks.Hooks) interface{} {
+		s := New(limit).(*semaphore)
+		s.hooks = hooks
+		return s
+	}
+}
+
+// yield lets the simulation harness switch goroutines before the next step.
+func (s *semaphore) yield(point string) {
+	if s.hooks != nil {
+		s.hooks.Yield(point)
+	}
+}
+
+// wait blocks until ctx is done or a broadcast is received, it reports whether ctx is done.
+func (s *semaphore) wait(ctxDoneCh <-chan struct{}, broadcastCh chan struct{}) bool {
+	if s.hooks != nil {
+		return s.hooks.Park("acquire.wait", ctxDoneCh, broadcastCh) == 0
+	}
+	select {
+	// check if context is done
+	case <-ctxDoneCh:
+		return true
+	// waiting for broadcast signal
+	case <-broadcastCh:
+		return false
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package testhooks connects the semaphore implementation to the semaphoretest simulation harness.
+package testhooks
+
+// Hooks are called by an instrumented semaphore at points where goroutines may interleave.
+type Hooks struct {
+	// Yield is called before every step of the semaphore state machine, point names the step.
+	Yield func(point string)
+
+	// Park is called instead of blocking on the channels, it returns the index of a closed channel.
+	// Nil channels are never closed.
+	Park func(point string, chs ...<-chan struct{}) int
+}
+
+// New creates a semaphore.Semaphore calling hooks, it's set by package semaphore.
+var New func(limit int, hooks *Hooks) interface{}
@@ -0,0 +1,18 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import "time"
+
+// Option configures the Semaphore created by NewWithOptions.
+type Option func(*options)
+
+type options struct {
+	spinMax time.Duration
+
+	// slowStart is the duration of the ramp from slowStartFrom to the limit
+	slowStart     time.Duration
+	slowStartFrom int
+}
@@ -0,0 +1,362 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PermitAcquirer is implemented by semaphores handing out revocable permits,
+// the Semaphore returned by New implements it.
+// When the limit is lowered below the count, by SetLimit or RampLimit, the semaphore cancels the contexts
+// of enough permits to cover the excess, lowest priority first and of equal priorities newest first,
+// so cooperative holders can abort and release and the count converges to the new limit.
+// Entries held by Acquire count against the limit, but they are never revoked.
+//
+// Permits acquired WithPreemptible are also preempted, in the same order, when an AcquirePermit call
+// of a higher priority has to wait: their contexts are cancelled, and if they are not released within
+// their grace period while such a call still waits, the semaphore releases their entries itself. Preemptible permits already revoked
+// by a lowered limit get the grace period then too.
+type PermitAcquirer interface {
+	// AcquirePermit acquires n entries like Acquire and returns them as a Permit,
+	// whose context is derived from ctx.
+	AcquirePermit(ctx context.Context, n int, opts ...PermitOption) (*Permit, error)
+}
+
+// PermitOption configures a Permit.
+type PermitOption func(*Permit)
+
+// WithPriority sets the priority of the permit, 0 by default. Permits of lower priority are revoked first,
+// and preemptible ones are preempted by AcquirePermit calls of higher priority.
+func WithPriority(priority int) PermitOption {
+	return func(p *Permit) {
+		p.priority = priority
+	}
+}
+
+// WithPreemptible makes the permit preemptible by AcquirePermit calls of higher priority.
+// A preempted permit is forcibly released after grace, its holder must stop using the entries by then.
+func WithPreemptible(grace time.Duration) PermitOption {
+	return func(p *Permit) {
+		p.preemptible = true
+		p.grace = grace
+	}
+}
+
+// Permit is a holding of entries which the semaphore may revoke, it must be released by its Release.
+type Permit struct {
+	sem         *semaphore
+	n           int
+	priority    int
+	preemptible bool
+	grace       time.Duration
+	seq         uint64 // acquisition order
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// set under the lock of the semaphore permits
+	revoked  bool
+	released bool
+	forced   bool        // released by the semaphore after the grace period
+	timer    *time.Timer // of the forced release
+}
+
+// permitSet holds the outstanding permits of a semaphore.
+type permitSet struct {
+	mu      sync.Mutex
+	permits map[*Permit]struct{}
+	seq     uint64
+
+	// revoked is the weight of revoked, not yet released permits
+	revoked int
+
+	// demand is the weight wanted by waiting AcquirePermit calls by their priority
+	demand map[int]int
+
+	// size is the number of outstanding permits, checked without the lock
+	size int32
+}
+
+func (s *semaphore) AcquirePermit(ctx context.Context, n int, opts ...PermitOption) (*Permit, error) {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	p := s.newPermit(n, opts)
+	if err := s.acquirePreempting(ctx, p); err != nil {
+		return nil, err
+	}
+	s.addPermit(ctx, p)
+	return p, nil
+}
+
+// tryAcquirePermit acquires a permit only if its entries are free, it returns nil otherwise.
+func (s *semaphore) tryAcquirePermit(ctx context.Context, n int, opts []PermitOption) *Permit {
+	p := s.newPermit(n, opts)
+	if !s.TryAcquire(n) {
+		return nil
+	}
+	s.addPermit(ctx, p)
+	return p
+}
+
+func (s *semaphore) newPermit(n int, opts []PermitOption) *Permit {
+	p := &Permit{
+		sem: s,
+		n:   n,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// addPermit registers the permit whose entries are acquired.
+func (s *semaphore) addPermit(ctx context.Context, p *Permit) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	ps := &s.permits
+	ps.mu.Lock()
+	if ps.permits == nil {
+		ps.permits = make(map[*Permit]struct{})
+	}
+	ps.seq++
+	p.seq = ps.seq
+	ps.permits[p] = struct{}{}
+	atomic.AddInt32(&ps.size, 1)
+	waiting := len(ps.demand) > 0
+	ps.mu.Unlock()
+
+	// the limit may have been lowered before the permit was registered
+	s.revokeOverLimit()
+	if waiting && p.preemptible {
+		// waiting calls may preempt the new permit
+		s.broadcast()
+	}
+}
+
+// acquirePreempting acquires the entries of p, preempting lower priority permits while it waits.
+func (s *semaphore) acquirePreempting(ctx context.Context, p *Permit) error {
+	if s.TryAcquire(p.n) {
+		return nil
+	}
+	var ctxDoneCh <-chan struct{}
+	if ctx != nil {
+		ctxDoneCh = ctx.Done()
+	}
+
+	ps := &s.permits
+	ps.mu.Lock()
+	if ps.demand == nil {
+		ps.demand = make(map[int]int)
+	}
+	ps.demand[p.priority] += p.n
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		if ps.demand[p.priority] -= p.n; ps.demand[p.priority] == 0 {
+			delete(ps.demand, p.priority)
+		}
+		ps.mu.Unlock()
+	}()
+
+	var w waiting
+	for {
+		// the channel is taken before the check, so a release after it isn't missed
+		broadcastCh := s.getBroadcastCh()
+		if s.TryAcquire(p.n) {
+			w.done(&s.stats, false)
+			return nil
+		}
+		s.preempt(p.priority)
+
+		w.park(&s.stats)
+		cancelled := s.wait(ctxDoneCh, broadcastCh)
+		w.unpark(&s.stats)
+		if cancelled {
+			w.done(&s.stats, true)
+			return ctx.Err()
+		}
+	}
+}
+
+// Context returns the context of the permit, it's cancelled when the permit is revoked or released.
+func (p *Permit) Context() context.Context {
+	return p.ctx
+}
+
+// Revoked reports whether the semaphore has revoked or preempted the permit.
+func (p *Permit) Revoked() bool {
+	ps := &p.sem.permits
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return p.revoked
+}
+
+// Release releases the entries of the permit, cancels its context and returns the previous count.
+// If the semaphore has already released a preempted permit, only the context is cancelled.
+func (p *Permit) Release() int {
+	// the count and the revoked weight change together, so revocation doesn't see the permit twice
+	ps := &p.sem.permits
+	ps.mu.Lock()
+	if p.released {
+		ps.mu.Unlock()
+		panic("permit is already released")
+	}
+	p.released = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	var count int
+	if p.forced {
+		count = p.sem.GetCount()
+	} else {
+		p.detach()
+		count = p.sem.release(p.n)
+	}
+	ps.mu.Unlock()
+
+	p.cancel()
+	if !p.forced {
+		p.sem.released()
+	}
+	return count
+}
+
+// forceRelease releases the entries of the preempted permit when the grace period is over,
+// if an AcquirePermit call of higher priority still waits for them.
+func (p *Permit) forceRelease() {
+	ps := &p.sem.permits
+	ps.mu.Lock()
+	if p.released || p.forced {
+		ps.mu.Unlock()
+		return
+	}
+	if !ps.waitingAbove(p.priority) {
+		// the preempting calls are cancelled or done, the next one starts a new grace period
+		p.timer = nil
+		ps.mu.Unlock()
+		return
+	}
+	p.forced = true
+	p.detach()
+	// counted before the entries are released, so whoever acquires them sees it
+	atomic.AddUint64(&p.sem.stats.forcedReleases, 1)
+	p.sem.release(p.n)
+	ps.mu.Unlock()
+
+	p.sem.released()
+}
+
+// detach removes the permit from the semaphore permits, the lock must be held.
+func (p *Permit) detach() {
+	ps := &p.sem.permits
+	if p.revoked {
+		ps.revoked -= p.n
+	}
+	delete(ps.permits, p)
+	atomic.AddInt32(&ps.size, -1)
+}
+
+// revokeOverLimit revokes permits until the weight of revoked ones covers the count over the limit.
+func (s *semaphore) revokeOverLimit() {
+	ps := &s.permits
+	if atomic.LoadInt32(&ps.size) == 0 {
+		return
+	}
+	ps.mu.Lock()
+	excess := s.GetCount() - s.GetLimit() - ps.revoked
+	revoked := ps.revoke(excess, func(p *Permit) bool { return true })
+	ps.mu.Unlock()
+
+	// cancel outside of the lock, context callbacks may call back
+	for _, p := range revoked {
+		p.cancel()
+	}
+}
+
+// preempt preempts preemptible permits of lower priority than priority until the weight of revoked ones
+// covers the demand of the waiting AcquirePermit calls of the same or higher priority.
+func (s *semaphore) preempt(priority int) {
+	ps := &s.permits
+	if atomic.LoadInt32(&ps.size) == 0 {
+		return
+	}
+	ps.mu.Lock()
+	demand := 0
+	for pr, n := range ps.demand {
+		if pr >= priority {
+			demand += n
+		}
+	}
+	eligible := func(p *Permit) bool {
+		return p.preemptible && p.priority < priority
+	}
+	excess := s.GetCount() + demand - s.GetLimit() - ps.revoked
+	ps.revoke(excess, eligible)
+	// permits revoked by a lowered limit are preempted too, or their holders could keep them forever
+	var preempted []*Permit
+	for p := range ps.permits {
+		if p.revoked && p.timer == nil && eligible(p) {
+			p.timer = time.AfterFunc(p.grace, p.forceRelease)
+			preempted = append(preempted, p)
+		}
+	}
+	ps.mu.Unlock()
+
+	atomic.AddUint64(&s.stats.preemptions, uint64(len(preempted)))
+	for _, p := range preempted {
+		p.cancel()
+	}
+}
+
+// waitingAbove reports whether AcquirePermit calls of higher priority than priority wait. The lock must be held.
+func (ps *permitSet) waitingAbove(priority int) bool {
+	for pr := range ps.demand {
+		if pr > priority {
+			return true
+		}
+	}
+	return false
+}
+
+// revoke marks the permits accepted by eligible as revoked, lowest priority first and of equal priorities
+// newest first, until their weight covers excess, and returns them. The lock must be held.
+func (ps *permitSet) revoke(excess int, eligible func(p *Permit) bool) []*Permit {
+	if excess <= 0 {
+		return nil
+	}
+	candidates := make([]*Permit, 0, len(ps.permits))
+	for p := range ps.permits {
+		if !p.revoked && eligible(p) {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.seq > b.seq
+	})
+	revoked := candidates[:0]
+	for _, p := range candidates {
+		if excess <= 0 {
+			break
+		}
+		p.revoked = true
+		ps.revoked += p.n
+		excess -= p.n
+		revoked = append(revoked, p)
+	}
+	return revoked
+}
@@ -0,0 +1,337 @@
+package semaphore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func acquirePermit(t *testing.T, sem Semaphore, n int, opts ...PermitOption) *Permit {
+	t.Helper()
+	p, err := sem.(PermitAcquirer).AcquirePermit(context.Background(), n, opts...)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	return p
+}
+
+func checkRevoked(t *testing.T, p *Permit, revoked bool) {
+	t.Helper()
+	if p.Revoked() != revoked {
+		t.Error("permit revoked", revoked, "expected")
+	}
+	if (p.Context().Err() != nil) != revoked {
+		t.Error("permit context cancelled", revoked, "expected, got", p.Context().Err())
+	}
+}
+
+func TestSemaphore_AcquirePermit(t *testing.T) {
+	sem := New(5)
+	p := acquirePermit(t, sem, 3)
+	checkLimitAndCount(t, sem, 5, 3)
+	checkRevoked(t, p, false)
+
+	if oldCnt := p.Release(); oldCnt != 3 {
+		t.Error("semaphore must have old count = ", 3, ", but has ", oldCnt)
+	}
+	checkLimitAndCount(t, sem, 5, 0)
+	if p.Context().Err() != context.Canceled || p.Revoked() {
+		t.Error("released permit context must be cancelled without revocation")
+	}
+}
+
+func TestSemaphore_AcquirePermit_revoke_newest_first(t *testing.T) {
+	sem := New(5)
+	p1 := acquirePermit(t, sem, 2)
+	p2 := acquirePermit(t, sem, 1)
+	p3 := acquirePermit(t, sem, 1)
+	sem.Acquire(nil, 1) // not revocable
+
+	// excess 2: the newest ones
+	sem.SetLimit(3)
+	checkRevoked(t, p1, false)
+	checkRevoked(t, p2, true)
+	checkRevoked(t, p3, true)
+
+	// revoked permits are counted as released, no more revocations
+	sem.SetLimit(3)
+	checkRevoked(t, p1, false)
+
+	p3.Release()
+	p2.Release()
+	checkLimitAndCount(t, sem, 3, 3)
+
+	// raising the limit doesn't revoke
+	sem.SetLimit(10)
+	checkRevoked(t, p1, false)
+}
+
+func TestSemaphore_AcquirePermit_revoke_priority(t *testing.T) {
+	sem := New(4)
+	high := acquirePermit(t, sem, 1, WithPriority(10))
+	low := acquirePermit(t, sem, 2, WithPriority(-1))
+	normal := acquirePermit(t, sem, 1)
+
+	// excess 1: the lowest priority one, weight 2
+	sem.SetLimit(3)
+	checkRevoked(t, high, false)
+	checkRevoked(t, low, true)
+	checkRevoked(t, normal, false)
+
+	// excess 4 - 2 revoked - 1 limit
+	sem.SetLimit(1)
+	checkRevoked(t, high, false)
+	checkRevoked(t, normal, true)
+
+	sem.SetLimit(0)
+	checkRevoked(t, high, true)
+}
+
+func TestSemaphore_AcquirePermit_RampLimit(t *testing.T) {
+	sem := New(4)
+	permits := make([]*Permit, 4)
+	for i := range permits {
+		permits[i] = acquirePermit(t, sem, 1)
+	}
+	if err := sem.(Ramper).RampLimit(nil, 2, 0); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkRevoked(t, permits[0], false)
+	checkRevoked(t, permits[1], false)
+	checkRevoked(t, permits[2], true)
+	checkRevoked(t, permits[3], true)
+}
+
+func TestSemaphore_AcquirePermit_ctx(t *testing.T) {
+	sem := New(1)
+	sem.Acquire(nil, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if p, err := sem.(PermitAcquirer).AcquirePermit(ctx, 1); err != context.DeadlineExceeded || p != nil {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	sem.Release(1)
+
+	// the permit context is derived from ctx
+	ctx, cancel = context.WithCancel(context.Background())
+	p, err := sem.(PermitAcquirer).AcquirePermit(ctx, 1)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	cancel()
+	if p.Context().Err() != context.Canceled || p.Revoked() {
+		t.Error("permit context must be cancelled with ctx")
+	}
+	p.Release()
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestSemaphore_AcquirePermit_release_twice_panic_expected(t *testing.T) {
+	p := acquirePermit(t, New(1), 1)
+	p.Release()
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected")
+		}
+	}()
+	p.Release()
+}
+
+func TestSemaphore_AcquirePermit_converges(t *testing.T) {
+	sem := New(10)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				p, err := sem.(PermitAcquirer).AcquirePermit(ctx, 1)
+				cancel()
+				if err != nil {
+					continue
+				}
+				// cooperative worker, works until revoked
+				select {
+				case <-p.Context().Done():
+				case <-stop:
+				}
+				p.Release()
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	sem.SetLimit(2)
+	deadline := time.Now().Add(5 * time.Second)
+	for sem.GetCount() > 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("count must converge to the limit, got", sem.GetCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+func acquirePermitAsync(sem Semaphore, ctx context.Context, n int, opts ...PermitOption) <-chan *Permit {
+	ch := make(chan *Permit, 1)
+	go func() {
+		p, _ := sem.(PermitAcquirer).AcquirePermit(ctx, n, opts...)
+		ch <- p
+	}()
+	return ch
+}
+
+func TestSemaphore_AcquirePermit_preempt(t *testing.T) {
+	sem := New(2)
+	low := acquirePermit(t, sem, 2, WithPreemptible(10*time.Second))
+
+	high := acquirePermitAsync(sem, context.Background(), 1, WithPriority(1))
+	select {
+	case <-low.Context().Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("low priority permit must be preempted")
+	}
+	checkRevoked(t, low, true)
+
+	low.Release()
+	p := <-high
+	if p == nil {
+		t.Fatal("high priority permit expected")
+	}
+	checkLimitAndCount(t, sem, 2, 1)
+	if st := sem.(StatsReporter).Stats(); st.Preemptions != 1 || st.ForcedReleases != 0 {
+		t.Error("1 preemption expected, got", st)
+	}
+	p.Release()
+}
+
+func TestSemaphore_AcquirePermit_preempt_grace(t *testing.T) {
+	sem := New(1)
+	low := acquirePermit(t, sem, 1, WithPreemptible(20*time.Millisecond))
+
+	start := time.Now()
+	high := acquirePermitAsync(sem, context.Background(), 1, WithPriority(1))
+
+	// the holder ignores preemption, its entry is released after the grace period
+	p := <-high
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Error("grace period must pass, passed", elapsed)
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+
+	if oldCnt := low.Release(); oldCnt != 1 {
+		t.Error("semaphore must have old count = ", 1, ", but has ", oldCnt)
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+	if st := sem.(StatsReporter).Stats(); st.Preemptions != 1 || st.ForcedReleases != 1 {
+		t.Error("1 forced release expected, got", st)
+	}
+	p.Release()
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestSemaphore_AcquirePermit_preempt_cancelled(t *testing.T) {
+	sem := New(1)
+	low := acquirePermit(t, sem, 1, WithPreemptible(50*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if p := <-acquirePermitAsync(sem, ctx, 1, WithPriority(1)); p != nil {
+		t.Fatal("permit must not be acquired")
+	}
+	checkRevoked(t, low, true)
+
+	// nobody waits when the grace period is over, the permit keeps its entry
+	time.Sleep(100 * time.Millisecond)
+	checkLimitAndCount(t, sem, 1, 1)
+	if st := sem.(StatsReporter).Stats(); st.ForcedReleases != 0 {
+		t.Error("no forced release expected, got", st)
+	}
+
+	// the next preempting call starts a new grace period
+	p := <-acquirePermitAsync(sem, context.Background(), 1, WithPriority(1))
+	if p == nil {
+		t.Fatal("high priority permit expected")
+	}
+	if st := sem.(StatsReporter).Stats(); st.ForcedReleases != 1 {
+		t.Error("1 forced release expected, got", st)
+	}
+	low.Release()
+	p.Release()
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestSemaphore_AcquirePermit_preempt_newest_lowest(t *testing.T) {
+	sem := New(4)
+	old := acquirePermit(t, sem, 1, WithPreemptible(10*time.Second))
+	newest := acquirePermit(t, sem, 1, WithPreemptible(10*time.Second))
+	higher := acquirePermit(t, sem, 1, WithPreemptible(10*time.Second), WithPriority(1))
+	plain := acquirePermit(t, sem, 1)
+
+	high := acquirePermitAsync(sem, context.Background(), 1, WithPriority(2))
+	<-newest.Context().Done()
+	newest.Release()
+	p := <-high
+
+	checkRevoked(t, old, false)
+	checkRevoked(t, higher, false)
+	checkRevoked(t, plain, false)
+	p.Release()
+}
+
+func TestSemaphore_AcquirePermit_not_preempted(t *testing.T) {
+	sem := New(2)
+	plain := acquirePermit(t, sem, 1, WithPriority(-1))
+	same := acquirePermit(t, sem, 1, WithPreemptible(0), WithPriority(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if p := <-acquirePermitAsync(sem, ctx, 1, WithPriority(1)); p != nil {
+		t.Error("permit must not be acquired")
+	}
+	checkRevoked(t, plain, false)
+	checkRevoked(t, same, false)
+	checkLimitAndCount(t, sem, 2, 2)
+
+	// Acquire doesn't preempt
+	low := acquirePermit(t, New(1), 1, WithPreemptible(0))
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := low.sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	checkRevoked(t, low, false)
+}
+
+func TestSemaphore_AcquirePermit_preempt_revoked(t *testing.T) {
+	sem := New(2)
+	low := acquirePermit(t, sem, 2, WithPreemptible(10*time.Millisecond))
+
+	// revoked by the lowered limit, but the holder ignores it
+	sem.SetLimit(1)
+	checkRevoked(t, low, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := <-acquirePermitAsync(sem, ctx, 1, WithPriority(10))
+	if p == nil {
+		t.Fatal("high priority permit expected")
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+	if st := sem.(StatsReporter).Stats(); st.Preemptions != 1 || st.ForcedReleases != 1 {
+		t.Error("1 forced release expected, got", st)
+	}
+	low.Release()
+	p.Release()
+	checkLimitAndCount(t, sem, 1, 0)
+}
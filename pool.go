@@ -0,0 +1,229 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Get after the pool is closed.
+var ErrPoolClosed = errors.New("semaphore: pool is closed")
+
+// PoolOption configures the Pool created by NewPool.
+type PoolOption[T any] func(*poolOptions[T])
+
+type poolOptions[T any] struct {
+	healthCheck func(T) bool
+	idleTimeout time.Duration
+}
+
+// WithHealthCheck sets a function checking an idle object before it's handed out by Get,
+// unhealthy objects are destroyed.
+func WithHealthCheck[T any](check func(T) bool) PoolOption[T] {
+	return func(o *poolOptions[T]) {
+		o.healthCheck = check
+	}
+}
+
+// WithIdleTimeout makes the pool destroy objects that have been idle for longer than d.
+// They are destroyed by a background goroutine running until the pool is closed.
+func WithIdleTimeout[T any](d time.Duration) PoolOption[T] {
+	return func(o *poolOptions[T]) {
+		o.idleTimeout = d
+	}
+}
+
+// Pool is a pool of objects with a resizable limit of live objects.
+// Checked out objects are counted by a Semaphore, so Get waits while the limit is reached,
+// and idle objects are reused before new ones are created.
+type Pool[T any] struct {
+	sem     Semaphore
+	create  func(ctx context.Context) (T, error)
+	destroy func(T)
+	opts    poolOptions[T]
+
+	mu     sync.Mutex
+	idle   []idleObject[T] // oldest first
+	closed bool
+
+	// closed on Close to stop the idle janitor
+	closeCh chan struct{}
+}
+
+type idleObject[T any] struct {
+	obj   T
+	since time.Time
+}
+
+// NewPool creates a Pool of at most limit live objects made by create and destroyed by destroy.
+// destroy may be nil if objects need no cleanup.
+func NewPool[T any](limit int, create func(ctx context.Context) (T, error), destroy func(T), opts ...PoolOption[T]) *Pool[T] {
+	if destroy == nil {
+		destroy = func(T) {}
+	}
+	p := &Pool[T]{
+		sem:     New(limit),
+		create:  create,
+		destroy: destroy,
+		closeCh: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&p.opts)
+	}
+	if p.opts.idleTimeout > 0 {
+		go p.janitor()
+	}
+	return p
+}
+
+// Get checks out an idle object, or creates a new one, blocking only until ctx is done
+// while the limit of live objects is reached.
+// The object must be returned with Put or Discard.
+func (p *Pool[T]) Get(ctx context.Context) (T, error) {
+	var zero T
+	if err := p.sem.Acquire(ctx, 1); err != nil {
+		return zero, err
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.sem.Release(1)
+			return zero, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// most recently used objects are the most likely to be healthy
+		obj := p.idle[len(p.idle)-1].obj
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.opts.healthCheck == nil || p.opts.healthCheck(obj) {
+			return obj, nil
+		}
+		p.destroy(obj)
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	obj, err := p.create(ctx)
+	if err != nil {
+		p.sem.Release(1)
+		return zero, err
+	}
+	return obj, nil
+}
+
+// Put returns a checked out object to the pool.
+// The object is destroyed if the pool is closed or has more live objects than its limit.
+func (p *Pool[T]) Put(obj T) {
+	p.mu.Lock()
+	if p.closed || p.sem.GetCount()+len(p.idle) > p.sem.GetLimit() {
+		p.mu.Unlock()
+		p.destroy(obj)
+	} else {
+		p.idle = append(p.idle, idleObject[T]{obj: obj, since: time.Now()})
+		p.mu.Unlock()
+	}
+	p.sem.Release(1)
+}
+
+// Discard destroys a checked out object, e.g. a broken one, instead of returning it to the pool.
+func (p *Pool[T]) Discard(obj T) {
+	p.destroy(obj)
+	p.sem.Release(1)
+}
+
+// SetLimit changes the limit of live objects. If it's lowered, excess idle objects are destroyed at once
+// and excess checked out objects are destroyed when they are put back.
+func (p *Pool[T]) SetLimit(limit int) {
+	p.sem.SetLimit(limit)
+
+	p.mu.Lock()
+	var excess []idleObject[T]
+	if n := p.sem.GetCount() + len(p.idle) - limit; n > 0 {
+		if n > len(p.idle) {
+			n = len(p.idle)
+		}
+		excess = append(excess, p.idle[:n]...)
+		p.idle = append(p.idle[:0], p.idle[n:]...)
+	}
+	p.mu.Unlock()
+
+	for _, o := range excess {
+		p.destroy(o.obj)
+	}
+}
+
+// GetLimit returns the current limit of live objects.
+func (p *Pool[T]) GetLimit() int {
+	return p.sem.GetLimit()
+}
+
+// GetCount returns the current number of checked out objects.
+func (p *Pool[T]) GetCount() int {
+	return p.sem.GetCount()
+}
+
+// GetIdle returns the current number of idle objects.
+func (p *Pool[T]) GetIdle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Close destroys idle objects, objects put back later are destroyed too.
+// Get returns ErrPoolClosed after Close.
+func (p *Pool[T]) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.closeCh)
+	for _, o := range idle {
+		p.destroy(o.obj)
+	}
+}
+
+// janitor destroys objects idle for longer than the idle timeout.
+func (p *Pool[T]) janitor() {
+	ticker := time.NewTicker(p.opts.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case now := <-ticker.C:
+			p.destroyExpired(now)
+		}
+	}
+}
+
+func (p *Pool[T]) destroyExpired(now time.Time) {
+	p.mu.Lock()
+	n := 0
+	for n < len(p.idle) && now.Sub(p.idle[n].since) >= p.opts.idleTimeout {
+		n++
+	}
+	expired := append([]idleObject[T](nil), p.idle[:n]...)
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	p.mu.Unlock()
+
+	for _, o := range expired {
+		p.destroy(o.obj)
+	}
+}
@@ -0,0 +1,292 @@
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	id        int
+	healthy   bool
+	destroyed bool
+}
+
+// testFactory creates and destroys testObjects.
+type testFactory struct {
+	mu        sync.Mutex
+	created   int
+	destroyed int
+	err       error
+}
+
+func (f *testFactory) create(ctx context.Context) (*testObject, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.created++
+	return &testObject{id: f.created, healthy: true}, nil
+}
+
+func (f *testFactory) destroy(o *testObject) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o.destroyed {
+		panic("object is destroyed twice")
+	}
+	o.destroyed = true
+	f.destroyed++
+}
+
+func (f *testFactory) check(t *testing.T, created, destroyed int) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.created != created || f.destroyed != destroyed {
+		t.Errorf("%d created and %d destroyed objects expected, got %d and %d", created, destroyed, f.created, f.destroyed)
+	}
+}
+
+func checkPool[T any](t *testing.T, p *Pool[T], expectedCount, expectedIdle int) {
+	t.Helper()
+	if count := p.GetCount(); count != expectedCount {
+		t.Error("pool must have count = ", expectedCount, ", but has ", count)
+	}
+	if idle := p.GetIdle(); idle != expectedIdle {
+		t.Error("pool must have idle = ", expectedIdle, ", but has ", idle)
+	}
+}
+
+func TestPool_Get_Put(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(2, f.create, f.destroy)
+	defer p.Close()
+
+	o1, err := p.Get(nil)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	o2, _ := p.Get(context.Background())
+	checkPool(t, p, 2, 0)
+	f.check(t, 2, 0)
+
+	p.Put(o1)
+	checkPool(t, p, 1, 1)
+
+	// idle object is reused
+	o3, _ := p.Get(nil)
+	if o3 != o1 {
+		t.Error("idle object must be reused")
+	}
+	f.check(t, 2, 0)
+
+	p.Put(o2)
+	p.Put(o3)
+	checkPool(t, p, 0, 2)
+	f.check(t, 2, 0)
+}
+
+func TestPool_Get_waits(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(1, f.create, f.destroy)
+	defer p.Close()
+	o, _ := p.Get(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+
+	got := make(chan *testObject)
+	go func() {
+		o, _ := p.Get(nil)
+		got <- o
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Put(o)
+	if <-got != o {
+		t.Error("put object must be handed to the waiter")
+	}
+	checkPool(t, p, 1, 0)
+	f.check(t, 1, 0)
+}
+
+func TestPool_create_error(t *testing.T) {
+	f := &testFactory{err: errors.New("dial failed")}
+	p := NewPool(1, f.create, f.destroy)
+	defer p.Close()
+
+	if _, err := p.Get(nil); err != f.err {
+		t.Error("create error expected, got", err)
+	}
+	// the permit is given back
+	checkPool(t, p, 0, 0)
+}
+
+func TestPool_health_check(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(2, f.create, f.destroy, WithHealthCheck(func(o *testObject) bool {
+		return o.healthy
+	}))
+	defer p.Close()
+
+	o1, _ := p.Get(nil)
+	o2, _ := p.Get(nil)
+	p.Put(o1)
+	p.Put(o2)
+	o2.healthy = false
+
+	// o2 is the most recently used, but broken
+	o, _ := p.Get(nil)
+	if o != o1 {
+		t.Error("healthy idle object expected")
+	}
+	if !o2.destroyed {
+		t.Error("unhealthy object must be destroyed")
+	}
+	checkPool(t, p, 1, 0)
+	f.check(t, 2, 1)
+}
+
+func TestPool_Discard(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(1, f.create, f.destroy)
+	defer p.Close()
+
+	o, _ := p.Get(nil)
+	p.Discard(o)
+	checkPool(t, p, 0, 0)
+	f.check(t, 1, 1)
+
+	if o, _ = p.Get(nil); o.id != 2 {
+		t.Error("new object expected")
+	}
+}
+
+func TestPool_SetLimit(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(4, f.create, f.destroy)
+	defer p.Close()
+
+	var objs []*testObject
+	for i := 0; i < 4; i++ {
+		o, _ := p.Get(nil)
+		objs = append(objs, o)
+	}
+	p.Put(objs[0])
+	p.Put(objs[1])
+	checkPool(t, p, 2, 2)
+
+	// 2 checked out + 2 idle, 1 idle is destroyed, the oldest one
+	p.SetLimit(3)
+	checkPool(t, p, 2, 1)
+	if !objs[0].destroyed || objs[1].destroyed {
+		t.Error("the oldest idle object must be destroyed")
+	}
+
+	// still over the limit, the excess checked out objects are destroyed when put back
+	p.SetLimit(1)
+	checkPool(t, p, 2, 0)
+	p.Put(objs[2])
+	p.Put(objs[3])
+	checkPool(t, p, 0, 1)
+	f.check(t, 4, 3)
+	if p.GetLimit() != 1 {
+		t.Error("pool must have limit = 1")
+	}
+
+	// raising the limit allows new objects
+	p.SetLimit(2)
+	o1, _ := p.Get(nil)
+	o2, _ := p.Get(nil)
+	if o1 != objs[3] || o2.id != 5 {
+		t.Error("idle object must be reused and a new one created")
+	}
+}
+
+func TestPool_idle_timeout(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(2, f.create, f.destroy, WithIdleTimeout[*testObject](20*time.Millisecond))
+	defer p.Close()
+
+	o, _ := p.Get(nil)
+	p.Put(o)
+	checkPool(t, p, 0, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.GetIdle() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle object is not destroyed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.check(t, 1, 1)
+}
+
+func TestPool_Close(t *testing.T) {
+	f := &testFactory{}
+	p := NewPool(2, f.create, f.destroy, WithIdleTimeout[*testObject](time.Minute))
+
+	o1, _ := p.Get(nil)
+	o2, _ := p.Get(nil)
+	p.Put(o1)
+
+	p.Close()
+	p.Close()
+	f.check(t, 2, 1)
+
+	if _, err := p.Get(nil); err != ErrPoolClosed {
+		t.Error("ErrPoolClosed expected, got", err)
+	}
+
+	// checked out objects are destroyed when put back
+	p.Put(o2)
+	checkPool(t, p, 0, 0)
+	f.check(t, 2, 2)
+}
+
+func TestPool_contention(t *testing.T) {
+	const limit = 5
+	f := &testFactory{}
+	p := NewPool(limit, f.create, f.destroy)
+	var inUse int32
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < 500; j++ {
+				o, err := p.Get(nil)
+				if err != nil {
+					panic(err)
+				}
+				if atomic.AddInt32(&inUse, 1) > limit {
+					t.Error("objects in use exceed the limit")
+				}
+				atomic.AddInt32(&inUse, -1)
+				p.Put(o)
+			}
+			wg.Done()
+		}()
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkPool(t, p, 0, p.GetIdle())
+	f.mu.Lock()
+	if live := f.created - f.destroyed; live > limit {
+		t.Error("live objects exceed the limit:", live)
+	}
+	f.mu.Unlock()
+	p.Close()
+	f.check(t, f.created, f.created)
+}
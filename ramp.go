@@ -0,0 +1,182 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRampSteps = 10
+
+// ErrRampSuperseded is returned by RampLimit when the limit is changed by SetLimit or another RampLimit.
+var ErrRampSuperseded = errors.New("semaphore: limit ramp is superseded")
+
+// Ramper is implemented by semaphores that can change the limit gradually,
+// the Semaphore returned by New implements it.
+type Ramper interface {
+	// RampLimit moves the limit to target in steps evenly spread over d, so that waiters are woken up
+	// in batches instead of all at once. It blocks until target is reached and returns nil,
+	// or until ctx is done and returns ctx.Err() leaving the limit at the current step.
+	// SetLimit or another RampLimit called meanwhile supersede the ramp, it stops at its next step
+	// without changing the limit and returns ErrRampSuperseded.
+	RampLimit(ctx context.Context, target int, d time.Duration, opts ...RampOption) error
+}
+
+// RampOption configures RampLimit.
+type RampOption func(*rampOptions)
+
+type rampOptions struct {
+	steps       int
+	exponential bool
+}
+
+// WithRampSteps sets the number of steps of the ramp, 10 by default.
+func WithRampSteps(n int) RampOption {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	return func(o *rampOptions) {
+		o.steps = n
+	}
+}
+
+// WithExponentialRamp makes the limit change by the same factor every step instead of by the same amount,
+// so a ramp up starts slowly and a ramp down starts fast.
+func WithExponentialRamp() RampOption {
+	return func(o *rampOptions) {
+		o.exponential = true
+	}
+}
+
+// WithSlowStart makes the Semaphore start with the limit initial and ramp up exponentially
+// to the limit passed to NewWithOptions over d, so that a newly started service doesn't hammer cold downstreams.
+// The ramp runs in a goroutine and is superseded by SetLimit, like RampLimit.
+func WithSlowStart(initial int, d time.Duration) Option {
+	if initial < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	return func(o *options) {
+		o.slowStart = d
+		o.slowStartFrom = initial
+	}
+}
+
+func (s *semaphore) RampLimit(ctx context.Context, target int, d time.Duration, opts ...RampOption) error {
+	if target < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	o := rampOptions{steps: defaultRampSteps}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var ctxDoneCh <-chan struct{}
+	if ctx != nil {
+		ctxDoneCh = ctx.Done()
+	}
+
+	gen, from := s.startRamp()
+	prev := from
+	start := time.Now()
+	var timer *time.Timer
+	for i := 1; i <= o.steps; i++ {
+		next := rampStep(from, target, i, o.steps, o.exponential)
+		if next == prev {
+			continue
+		}
+
+		// wait for the time of the step
+		if wait := time.Until(start.Add(d * time.Duration(i) / time.Duration(o.steps))); wait > 0 {
+			if timer == nil {
+				timer = time.NewTimer(wait)
+				defer timer.Stop()
+			} else {
+				timer.Reset(wait)
+			}
+			select {
+			case <-ctxDoneCh:
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if !s.setRampLimit(gen, prev, next) {
+			return ErrRampSuperseded
+		}
+		prev = next
+	}
+	return nil
+}
+
+// rampStep returns the limit of the step i of n of a ramp from from to to.
+func rampStep(from, to, i, n int, exponential bool) int {
+	if i >= n {
+		return to
+	}
+	f := float64(i) / float64(n)
+	if !exponential {
+		return from + int(math.Round(float64(to-from)*f))
+	}
+	// zero can't be scaled, start from one
+	a, b := math.Max(float64(from), 1), math.Max(float64(to), 1)
+	return int(math.Round(a * math.Pow(b/a, f)))
+}
+
+// newLimitReq starts a new generation of limit requests with the limit.
+func (s *semaphore) newLimitReq(limit int) uint32 {
+	for {
+		req := atomic.LoadUint64(&s.limitReq)
+		gen := uint32(req>>32) + 1
+		if atomic.CompareAndSwapUint64(&s.limitReq, req, uint64(gen)<<32+uint64(limit)) {
+			return gen
+		}
+	}
+}
+
+// startRamp starts a new generation of limit requests with the current limit, which the ramp starts from.
+func (s *semaphore) startRamp() (gen uint32, limit int) {
+	limit = s.GetLimit()
+	return s.newLimitReq(limit), limit
+}
+
+// setRampLimit changes the limit from prev to next if the ramp of generation gen is not superseded,
+// it reports whether the ramp may go on.
+func (s *semaphore) setRampLimit(gen uint32, prev, next int) bool {
+	if !atomic.CompareAndSwapUint64(&s.limitReq, uint64(gen)<<32+uint64(prev), uint64(gen)<<32+uint64(next)) {
+		return false
+	}
+	if !s.casLimit(uint64(prev), uint64(next)) {
+		// changed by SetLimit
+		return false
+	}
+	s.broadcast()
+	s.revokeOverLimit()
+
+	if req := atomic.LoadUint64(&s.limitReq); uint32(req>>32) != gen {
+		// SetLimit started meanwhile may have set its limit before the step, restore it
+		if s.casLimit(uint64(next), req&0xFFFFFFFF) {
+			s.broadcast()
+			s.revokeOverLimit()
+		}
+		return false
+	}
+	return true
+}
+
+// casLimit changes the limit from old to new keeping the count, it reports false if the limit is not old.
+func (s *semaphore) casLimit(old, new uint64) bool {
+	for {
+		state := atomic.LoadUint64(&s.state)
+		if state>>32 != old {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&s.state, state, new<<32+state&0xFFFFFFFF) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package semaphore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRampStep(t *testing.T) {
+	steps := func(from, to, n int, exponential bool) []int {
+		var res []int
+		for i := 1; i <= n; i++ {
+			res = append(res, rampStep(from, to, i, n, exponential))
+		}
+		return res
+	}
+	for _, test := range []struct {
+		from, to, n int
+		exponential bool
+		expected    []int
+	}{
+		{10, 50, 4, false, []int{20, 30, 40, 50}},
+		{50, 10, 4, false, []int{40, 30, 20, 10}},
+		{1, 16, 4, true, []int{2, 4, 8, 16}},
+		{0, 16, 4, true, []int{2, 4, 8, 16}},
+		{16, 0, 4, true, []int{8, 4, 2, 0}},
+		{5, 5, 2, true, []int{5, 5}},
+	} {
+		if res := steps(test.from, test.to, test.n, test.exponential); !reflect.DeepEqual(res, test.expected) {
+			t.Error(test.from, "->", test.to, "steps", test.expected, "expected, got", res)
+		}
+	}
+}
+
+func TestSemaphore_RampLimit(t *testing.T) {
+	sem := New(10)
+	sem.Acquire(nil, 3)
+
+	start := time.Now()
+	if err := sem.(Ramper).RampLimit(context.Background(), 50, 40*time.Millisecond, WithRampSteps(4)); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Error("ramp must take 40ms, took", elapsed)
+	}
+	checkLimitAndCount(t, sem, 50, 3)
+
+	// zero duration is a jump
+	if err := sem.(Ramper).RampLimit(nil, 0, 0); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 0, 3)
+}
+
+func TestSemaphore_RampLimit_wakes_in_steps(t *testing.T) {
+	sem := New(0)
+	acquired := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			sem.Acquire(nil, 1)
+			acquired <- struct{}{}
+		}()
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- sem.(Ramper).RampLimit(nil, 4, 400*time.Millisecond, WithRampSteps(2))
+	}()
+
+	// the first step lets in 2 waiters
+	<-acquired
+	<-acquired
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the first step")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	<-acquired
+	<-acquired
+	checkLimitAndCount(t, sem, 4, 4)
+}
+
+func TestSemaphore_RampLimit_ctx_done(t *testing.T) {
+	sem := New(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	err := sem.(Ramper).RampLimit(ctx, 10, time.Second)
+	if err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	if limit := sem.GetLimit(); limit == 0 || limit == 10 {
+		t.Error("limit of an intermediate step expected, got", limit)
+	}
+}
+
+func TestSemaphore_RampLimit_superseded(t *testing.T) {
+	sem := New(1)
+	done := make(chan error)
+	go func() {
+		done <- sem.(Ramper).RampLimit(nil, 100, 10*time.Second, WithRampSteps(1000))
+	}()
+	for sem.GetLimit() == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sem.SetLimit(5)
+	if err := <-done; err != ErrRampSuperseded {
+		t.Error("ErrRampSuperseded expected, got", err)
+	}
+	checkLimitAndCount(t, sem, 5, 0)
+
+	// by another ramp
+	go func() {
+		done <- sem.(Ramper).RampLimit(nil, 100, 200*time.Millisecond)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := sem.(Ramper).RampLimit(nil, 2, 0); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	// noticed at the next step
+	if err := <-done; err != ErrRampSuperseded {
+		t.Error("ErrRampSuperseded expected, got", err)
+	}
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+func TestNew_WithSlowStart(t *testing.T) {
+	sem := NewWithOptions(100, WithSlowStart(1, 100*time.Millisecond))
+	if limit := sem.GetLimit(); limit >= 100 {
+		t.Error("slow start expected, got limit", limit)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for sem.GetLimit() != 100 {
+		if time.Now().After(deadline) {
+			t.Fatal("limit 100 expected, got", sem.GetLimit())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// SetLimit supersedes the slow start
+	sem = NewWithOptions(100, WithSlowStart(1, 10*time.Second))
+	sem.SetLimit(7)
+	time.Sleep(50 * time.Millisecond)
+	checkLimitAndCount(t, sem, 7, 0)
+
+	// initial over the limit is ignored
+	checkLimitAndCount(t, NewWithOptions(5, WithSlowStart(10, time.Second)), 5, 0)
+}
+
+func TestRampLimit_panic_expected(t *testing.T) {
+	tests := []func(){
+		func() { New(1).(Ramper).RampLimit(nil, -1, time.Second) },
+		func() { WithRampSteps(0) },
+		func() { WithSlowStart(-1, time.Second) },
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			test()
+		}()
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"sync"
+)
+
+// Reentrant is a Semaphore whose acquisitions are owned by contexts,
+// so that nested acquisitions on the same request don't deadlock.
+// Acquire returns a context carrying the ownership, an Acquire with that very context
+// is satisfied from the weight already held and acquires only the difference from the Semaphore.
+// Contexts derived from an owning one own nothing, e.g. in goroutines started by the request,
+// so they acquire their own entries; pass the returned context itself to nested calls.
+type Reentrant struct {
+	sem Semaphore
+
+	// mu guards the bookkeeping of nested acquisitions
+	mu sync.Mutex
+}
+
+// NewReentrant creates a Reentrant acquiring from sem.
+func NewReentrant(sem Semaphore) *Reentrant {
+	return &Reentrant{sem: sem}
+}
+
+// ownedContext is the context returned by Reentrant.Acquire, it carries the acquisition as the ownership token.
+type ownedContext struct {
+	context.Context
+	r *Reentrant
+	o *ownership
+}
+
+// ownership is an acquisition made by Reentrant.Acquire, its fields are changed under the lock of the Reentrant.
+type ownership struct {
+	outer    *ownership // owning acquisition the weight was taken from, nil if none
+	held     int        // weight held by the context, including the outer acquisitions
+	acquired int        // weight acquired from the semaphore by this acquisition
+
+	nested   int // unreleased acquisitions nested in this one
+	released bool
+}
+
+// owner returns the unreleased acquisition owning ctx, or nil. The lock must be held.
+// Contexts returned by other Reentrants keep the ownership of the context they wrap.
+func (r *Reentrant) owner(ctx context.Context) *ownership {
+	oc, _ := ctx.(*ownedContext)
+	for oc != nil && oc.r != r {
+		oc, _ = oc.Context.(*ownedContext)
+	}
+	if oc == nil {
+		return nil
+	}
+	o := oc.o
+	for o != nil && o.released {
+		o = o.outer
+	}
+	return o
+}
+
+// Acquire acquires n entries for ctx, blocking only until ctx is done, and returns the context owning them.
+// If ctx is returned by Acquire and owns m entries, only n-m of them, if any, are acquired from the Semaphore.
+// On failure it returns ctx and ctx.Err().
+func (r *Reentrant) Acquire(ctx context.Context, n int) (context.Context, error) {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	o := &ownership{
+		held:     n,
+		acquired: n,
+	}
+	r.mu.Lock()
+	if o.outer = r.owner(ctx); o.outer != nil {
+		if o.outer.held >= n {
+			o.held, o.acquired = o.outer.held, 0
+		} else {
+			o.acquired = n - o.outer.held
+		}
+		// the outer acquisition can't be released while this one is in progress
+		o.outer.nested++
+	}
+	r.mu.Unlock()
+
+	if o.acquired > 0 {
+		if err := r.sem.Acquire(ctx, o.acquired); err != nil {
+			if o.outer != nil {
+				r.mu.Lock()
+				o.outer.nested--
+				r.mu.Unlock()
+			}
+			return ctx, err
+		}
+	}
+	return &ownedContext{Context: ctx, r: r, o: o}, nil
+}
+
+// Release releases the acquisition that returned ctx, giving back to the Semaphore only the entries it acquired.
+// Nested acquisitions must be released before the outer ones, every acquisition is released once.
+func (r *Reentrant) Release(ctx context.Context) {
+	oc, _ := ctx.(*ownedContext)
+	if oc == nil || oc.r != r {
+		panic("context must be returned by Acquire of the same Reentrant")
+	}
+	o := oc.o
+	r.mu.Lock()
+	if o.nested != 0 {
+		r.mu.Unlock()
+		panic("nested acquisitions must be released first")
+	}
+	if o.released {
+		r.mu.Unlock()
+		panic("acquisition is already released")
+	}
+	o.released = true
+	if o.outer != nil {
+		o.outer.nested--
+	}
+	r.mu.Unlock()
+
+	if o.acquired > 0 {
+		r.sem.Release(o.acquired)
+	}
+}
+
+// Held returns the number of entries owned by ctx.
+func (r *Reentrant) Held(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o := r.owner(ctx); o != nil {
+		return o.held
+	}
+	return 0
+}
@@ -0,0 +1,280 @@
+package semaphore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReentrant_nested(t *testing.T) {
+	sem := New(1)
+	r := NewReentrant(sem)
+
+	outer, err := r.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+
+	// satisfied from the held entry, doesn't deadlock
+	inner, err := r.Acquire(outer, 1)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+	if held := r.Held(inner); held != 1 {
+		t.Error("held 1 expected, got", held)
+	}
+
+	r.Release(inner)
+	checkLimitAndCount(t, sem, 1, 1)
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 1, 0)
+	if held := r.Held(outer); held != 0 {
+		t.Error("held 0 expected, got", held)
+	}
+}
+
+func TestReentrant_nested_difference(t *testing.T) {
+	sem := New(5)
+	r := NewReentrant(sem)
+
+	outer, _ := r.Acquire(nil, 2)
+	checkLimitAndCount(t, sem, 5, 2)
+
+	// only the difference is acquired
+	inner, err := r.Acquire(outer, 4)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 4)
+
+	// a smaller nested acquisition keeps the held weight
+	innermost, _ := r.Acquire(inner, 1)
+	checkLimitAndCount(t, sem, 5, 4)
+	if held := r.Held(innermost); held != 4 {
+		t.Error("held 4 expected, got", held)
+	}
+
+	r.Release(innermost)
+	checkLimitAndCount(t, sem, 5, 4)
+	r.Release(inner)
+	checkLimitAndCount(t, sem, 5, 2)
+	if held := r.Held(outer); held != 2 {
+		t.Error("held 2 expected, got", held)
+	}
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 5, 0)
+}
+
+func TestReentrant_nested_after_release(t *testing.T) {
+	sem := New(2)
+	r := NewReentrant(sem)
+
+	outer, _ := r.Acquire(nil, 1)
+	inner, _ := r.Acquire(outer, 2)
+	r.Release(inner)
+
+	// the released acquisition owns nothing, the outer one is used
+	again, _ := r.Acquire(inner, 2)
+	checkLimitAndCount(t, sem, 2, 2)
+	r.Release(again)
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+func TestReentrant_separate(t *testing.T) {
+	sem := New(2)
+	r1 := NewReentrant(sem)
+	r2 := NewReentrant(sem)
+
+	ctx1, _ := r1.Acquire(nil, 1)
+	ctx2, _ := r2.Acquire(ctx1, 1)
+	checkLimitAndCount(t, sem, 2, 2)
+
+	// ownership of r1 doesn't satisfy r2
+	ctx, cancel := context.WithTimeout(ctx2, 20*time.Millisecond)
+	defer cancel()
+	if _, err := r2.Acquire(ctx, 2); err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	if held := r2.Held(ctx2); held != 1 {
+		t.Error("held 1 expected, got", held)
+	}
+	// ownership of r1 is kept by the context of r2
+	if held := r1.Held(ctx2); held != 1 {
+		t.Error("held 1 expected, got", held)
+	}
+
+	r2.Release(ctx2)
+	r1.Release(ctx1)
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+func TestReentrant_derived_context(t *testing.T) {
+	sem := New(1)
+	r := NewReentrant(sem)
+	outer, _ := r.Acquire(nil, 1)
+
+	// a derived context, e.g. passed to another goroutine, doesn't reuse the held entry
+	ctx, cancel := context.WithTimeout(outer, 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := r.Acquire(ctx, 1)
+		done <- err
+	}()
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	if held := r.Held(ctx); held != 0 {
+		t.Error("held 0 expected, got", held)
+	}
+
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestReentrant_Acquire_ctx_done(t *testing.T) {
+	sem := New(1)
+	r := NewReentrant(sem)
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	got, err := r.Acquire(ctx, 1)
+	if err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	if got != ctx || r.Held(got) != 0 {
+		t.Error("original context expected")
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func TestReentrant_panic_expected(t *testing.T) {
+	r := NewReentrant(New(2))
+	outer, _ := r.Acquire(nil, 1)
+	inner, _ := r.Acquire(outer, 2)
+
+	tests := []func(){
+		func() { r.Acquire(nil, 0) },
+		func() { r.Release(context.Background()) },
+		func() { NewReentrant(New(1)).Release(outer) },
+		// outer before inner
+		func() { r.Release(outer) },
+		// twice
+		func() {
+			r.Release(inner)
+			r.Release(inner)
+		},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			test()
+		}()
+	}
+}
+
+func TestReentrant_concurrent(t *testing.T) {
+	sem := New(1)
+	r := NewReentrant(sem)
+
+	var maxCount int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				outer, _ := r.Acquire(nil, 1)
+				inner, _ := r.Acquire(outer, 1)
+				if c := int32(sem.GetCount()); c > atomic.LoadInt32(&maxCount) {
+					atomic.StoreInt32(&maxCount, c)
+				}
+				r.Release(inner)
+				r.Release(outer)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxCount > 1 {
+		t.Error("count over limit:", maxCount)
+	}
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestReentrant_concurrent_nested(t *testing.T) {
+	sem := New(3)
+	r := NewReentrant(sem)
+	outer, _ := r.Acquire(nil, 1)
+
+	// nested acquisitions on a shared owning context, each acquires 1 more entry
+	var maxCount int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				inner, err := r.Acquire(outer, 2)
+				if err != nil {
+					t.Error("Error returned:", err.Error())
+					return
+				}
+				if held := r.Held(inner); held != 2 {
+					t.Error("held 2 expected, got", held)
+				}
+				if c := int32(sem.GetCount()); c > atomic.LoadInt32(&maxCount) {
+					atomic.StoreInt32(&maxCount, c)
+				}
+				r.Release(inner)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxCount > 3 {
+		t.Error("count over limit:", maxCount)
+	}
+	checkLimitAndCount(t, sem, 3, 1)
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 3, 0)
+}
+
+func TestReentrant_Release_while_nested_waits(t *testing.T) {
+	sem := New(1)
+	r := NewReentrant(sem)
+	outer, _ := r.Acquire(nil, 1)
+
+	acquired := make(chan context.Context)
+	go func() {
+		inner, _ := r.Acquire(outer, 2)
+		acquired <- inner
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the nested acquisition is in progress
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Panic expected")
+			}
+		}()
+		r.Release(outer)
+	}()
+
+	sem.SetLimit(2)
+	inner := <-acquired
+	r.Release(inner)
+	r.Release(outer)
+	checkLimitAndCount(t, sem, 2, 0)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry holds the semaphores registered by name.
+var registry = struct {
+	sync.RWMutex
+	sems map[string]Semaphore
+}{
+	sems: make(map[string]Semaphore),
+}
+
+// Register makes sem visible by name, e.g. to the semaphoredebug HTTP handler.
+// It panics if the name is empty or already registered.
+func Register(name string, sem Semaphore) {
+	if name == "" {
+		panic("semaphore name must not be empty")
+	}
+	if sem == nil {
+		panic("semaphore must not be nil")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.sems[name]; ok {
+		panic("semaphore " + name + " is already registered")
+	}
+	registry.sems[name] = sem
+}
+
+// Unregister removes the semaphore registered by name, if any.
+func Unregister(name string) {
+	registry.Lock()
+	delete(registry.sems, name)
+	registry.Unlock()
+}
+
+// Lookup returns the semaphore registered by name, or nil.
+func Lookup(name string) Semaphore {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.sems[name]
+}
+
+// Registered returns the sorted names of the registered semaphores.
+func Registered() []string {
+	registry.RLock()
+	names := make([]string, 0, len(registry.sems))
+	for name := range registry.sems {
+		names = append(names, name)
+	}
+	registry.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,54 @@
+package semaphore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	a, b := New(1), New(2)
+	Register("test.b", b)
+	Register("test.a", a)
+	defer Unregister("test.a")
+	defer Unregister("test.b")
+
+	if Lookup("test.a") != a || Lookup("test.b") != b {
+		t.Error("registered semaphores must be found")
+	}
+	if Lookup("test.c") != nil {
+		t.Error("nil expected for unknown name")
+	}
+	if names := Registered(); !reflect.DeepEqual(names, []string{"test.a", "test.b"}) {
+		t.Error("sorted names expected, got", names)
+	}
+
+	Unregister("test.a")
+	if Lookup("test.a") != nil {
+		t.Error("unregistered semaphore must not be found")
+	}
+	Unregister("test.a")
+
+	// the name can be reused
+	Register("test.a", b)
+}
+
+func TestRegister_panic_expected(t *testing.T) {
+	Register("test.dup", New(1))
+	defer Unregister("test.dup")
+
+	tests := []func(){
+		func() { Register("test.dup", New(1)) },
+		func() { Register("", New(1)) },
+		func() { Register("test.nil", nil) },
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			test()
+		}()
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReservationDone is returned by Reservation.Commit if the reservation is already committed, cancelled or expired.
+var ErrReservationDone = errors.New("semaphore: reservation is already committed, cancelled or expired")
+
+// Reserver is implemented by semaphores supporting two-phase acquisition,
+// the Semaphore returned by New implements it.
+type Reserver interface {
+	// Reserve enters the semaphore a specified number of times, blocking only until ctx is done,
+	// but the entries are reported as reserved until the returned Reservation is committed.
+	// Reserved entries count against the limit immediately.
+	// If the reservation is neither committed nor cancelled within ttl after it's made,
+	// it expires and its entries are released. ctx only bounds the waiting.
+	Reserve(ctx context.Context, n int, ttl time.Duration) (*Reservation, error)
+
+	// GetReserved returns current number of entries taken by uncommitted reservations.
+	GetReserved() int
+
+	// GetCommitted returns current number of occupied entries excluding the reserved ones.
+	GetCommitted() int
+}
+
+const (
+	reservationPending int32 = iota
+	reservationCommitted
+	reservationCancelled
+)
+
+// Reservation is a capacity reserved by Reserve, it must be either committed or cancelled.
+type Reservation struct {
+	sem   *semaphore
+	n     int
+	state int32
+
+	// expires forgotten reservation
+	timer *time.Timer
+}
+
+func (s *semaphore) Reserve(ctx context.Context, n int, ttl time.Duration) (*Reservation, error) {
+	if ttl <= 0 {
+		panic("ttl must be positive duration")
+	}
+	if err := s.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&s.reserved, int64(n))
+
+	r := &Reservation{
+		sem: s,
+		n:   n,
+	}
+	r.timer = time.AfterFunc(ttl, func() { r.cancel() })
+	return r, nil
+}
+
+func (s *semaphore) GetReserved() int {
+	return int(atomic.LoadInt64(&s.reserved))
+}
+
+func (s *semaphore) GetCommitted() int {
+	committed := s.GetCount() - s.GetReserved()
+	if committed < 0 {
+		// count and reserved are changed concurrently
+		committed = 0
+	}
+	return committed
+}
+
+// N returns the number of reserved entries.
+func (r *Reservation) N() int {
+	return r.n
+}
+
+// Commit turns the reserved entries into normal ones that must be released with Release.
+// It returns ErrReservationDone if the reservation is already committed, cancelled or expired.
+func (r *Reservation) Commit() error {
+	if !atomic.CompareAndSwapInt32(&r.state, reservationPending, reservationCommitted) {
+		return ErrReservationDone
+	}
+	atomic.AddInt64(&r.sem.reserved, -int64(r.n))
+	r.timer.Stop()
+	return nil
+}
+
+// Cancel releases the reserved entries. It does nothing if the reservation is already committed, cancelled or expired.
+func (r *Reservation) Cancel() {
+	if r.cancel() {
+		r.timer.Stop()
+	}
+}
+
+// cancel releases the reserved entries if the reservation is pending and reports whether it was.
+func (r *Reservation) cancel() bool {
+	if !atomic.CompareAndSwapInt32(&r.state, reservationPending, reservationCancelled) {
+		return false
+	}
+	atomic.AddInt64(&r.sem.reserved, -int64(r.n))
+	r.sem.Release(r.n)
+	return true
+}
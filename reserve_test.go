@@ -0,0 +1,180 @@
+package semaphore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func checkReservedAndCommitted(t *testing.T, res Reserver, expectedReserved, expectedCommitted int) {
+	if res.GetReserved() != expectedReserved {
+		t.Error("semaphore must have reserved = ", expectedReserved, ", but has ", res.GetReserved())
+	}
+	if res.GetCommitted() != expectedCommitted {
+		t.Error("semaphore must have committed = ", expectedCommitted, ", but has ", res.GetCommitted())
+	}
+}
+
+func TestSemaphore_Reserve_Commit(t *testing.T) {
+	sem := New(5)
+	res := sem.(Reserver)
+	sem.Acquire(nil, 1)
+
+	r, err := res.Reserve(nil, 3, time.Minute)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 4)
+	checkReservedAndCommitted(t, res, 3, 1)
+
+	// reserved entries count against the limit
+	if !(sem.TryAcquire(2) == false) {
+		t.Fail()
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 4)
+	checkReservedAndCommitted(t, res, 0, 4)
+
+	if err := r.Commit(); err != ErrReservationDone {
+		t.Error("ErrReservationDone expected, got", err)
+	}
+
+	// cancel after commit does nothing
+	r.Cancel()
+	checkLimitAndCount(t, sem, 5, 4)
+
+	sem.Release(4)
+	checkLimitAndCount(t, sem, 5, 0)
+	checkReservedAndCommitted(t, res, 0, 0)
+}
+
+func TestSemaphore_Reserve_Cancel(t *testing.T) {
+	sem := New(5)
+	res := sem.(Reserver)
+
+	r, _ := res.Reserve(nil, 2, time.Minute)
+	checkLimitAndCount(t, sem, 5, 2)
+	checkReservedAndCommitted(t, res, 2, 0)
+
+	r.Cancel()
+	checkLimitAndCount(t, sem, 5, 0)
+	checkReservedAndCommitted(t, res, 0, 0)
+
+	// cancel is idempotent
+	r.Cancel()
+	checkLimitAndCount(t, sem, 5, 0)
+
+	if err := r.Commit(); err != ErrReservationDone {
+		t.Error("ErrReservationDone expected, got", err)
+	}
+}
+
+func TestSemaphore_Reserve_waits(t *testing.T) {
+	sem := New(2)
+	res := sem.(Reserver)
+	sem.Acquire(nil, 2)
+
+	reserved := make(chan *Reservation)
+	go func() {
+		r, _ := res.Reserve(nil, 1, time.Minute)
+		reserved <- r
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-reserved:
+		t.Fatal("reserved over limit")
+	default:
+	}
+
+	sem.Release(1)
+	r := <-reserved
+	checkLimitAndCount(t, sem, 2, 2)
+	checkReservedAndCommitted(t, res, 1, 1)
+	r.Cancel()
+	checkLimitAndCount(t, sem, 2, 1)
+}
+
+func TestSemaphore_Reserve_ctx_done(t *testing.T) {
+	sem := New(1)
+	res := sem.(Reserver)
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r, err := res.Reserve(ctx, 1, time.Minute)
+	if err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+	if r != nil {
+		t.Error("no reservation expected")
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+	checkReservedAndCommitted(t, res, 0, 1)
+}
+
+func TestSemaphore_Reserve_expires(t *testing.T) {
+	sem := New(3)
+	res := sem.(Reserver)
+
+	r, err := res.Reserve(nil, 2, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkReservedAndCommitted(t, res, 2, 0)
+
+	// forgotten reservation is released after ttl
+	deadline := time.Now().Add(5 * time.Second)
+	for sem.GetCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reservation is not expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkReservedAndCommitted(t, res, 0, 0)
+
+	if err := r.Commit(); err != ErrReservationDone {
+		t.Error("ErrReservationDone expected, got", err)
+	}
+}
+
+func TestSemaphore_Reserve_outlives_ctx(t *testing.T) {
+	sem := New(3)
+	res := sem.(Reserver)
+
+	// ctx bounds only the waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := res.Reserve(ctx, 2, time.Minute)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	checkReservedAndCommitted(t, res, 2, 0)
+
+	if err := r.Commit(); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkReservedAndCommitted(t, res, 0, 2)
+}
+
+func TestSemaphore_Reserve_committed_outlives_ttl(t *testing.T) {
+	sem := New(3)
+	res := sem.(Reserver)
+
+	r, _ := res.Reserve(nil, 2, 10*time.Millisecond)
+	if err := r.Commit(); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	time.Sleep(30 * time.Millisecond)
+	checkLimitAndCount(t, sem, 3, 2)
+	checkReservedAndCommitted(t, res, 0, 2)
+}
+
+func TestSemaphore_Reserve_ttl_panic_expected(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected")
+		}
+	}()
+	New(1).(Reserver).Reserve(nil, 1, 0)
+}
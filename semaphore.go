@@ -11,6 +11,8 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+
+	"github.com/marusama/semaphore/v2/internal/testhooks"
 )
 
 // Semaphore counting resizable semaphore synchronization primitive.
@@ -56,21 +58,81 @@ type semaphore struct {
 	//
 	state uint64
 
+	// reserved holds the part of count taken by uncommitted reservations,
+	// it's kept next to state for 64-bit alignment of atomic operations
+	reserved int64
+
+	// limitReq holds the generation (high 32 bits) and the value (low 32 bits) of the latest limit request,
+	// SetLimit and RampLimit start a new generation, so a running ramp sees it's superseded
+	limitReq uint64
+
+	// spinMax is the maximum time Acquire spins before parking, zero disables spinning;
+	// waitAvg is the moving average of recent wait times in nanoseconds
+	spinMax int64
+	waitAvg int64
+
+	// stats count waiting Acquire calls
+	stats waitStats
+
+	// permits are the outstanding revocable permits
+	permits permitSet
+
 	// broadcast fields
 	lock        sync.RWMutex
 	broadcastCh chan struct{}
+
+	// exclusive holds the number of exclusive waiters and holders,
+	// while it's positive new shared acquisitions are blocked
+	exclusive int32
+
+	// exclusiveCh is a token of exclusive ownership,
+	// exclusiveHeld is the weight taken by the exclusive holder
+	exclusiveCh      chan struct{}
+	exclusiveHolding int32
+	exclusiveHeld    uint64
+
+	// upgradeCh is a token of the only upgrader allowed to wait
+	upgradeCh chan struct{}
+
+	// hooks are set only by the semaphoretest simulation harness
+	hooks *testhooks.Hooks
+
+	// onRelease is set by the Group of the semaphore to rebalance limits after releases
+	onRelease func()
 }
 
 // New initializes a new instance of the Semaphore, specifying the maximum number of concurrent entries.
 func New(limit int) Semaphore {
+	return NewWithOptions(limit)
+}
+
+// NewWithOptions initializes a new instance of the Semaphore like New, configured by opts.
+func NewWithOptions(limit int, opts ...Option) Semaphore {
 	if limit < 0 {
 		panic("semaphore limit must not be negative")
 	}
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	initial := limit
+	if o.slowStart > 0 && o.slowStartFrom < limit {
+		initial = o.slowStartFrom
+	}
 	broadcastCh := make(chan struct{})
-	return &semaphore{
-		state:       uint64(limit) << 32,
+	s := &semaphore{
+		state:       uint64(initial) << 32,
+		limitReq:    uint64(initial),
+		spinMax:     int64(o.spinMax),
+		waitAvg:     int64(o.spinMax) / 2, // the first waiters spin up to spinMax
 		broadcastCh: broadcastCh,
+		exclusiveCh: make(chan struct{}, 1),
+		upgradeCh:   make(chan struct{}, 1),
+	}
+	if initial != limit {
+		go s.RampLimit(context.Background(), limit, o.slowStart, WithExponentialRamp())
 	}
+	return s
 }
 
 func (s *semaphore) Acquire(ctx context.Context, n int) error {
@@ -81,15 +143,19 @@ func (s *semaphore) Acquire(ctx context.Context, n int) error {
 	if ctx != nil {
 		ctxDoneCh = ctx.Done()
 	}
+	var spin spinner
+	var w waiting
 	for {
 		// check if context is done
 		select {
 		case <-ctxDoneCh:
+			w.done(&s.stats, true)
 			return ctx.Err()
 		default:
 		}
 
 		// get current semaphore count and limit
+		s.yield("acquire.load")
 		state := atomic.LoadUint64(&s.state)
 		count := state & 0xFFFFFFFF
 		limit := state >> 32
@@ -97,32 +163,42 @@ func (s *semaphore) Acquire(ctx context.Context, n int) error {
 		// new count
 		newCount := count + uint64(n)
 
-		if newCount <= limit {
+		if newCount <= limit && atomic.LoadInt32(&s.exclusive) == 0 {
+			s.yield("acquire.cas")
 			if atomic.CompareAndSwapUint64(&s.state, state, limit<<32+newCount) {
 				// acquired
+				spin.done(s)
+				w.done(&s.stats, false)
 				return nil
 			}
 
 			// CAS failed, try again
 			continue
 		} else {
-			// semaphore is full, let's wait
-			s.lock.RLock()
-			broadcastCh := s.broadcastCh
-			s.lock.RUnlock()
+			if spin.spin(s) {
+				// a permit is expected to be released soon, try again
+				continue
+			}
+
+			// semaphore is full or exclusively taken, let's wait
+			s.yield("acquire.broadcast")
+			broadcastCh := s.getBroadcastCh()
 
 			// ensure that the state is the same as when we first checked; this
-			// ensures that the broadcastCh will eventually be closed by a Release.
-			if atomic.LoadUint64(&s.state) != state {
+			// ensures that the broadcastCh will eventually be closed by a Release
+			// or by the exclusive holder or waiter leaving.
+			s.yield("acquire.recheck")
+			if atomic.LoadUint64(&s.state) != state ||
+				newCount <= limit && atomic.LoadInt32(&s.exclusive) == 0 {
 				continue
 			}
 
-			select {
-			// check if context is done
-			case <-ctxDoneCh:
+			w.park(&s.stats)
+			cancelled := s.wait(ctxDoneCh, broadcastCh)
+			w.unpark(&s.stats)
+			if cancelled {
+				w.done(&s.stats, true)
 				return ctx.Err()
-			// waiting for broadcast signal
-			case <-broadcastCh:
 			}
 		}
 	}
@@ -135,6 +211,7 @@ func (s *semaphore) TryAcquire(n int) bool {
 
 	for {
 		// get current semaphore count and limit
+		s.yield("tryacquire.load")
 		state := atomic.LoadUint64(&s.state)
 		count := state & 0xFFFFFFFF
 		limit := state >> 32
@@ -142,7 +219,8 @@ func (s *semaphore) TryAcquire(n int) bool {
 		// new count
 		newCount := count + uint64(n)
 
-		if newCount <= limit {
+		if newCount <= limit && atomic.LoadInt32(&s.exclusive) == 0 {
+			s.yield("tryacquire.cas")
 			if atomic.CompareAndSwapUint64(&s.state, state, limit<<32+newCount) {
 				// acquired
 				return true
@@ -152,17 +230,25 @@ func (s *semaphore) TryAcquire(n int) bool {
 			continue
 		}
 
-		// semaphore is full
+		// semaphore is full or exclusively taken
 		return false
 	}
 }
 
 func (s *semaphore) Release(n int) int {
+	count := s.release(n)
+	s.released()
+	return count
+}
+
+// release is Release without notifying the Group of the semaphore.
+func (s *semaphore) release(n int) int {
 	if n <= 0 {
 		panic("n must be positive number")
 	}
 	for {
 		// get current semaphore count and limit
+		s.yield("release.load")
 		state := atomic.LoadUint64(&s.state)
 		count := state & 0xFFFFFFFF
 
@@ -173,16 +259,9 @@ func (s *semaphore) Release(n int) int {
 		// new count
 		newCount := count - uint64(n)
 
+		s.yield("release.cas")
 		if atomic.CompareAndSwapUint64(&s.state, state, state&0xFFFFFFFF00000000+newCount) {
-
-			newBroadcastCh := make(chan struct{})
-			s.lock.Lock()
-			oldBroadcastCh := s.broadcastCh
-			s.broadcastCh = newBroadcastCh
-			s.lock.Unlock()
-			// send broadcast signal
-			close(oldBroadcastCh)
-
+			s.broadcast()
 			return int(count)
 		}
 	}
@@ -192,22 +271,41 @@ func (s *semaphore) SetLimit(limit int) {
 	if limit < 0 {
 		panic("semaphore limit must not be negative")
 	}
+	s.newLimitReq(limit)
 	for {
+		s.yield("setlimit.load")
 		state := atomic.LoadUint64(&s.state)
+		s.yield("setlimit.cas")
 		if atomic.CompareAndSwapUint64(&s.state, state, uint64(limit)<<32+state&0xFFFFFFFF) {
-			newBroadcastCh := make(chan struct{})
-			s.lock.Lock()
-			oldBroadcastCh := s.broadcastCh
-			s.broadcastCh = newBroadcastCh
-			s.lock.Unlock()
-
-			// send broadcast signal
-			close(oldBroadcastCh)
+			s.broadcast()
+			s.revokeOverLimit()
 			return
 		}
 	}
 }
 
+// broadcast wakes up all waiters, so they can check the state again.
+func (s *semaphore) broadcast() {
+	s.yield("broadcast.swap")
+	newBroadcastCh := make(chan struct{})
+	s.lock.Lock()
+	oldBroadcastCh := s.broadcastCh
+	s.broadcastCh = newBroadcastCh
+	s.lock.Unlock()
+
+	// send broadcast signal
+	s.yield("broadcast.close")
+	close(oldBroadcastCh)
+}
+
+// getBroadcastCh returns the channel that will be closed on the next broadcast.
+func (s *semaphore) getBroadcastCh() chan struct{} {
+	s.lock.RLock()
+	broadcastCh := s.broadcastCh
+	s.lock.RUnlock()
+	return broadcastCh
+}
+
 func (s *semaphore) GetCount() int {
 	state := atomic.LoadUint64(&s.state)
 	return int(state & 0xFFFFFFFF)
@@ -0,0 +1,319 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoreconfig sets limits of named semaphores from a config file and reloads them when it changes.
+//
+// The file maps semaphore names, as registered with semaphore.Register, to limits.
+// It's either a JSON object:
+//
+//	{"db": 10, "http": 100}
+//
+// or a flat YAML mapping:
+//
+//	# concurrency limits
+//	db: 10
+//	http: 100
+//
+// Semaphores not mentioned in the file are left alone. An update is applied only if all of its entries are valid,
+// otherwise it's rejected as a whole and the running semaphores keep their limits.
+// Replace the file atomically, by writing a temporary file and renaming it,
+// as a partially written file may be valid, e.g. "db: 1" of "db: 100".
+package semaphoreconfig // import "github.com/marusama/semaphore/v2/semaphoreconfig"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+const defaultPollInterval = time.Second
+
+// Option configures the Loader.
+type Option func(*options)
+
+type options struct {
+	pollInterval time.Duration
+	lookup       func(name string) semaphore.Semaphore
+	validate     func(name string, limit int) error
+	onChange     func([]Change)
+	onError      func(error)
+}
+
+// WithPollInterval sets how often Watch checks the file for changes, 1 second by default.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// WithLookup sets how semaphores are found by name, semaphore.Lookup by default.
+func WithLookup(lookup func(name string) semaphore.Semaphore) Option {
+	return func(o *options) {
+		o.lookup = lookup
+	}
+}
+
+// WithValidator adds a check of every entry, e.g. an upper bound of the limit.
+// Limits are always checked to be integers between 0 and math.MaxUint32 and names to be known.
+func WithValidator(validate func(name string, limit int) error) Option {
+	return func(o *options) {
+		o.validate = validate
+	}
+}
+
+// WithOnChange sets a function called by Watch with the limits changed by a reload.
+func WithOnChange(f func([]Change)) Option {
+	return func(o *options) {
+		o.onChange = f
+	}
+}
+
+// WithOnError sets a function called by Watch when the file can't be read or an update is rejected.
+// Every rejected version of the file is reported once, and so is a read error until the file is read again.
+func WithOnError(f func(error)) Option {
+	return func(o *options) {
+		o.onError = f
+	}
+}
+
+// Change is a limit changed by the config.
+type Change struct {
+	Name     string
+	Old, New int
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %d -> %d", c.Name, c.Old, c.New)
+}
+
+// ErrInvalidConfig is wrapped by errors of rejected updates.
+var ErrInvalidConfig = errors.New("semaphoreconfig: invalid config")
+
+// Loader applies the limits of a config file to named semaphores.
+type Loader struct {
+	path string
+	opts options
+
+	mu   sync.Mutex
+	last []byte // content of the last loaded version, valid or not
+
+	// readFailed is set by Watch after a read error was reported
+	readFailed bool
+}
+
+// NewLoader creates a Loader of the file at path.
+func NewLoader(path string, opts ...Option) *Loader {
+	o := options{
+		pollInterval: defaultPollInterval,
+		lookup:       semaphore.Lookup,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Loader{
+		path: path,
+		opts: o,
+	}
+}
+
+// Load reads the file and applies its limits via SetLimit, it returns the changed limits sorted by name.
+// If the file is invalid, no limit is changed and the returned error wraps ErrInvalidConfig.
+func (l *Loader) Load() ([]Change, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last = data
+	return l.apply(data)
+}
+
+// Watch polls the file until ctx is done and applies every changed version of it, like Load.
+// Changes and errors are reported to the functions set by WithOnChange and WithOnError.
+// If Load was called before, the file is applied only when its content changes,
+// so limits changed at runtime by other means are kept until the next edit. It returns ctx.Err().
+func (l *Loader) Watch(ctx context.Context) error {
+	t := time.NewTicker(l.opts.pollInterval)
+	defer t.Stop()
+	for {
+		l.reload()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// reload applies the file if its content differs from the last loaded one.
+func (l *Loader) reload() {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if !l.readFailed {
+			l.readFailed = true
+			l.reportError(err)
+		}
+		return
+	}
+	l.readFailed = false
+
+	l.mu.Lock()
+	if l.last != nil && bytes.Equal(data, l.last) {
+		l.mu.Unlock()
+		return
+	}
+	l.last = data
+	changes, err := l.apply(data)
+	l.mu.Unlock()
+
+	if err != nil {
+		l.reportError(err)
+		return
+	}
+	if len(changes) > 0 && l.opts.onChange != nil {
+		l.opts.onChange(changes)
+	}
+}
+
+func (l *Loader) reportError(err error) {
+	if l.opts.onError != nil {
+		l.opts.onError(err)
+	}
+}
+
+// apply validates all entries and then sets the limits.
+func (l *Loader) apply(data []byte) ([]Change, error) {
+	limits, err := parse(l.path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, l.path, err)
+	}
+
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sems := make([]semaphore.Semaphore, len(names))
+	for i, name := range names {
+		limit := limits[name]
+		if limit < 0 {
+			return nil, fmt.Errorf("%w: %s: limit of %q must not be negative", ErrInvalidConfig, l.path, name)
+		}
+		// the semaphore keeps the limit in 32 bits
+		if uint64(limit) > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: %s: limit of %q must not exceed %d", ErrInvalidConfig, l.path, name, uint32(math.MaxUint32))
+		}
+		if sems[i] = l.opts.lookup(name); sems[i] == nil {
+			return nil, fmt.Errorf("%w: %s: semaphore %q is not registered", ErrInvalidConfig, l.path, name)
+		}
+		if l.opts.validate != nil {
+			if err := l.opts.validate(name, limit); err != nil {
+				return nil, fmt.Errorf("%w: %s: %q: %v", ErrInvalidConfig, l.path, name, err)
+			}
+		}
+	}
+
+	var changes []Change
+	for i, name := range names {
+		old := sems[i].GetLimit()
+		if limit := limits[name]; limit != old {
+			sems[i].SetLimit(limit)
+			changes = append(changes, Change{Name: name, Old: old, New: limit})
+		}
+	}
+	return changes, nil
+}
+
+// parse parses JSON files by the .json extension or by the leading brace, and YAML files otherwise.
+func parse(path string, data []byte) (map[string]int, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return parseJSON(data)
+	case ".yaml", ".yml":
+		return parseYAML(data)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseJSON(data)
+	}
+	return parseYAML(data)
+}
+
+func parseJSON(data []byte) (map[string]int, error) {
+	var raw map[string]json.Number
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	limits := make(map[string]int, len(raw))
+	for name, num := range raw {
+		limit, err := strconv.Atoi(num.String())
+		if err != nil {
+			return nil, fmt.Errorf("limit of %q is not an integer: %s", name, num)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// parseYAML parses a flat mapping of names to integers, one "name: limit" per line,
+// names may be quoted, comments start with #.
+func parseYAML(data []byte) (map[string]int, error) {
+	limits := make(map[string]int)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || s == "---" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		var name string
+		if q := s[0]; q == '"' || q == '\'' {
+			end := strings.IndexByte(s[1:], q)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quoted name", line)
+			}
+			name, s = s[1:end+1], s[end+2:]
+			if !strings.HasPrefix(s, ":") {
+				return nil, fmt.Errorf("line %d: expected \"name: limit\"", line)
+			}
+			s = s[1:]
+		} else {
+			i := strings.IndexByte(s, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("line %d: expected \"name: limit\"", line)
+			}
+			name, s = strings.TrimSpace(s[:i]), s[i+1:]
+		}
+
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		limit, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: limit of %q is not an integer: %q", line, name, s)
+		}
+		if _, ok := limits[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate name %q", line, name)
+		}
+		limits[name] = limit
+	}
+	return limits, sc.Err()
+}
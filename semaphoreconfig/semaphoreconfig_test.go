@@ -0,0 +1,208 @@
+package semaphoreconfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func register(t *testing.T, name string, limit int) semaphore.Semaphore {
+	sem := semaphore.New(limit)
+	semaphore.Register(name, sem)
+	t.Cleanup(func() { semaphore.Unregister(name) })
+	return sem
+}
+
+// writeFile replaces the file atomically, so Watch never reads a partial write.
+func writeFile(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoader_Load(t *testing.T) {
+	db := register(t, "config.db", 1)
+	api := register(t, "config.api", 5)
+	other := register(t, "config.other", 3)
+
+	for _, file := range []struct{ name, content string }{
+		{"limits.json", `{"config.db": 10, "config.api": 5}`},
+		{"limits.yaml", "# limits\nconfig.db: 10 # primary\n'config.api': 5\n"},
+		{"limits", "---\n\"config.db\": 10\n\nconfig.api:5\n"},
+	} {
+		db.SetLimit(1)
+		path := filepath.Join(t.TempDir(), file.name)
+		writeFile(t, path, file.content)
+
+		changes, err := NewLoader(path).Load()
+		if err != nil {
+			t.Fatal(file.name, err)
+		}
+		if expected := []Change{{"config.db", 1, 10}}; !reflect.DeepEqual(changes, expected) {
+			t.Error(file.name, "changes", expected, "expected, got", changes)
+		}
+		if db.GetLimit() != 10 || api.GetLimit() != 5 || other.GetLimit() != 3 {
+			t.Error(file.name, "unexpected limits", db.GetLimit(), api.GetLimit(), other.GetLimit())
+		}
+	}
+}
+
+func TestLoader_Load_invalid(t *testing.T) {
+	db := register(t, "config.db", 1)
+	api := register(t, "config.api", 5)
+
+	max100 := WithValidator(func(name string, limit int) error {
+		if limit > 100 {
+			return errors.New("limit is over 100")
+		}
+		return nil
+	})
+	for _, content := range []string{
+		`{"config.db": 10, "config.api": -1}`,
+		`{"config.db": 10, "config.api": 1.5}`,
+		`{"config.db": 10, "config.unknown": 1}`,
+		`{"config.db": 10, "config.api": 1000}`,
+		`{"config.db": 10,`,
+		"config.db: 10\nconfig.api: x\n",
+		"config.db: 10\nconfig.api\n",
+		"config.db: 10\nconfig.db: 20\n",
+		"'config.db: 10\n",
+	} {
+		path := filepath.Join(t.TempDir(), "limits")
+		writeFile(t, path, content)
+
+		changes, err := NewLoader(path, max100).Load()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%q: ErrInvalidConfig expected, got %v", content, err)
+		}
+		if changes != nil || db.GetLimit() != 1 || api.GetLimit() != 5 {
+			t.Errorf("%q: semaphores must not be touched", content)
+		}
+	}
+
+	// the range of the semaphore limit is checked without validators
+	for _, content := range []string{
+		`{"config.db": 10, "config.api": 4294967296}`,
+		"config.db: 10\nconfig.api: 4294967296\n",
+	} {
+		path := filepath.Join(t.TempDir(), "limits")
+		writeFile(t, path, content)
+
+		if _, err := NewLoader(path).Load(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%q: ErrInvalidConfig expected, got %v", content, err)
+		}
+		if db.GetLimit() != 1 || api.GetLimit() != 5 {
+			t.Errorf("%q: semaphores must not be touched", content)
+		}
+	}
+
+	if _, err := NewLoader(filepath.Join(t.TempDir(), "missing")).Load(); !os.IsNotExist(err) {
+		t.Error("not exist error expected, got", err)
+	}
+}
+
+func TestLoader_Watch(t *testing.T) {
+	db := register(t, "config.db", 1)
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	writeFile(t, path, "config.db: 2\n")
+
+	changed := make(chan []Change, 10)
+	failed := make(chan error, 10)
+	l := NewLoader(path,
+		WithPollInterval(5*time.Millisecond),
+		WithOnChange(func(c []Change) { changed <- c }),
+		WithOnError(func(err error) { failed <- err }),
+	)
+	if _, err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.Watch(ctx)
+	}()
+
+	// the loaded version is not applied again, a runtime change is kept
+	db.SetLimit(7)
+	time.Sleep(30 * time.Millisecond)
+	if db.GetLimit() != 7 {
+		t.Error("unchanged file must not be applied")
+	}
+
+	writeFile(t, path, "config.db: 3\n")
+	select {
+	case c := <-changed:
+		if expected := []Change{{"config.db", 7, 3}}; !reflect.DeepEqual(c, expected) {
+			t.Error("changes", expected, "expected, got", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not applied")
+	}
+
+	// invalid update is rejected and reported once
+	writeFile(t, path, "config.db: -3\n")
+	select {
+	case err := <-failed:
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Error("ErrInvalidConfig expected, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid update is not reported")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if db.GetLimit() != 3 || len(failed) != 0 {
+		t.Error("invalid update must be rejected once, limit", db.GetLimit(), "errors", len(failed))
+	}
+
+	// so is a limit out of the semaphore range
+	writeFile(t, path, "config.db: 4294967296\n")
+	select {
+	case err := <-failed:
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Error("ErrInvalidConfig expected, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("limit out of range is not reported")
+	}
+	if db.GetLimit() != 3 {
+		t.Error("limit out of range must be rejected, limit", db.GetLimit())
+	}
+
+	// missing file is reported once too
+	os.Remove(path)
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read error is not reported")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if len(failed) != 0 {
+		t.Error("read error must be reported once, got", len(failed)+1)
+	}
+
+	writeFile(t, path, "config.db: 4\n")
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not applied")
+	}
+	if db.GetLimit() != 4 {
+		t.Error("limit 4 expected, got", db.GetLimit())
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("context.Canceled expected, got", err)
+	}
+}
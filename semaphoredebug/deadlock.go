@@ -0,0 +1,451 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoredebug provides debugging tools for programs using semaphores.
+//
+// A Detector finds deadlocks between goroutines holding and waiting on several semaphores:
+// wrap every semaphore of interest with Detector.Wrap and use the wrappers instead.
+// Goroutines are reported with the labels of the contexts passed to Acquire, see ContextWithLabel.
+// Bookkeeping costs a goroutine stack walk per call, so it's meant for tests and staging.
+//
+// A Handler serves the semaphores registered with semaphore.Register over HTTP:
+// their limits, counts and waiting statistics, and changes their limits at runtime.
+//
+// Profiled records who holds and who waits for permits in pprof profiles.
+package semaphoredebug // import "github.com/marusama/semaphore/v2/semaphoredebug"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// Option configures the Detector.
+type Option func(*options)
+
+type options struct {
+	handler       func(*Deadlock)
+	checkInterval time.Duration
+}
+
+// WithHandler sets a function called once for every found deadlock.
+// By default the Detector panics with the *Deadlock.
+func WithHandler(h func(*Deadlock)) Option {
+	return func(o *options) {
+		o.handler = h
+	}
+}
+
+// WithCheckInterval sets how often a blocked Acquire checks for deadlocks, 100ms by default.
+func WithCheckInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.checkInterval = d
+	}
+}
+
+// Detector records which goroutines hold and wait on the wrapped semaphores
+// and reports goroutines that wait on each other forever.
+type Detector struct {
+	opts options
+
+	mu      sync.Mutex
+	sems    map[*trackedSemaphore]struct{}
+	gs      map[int64]*goroutineState
+	waitSeq uint64
+
+	// keys of already reported deadlocks
+	reported map[string]struct{}
+}
+
+// goroutineState is what a goroutine holds and waits on.
+type goroutineState struct {
+	label string
+	held  map[*trackedSemaphore]int
+
+	waiting   *trackedSemaphore
+	waitingN  int
+	waitID    uint64
+	waitStack string
+}
+
+// NewDetector creates a Detector.
+func NewDetector(opts ...Option) *Detector {
+	o := options{
+		handler: func(d *Deadlock) {
+			panic(d)
+		},
+		checkInterval: 100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Detector{
+		opts:     o,
+		sems:     make(map[*trackedSemaphore]struct{}),
+		gs:       make(map[int64]*goroutineState),
+		reported: make(map[string]struct{}),
+	}
+}
+
+// Wrap returns a Semaphore tracked by the Detector, name identifies it in reports.
+func (d *Detector) Wrap(name string, sem semaphore.Semaphore) semaphore.Semaphore {
+	s := &trackedSemaphore{
+		Semaphore: sem,
+		name:      name,
+		d:         d,
+	}
+	d.mu.Lock()
+	d.sems[s] = struct{}{}
+	d.mu.Unlock()
+	return s
+}
+
+// Deadlock describes goroutines blocked forever on the wrapped semaphores.
+type Deadlock struct {
+	Goroutines []Goroutine
+}
+
+// Goroutine is a blocked goroutine in a Deadlock.
+type Goroutine struct {
+	// ID is the goroutine id as shown in stack traces.
+	ID int64
+
+	// Label is the label of the latest context the goroutine passed to Acquire, see ContextWithLabel.
+	Label string
+
+	// Waiting is the name of the semaphore the goroutine waits on and WaitingN is the requested number of entries.
+	Waiting  string
+	WaitingN int
+
+	// Held maps names of semaphores to the number of entries held by the goroutine.
+	Held map[string]int
+
+	// Stack is the stack trace of the goroutine when it started waiting.
+	Stack string
+}
+
+func (dl *Deadlock) Error() string {
+	return dl.String()
+}
+
+func (dl *Deadlock) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "semaphore deadlock of %d goroutines:\n", len(dl.Goroutines))
+	for _, g := range dl.Goroutines {
+		names := make([]string, 0, len(g.Held))
+		for name := range g.Held {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		held := make([]string, 0, len(names))
+		for _, name := range names {
+			held = append(held, fmt.Sprintf("%s(%d)", name, g.Held[name]))
+		}
+		label := ""
+		if g.Label != "" {
+			label = " [" + g.Label + "]"
+		}
+		fmt.Fprintf(&b, "\ngoroutine %d%s holds %s and waits on %s(%d)\n%s\n",
+			g.ID, label, strings.Join(held, ", "), g.Waiting, g.WaitingN, g.Stack)
+	}
+	return b.String()
+}
+
+// Check returns the goroutines deadlocked at the moment, or nil if there are none.
+// Unlike the checks done by blocked Acquire calls it reports the same deadlock every time it's called.
+func (d *Detector) Check() *Deadlock {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findDeadlock()
+}
+
+// check reports a new deadlock to the handler.
+func (d *Detector) check() {
+	d.mu.Lock()
+	dl := d.findDeadlock()
+	if dl != nil {
+		key := d.deadlockKey(dl)
+		if _, ok := d.reported[key]; ok {
+			dl = nil
+		} else {
+			d.reported[key] = struct{}{}
+		}
+	}
+	d.mu.Unlock()
+
+	if dl != nil {
+		d.opts.handler(dl)
+	}
+}
+
+// findDeadlock looks for waiting goroutines that can't make progress:
+// a waiter can progress if its semaphore has room, is held by some goroutine which isn't waiting
+// (or can progress itself), or by an untracked holder. All the others wait on each other.
+// Must be called under d.mu.
+func (d *Detector) findDeadlock() *Deadlock {
+	blocked := make(map[int64]*goroutineState)
+	for id, g := range d.gs {
+		if g.waiting != nil {
+			blocked[id] = g
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for id, g := range blocked {
+			if d.canProgress(g, blocked) {
+				delete(blocked, id)
+				changed = true
+			}
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	dl := &Deadlock{}
+	for id, g := range blocked {
+		held := make(map[string]int, len(g.held))
+		for s, n := range g.held {
+			held[s.name] += n
+		}
+		dl.Goroutines = append(dl.Goroutines, Goroutine{
+			ID:       id,
+			Label:    g.label,
+			Waiting:  g.waiting.name,
+			WaitingN: g.waitingN,
+			Held:     held,
+			Stack:    g.waitStack,
+		})
+	}
+	sort.Slice(dl.Goroutines, func(i, j int) bool {
+		return dl.Goroutines[i].ID < dl.Goroutines[j].ID
+	})
+	return dl
+}
+
+// canProgress reports if the waiter g may be woken up by something other than the blocked goroutines.
+func (d *Detector) canProgress(g *goroutineState, blocked map[int64]*goroutineState) bool {
+	s := g.waiting
+	count := s.GetCount()
+	if s.GetLimit()-count >= g.waitingN {
+		// room is available, the waiter is about to wake up
+		return true
+	}
+
+	tracked := 0
+	for id, other := range d.gs {
+		n := other.held[s]
+		if n == 0 {
+			continue
+		}
+		if _, ok := blocked[id]; !ok {
+			return true
+		}
+		tracked += n
+	}
+	// entries acquired bypassing the wrapper may be released any time,
+	// and without holders the waiter waits for SetLimit rather than for a deadlock
+	return count > tracked || tracked == 0
+}
+
+// deadlockKey identifies the waits of a deadlock, so it's reported only once.
+func (d *Detector) deadlockKey(dl *Deadlock) string {
+	ids := make([]string, 0, len(dl.Goroutines))
+	for _, g := range dl.Goroutines {
+		ids = append(ids, strconv.FormatUint(d.gs[g.ID].waitID, 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+// state returns the state of the goroutine id, must be called under d.mu.
+func (d *Detector) state(id int64) *goroutineState {
+	g := d.gs[id]
+	if g == nil {
+		g = &goroutineState{held: make(map[*trackedSemaphore]int)}
+		d.gs[id] = g
+	}
+	return g
+}
+
+// cleanup forgets the goroutine id if it neither holds nor waits, must be called under d.mu.
+func (d *Detector) cleanup(id int64) {
+	if g := d.gs[id]; g != nil && g.waiting == nil && len(g.held) == 0 {
+		delete(d.gs, id)
+	}
+}
+
+func (d *Detector) acquired(s *trackedSemaphore, id int64, label string, n int) {
+	d.mu.Lock()
+	g := d.state(id)
+	if label != "" {
+		g.label = label
+	}
+	g.held[s] += n
+	g.waiting = nil
+	d.mu.Unlock()
+}
+
+func (d *Detector) startWaiting(s *trackedSemaphore, id int64, label string, n int) {
+	stack := make([]byte, 8192)
+	stack = stack[:runtime.Stack(stack, false)]
+
+	d.mu.Lock()
+	g := d.state(id)
+	if label != "" {
+		g.label = label
+	}
+	d.waitSeq++
+	g.waiting = s
+	g.waitingN = n
+	g.waitID = d.waitSeq
+	g.waitStack = string(stack)
+	d.mu.Unlock()
+}
+
+func (d *Detector) stopWaiting(id int64) {
+	d.mu.Lock()
+	if g := d.gs[id]; g != nil {
+		g.waiting = nil
+	}
+	d.cleanup(id)
+	d.mu.Unlock()
+}
+
+func (d *Detector) released(s *trackedSemaphore, id int64, n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// entries are usually released by the goroutine that acquired them,
+	// but may be passed to another one
+	if g := d.gs[id]; g != nil {
+		n = g.release(s, n)
+		d.cleanup(id)
+	}
+	for otherID, g := range d.gs {
+		if n == 0 {
+			return
+		}
+		n = g.release(s, n)
+		d.cleanup(otherID)
+	}
+}
+
+// release forgets up to n held entries of s and returns the number of entries left to forget.
+func (g *goroutineState) release(s *trackedSemaphore, n int) int {
+	held := g.held[s]
+	if held > n {
+		g.held[s] = held - n
+		return 0
+	}
+	delete(g.held, s)
+	return n - held
+}
+
+// trackedSemaphore reports acquisitions and releases to the Detector.
+type trackedSemaphore struct {
+	semaphore.Semaphore
+	name string
+	d    *Detector
+}
+
+func (s *trackedSemaphore) Acquire(ctx context.Context, n int) error {
+	if ctx != nil && ctx.Err() != nil {
+		// like the wrapped semaphore, don't acquire with a done context
+		return ctx.Err()
+	}
+	id := goroutineID()
+	label := contextLabel(ctx)
+	if s.Semaphore.TryAcquire(n) {
+		s.d.acquired(s, id, label, n)
+		return nil
+	}
+
+	s.d.startWaiting(s, id, label, n)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(s.d.opts.checkInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.d.check()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := s.Semaphore.Acquire(ctx, n)
+	close(done)
+	if err != nil {
+		s.d.stopWaiting(id)
+		return err
+	}
+	s.d.acquired(s, id, label, n)
+	return nil
+}
+
+func (s *trackedSemaphore) TryAcquire(n int) bool {
+	if !s.Semaphore.TryAcquire(n) {
+		return false
+	}
+	s.d.acquired(s, goroutineID(), "", n)
+	return true
+}
+
+func (s *trackedSemaphore) Release(n int) int {
+	count := s.Semaphore.Release(n)
+	s.d.released(s, goroutineID(), n)
+	return count
+}
+
+type labelKey struct{}
+
+// ContextWithLabel returns a context labelling the goroutine which passes it to Acquire of the wrapped semaphores
+// in Deadlock reports, e.g. with the request or job it works on.
+// Without such a label, pprof labels of the context are used, see pprof.WithLabels.
+func ContextWithLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, labelKey{}, label)
+}
+
+// contextLabel returns the label of ctx, or its pprof labels as "key=value" pairs.
+func contextLabel(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if label, ok := ctx.Value(labelKey{}).(string); ok {
+		return label
+	}
+	var labels []string
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		labels = append(labels, key+"="+value)
+		return true
+	})
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+var goroutinePrefix = []byte("goroutine ")
+
+// goroutineID returns the id of the calling goroutine parsed from its stack trace.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, goroutinePrefix)
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseInt(string(buf), 10, 64)
+	return id
+}
@@ -0,0 +1,272 @@
+package semaphoredebug
+
+import (
+	"context"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/semaphoretest"
+)
+
+func waitDeadlock(t *testing.T, found <-chan *Deadlock) *Deadlock {
+	select {
+	case dl := <-found:
+		return dl
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock is not reported")
+		return nil
+	}
+}
+
+func TestDetector_cycle(t *testing.T) {
+	found := make(chan *Deadlock, 1)
+	d := NewDetector(
+		WithCheckInterval(10*time.Millisecond),
+		WithHandler(func(dl *Deadlock) { found <- dl }),
+	)
+	x := d.Wrap("x", semaphore.New(1))
+	y := d.Wrap("y", semaphore.New(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	xHeld, yHeld := make(chan struct{}), make(chan struct{})
+	go func() {
+		x.Acquire(nil, 1)
+		close(xHeld)
+		<-yHeld
+		if y.Acquire(ctx, 1) == nil {
+			y.Release(1)
+		}
+		x.Release(1)
+	}()
+	go func() {
+		y.Acquire(nil, 1)
+		close(yHeld)
+		<-xHeld
+		if x.Acquire(ctx, 1) == nil {
+			x.Release(1)
+		}
+		y.Release(1)
+	}()
+
+	dl := waitDeadlock(t, found)
+	if len(dl.Goroutines) != 2 {
+		t.Fatal("2 deadlocked goroutines expected, got", len(dl.Goroutines))
+	}
+	for _, g := range dl.Goroutines {
+		if g.Held[g.Waiting] != 0 || len(g.Held) != 1 || g.WaitingN != 1 {
+			t.Errorf("unexpected goroutine state %+v", g)
+		}
+		if !strings.Contains(g.Stack, "TestDetector_cycle") {
+			t.Error("stack doesn't point to the waiting call:", g.Stack)
+		}
+	}
+	if d.Check() == nil {
+		t.Error("Check must report the deadlock")
+	}
+	if !strings.Contains(dl.Error(), "waits on x(1)") || !strings.Contains(dl.Error(), "waits on y(1)") {
+		t.Error("unexpected report:", dl.Error())
+	}
+
+	// the deadlock is broken by cancelling the waits
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for x.GetCount() != 0 || y.GetCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("waiters are not cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dl := d.Check(); dl != nil {
+		t.Error("no deadlock expected, got", dl)
+	}
+	select {
+	case dl := <-found:
+		t.Error("deadlock must be reported once, got", dl)
+	default:
+	}
+}
+
+func TestDetector_no_deadlock(t *testing.T) {
+	d := NewDetector(
+		WithCheckInterval(10*time.Millisecond),
+		WithHandler(func(dl *Deadlock) { t.Error("unexpected deadlock:", dl) }),
+	)
+	x := d.Wrap("x", semaphore.New(1))
+	y := d.Wrap("y", semaphore.New(1))
+
+	// holder of y isn't waiting, so the waiters will progress
+	y.Acquire(nil, 1)
+	done := make(chan struct{})
+	go func() {
+		x.Acquire(nil, 1)
+		y.Acquire(nil, 1)
+		y.Release(1)
+		x.Release(1)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if dl := d.Check(); dl != nil {
+		t.Error("no deadlock expected, got", dl)
+	}
+	y.Release(1)
+	<-done
+
+	if x.GetCount() != 0 || y.GetCount() != 0 {
+		t.Error("semaphores must be released")
+	}
+	d.mu.Lock()
+	if len(d.gs) != 0 {
+		t.Error("goroutine states must be forgotten, got", len(d.gs))
+	}
+	d.mu.Unlock()
+}
+
+func TestDetector_untracked_holder(t *testing.T) {
+	d := NewDetector(WithHandler(func(dl *Deadlock) { t.Error("unexpected deadlock:", dl) }))
+	raw := semaphore.New(1)
+	x := d.Wrap("x", raw)
+
+	// entries taken bypassing the wrapper may be released any time
+	raw.Acquire(nil, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go x.Acquire(ctx, 1)
+	time.Sleep(20 * time.Millisecond)
+	if dl := d.Check(); dl != nil {
+		t.Error("no deadlock expected, got", dl)
+	}
+	<-ctx.Done()
+}
+
+func TestDetector_self_deadlock(t *testing.T) {
+	found := make(chan *Deadlock, 1)
+	d := NewDetector(
+		WithCheckInterval(10*time.Millisecond),
+		WithHandler(func(dl *Deadlock) { found <- dl }),
+	)
+	x := d.Wrap("x", semaphore.New(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		x.Acquire(nil, 1)
+		x.Acquire(ctx, 2) // never fits while holding 1
+		x.Release(1)
+	}()
+
+	dl := waitDeadlock(t, found)
+	if len(dl.Goroutines) != 1 || dl.Goroutines[0].Held["x"] != 1 || dl.Goroutines[0].WaitingN != 2 {
+		t.Errorf("unexpected deadlock %+v", dl)
+	}
+	cancel()
+}
+
+func TestDetector_labels(t *testing.T) {
+	found := make(chan *Deadlock, 2)
+	d := NewDetector(
+		WithCheckInterval(10*time.Millisecond),
+		WithHandler(func(dl *Deadlock) { found <- dl }),
+	)
+	x := d.Wrap("x", semaphore.New(2))
+	y := d.Wrap("y", semaphore.New(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ctx := ContextWithLabel(ctx, "job 42")
+		x.Acquire(ctx, 1)
+		x.Acquire(ctx, 2)
+		x.Release(1)
+	}()
+	dl := waitDeadlock(t, found)
+	if len(dl.Goroutines) != 1 || dl.Goroutines[0].Label != "job 42" {
+		t.Errorf("label expected, got %+v", dl)
+	}
+	if !strings.Contains(dl.String(), "[job 42] holds x(1)") {
+		t.Error("unexpected report:", dl.String())
+	}
+
+	// pprof labels are used without a label
+	go func() {
+		ctx := pprof.WithLabels(ctx, pprof.Labels("worker", "b", "job", "7"))
+		y.Acquire(ctx, 1)
+		y.Acquire(ctx, 2)
+		y.Release(1)
+	}()
+	dl = waitDeadlock(t, found)
+	for _, g := range dl.Goroutines {
+		if g.Waiting == "y" && g.Label != "job=7,worker=b" {
+			t.Error("pprof labels expected, got", g.Label)
+		}
+	}
+}
+
+func TestDetector_release_by_other_goroutine(t *testing.T) {
+	d := NewDetector()
+	x := d.Wrap("x", semaphore.New(2))
+
+	x.Acquire(nil, 2)
+	done := make(chan struct{})
+	go func() {
+		x.Release(2)
+		close(done)
+	}()
+	<-done
+
+	d.mu.Lock()
+	if len(d.gs) != 0 {
+		t.Error("goroutine states must be forgotten, got", len(d.gs))
+	}
+	d.mu.Unlock()
+}
+
+func TestDetector_default_handler_panics(t *testing.T) {
+	d := NewDetector()
+	x := d.Wrap("x", semaphore.New(1))
+	x.Acquire(nil, 1)
+
+	id := goroutineID()
+	d.startWaiting(x.(*trackedSemaphore), id, "", 1)
+	defer func() {
+		if _, ok := recover().(*Deadlock); !ok {
+			t.Error("Panic with *Deadlock expected")
+		}
+	}()
+	d.check()
+}
+
+func TestGoroutineID(t *testing.T) {
+	ids := make(chan int64, 2)
+	go func() { ids <- goroutineID() }()
+	go func() { ids <- goroutineID() }()
+	a, b := <-ids, <-ids
+	if a <= 0 || b <= 0 || a == b {
+		t.Error("unexpected goroutine ids", a, b)
+	}
+}
+
+func TestDetector_Wrap_Acquire_ctx_done(t *testing.T) {
+	d := NewDetector()
+	sem := d.Wrap("a", semaphore.New(1))
+
+	// a done context fails even if the semaphore is free, like the wrapped semaphore
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sem.Acquire(ctx, 1); err != context.Canceled {
+		t.Error("context.Canceled expected, got", err)
+	}
+	if count := sem.GetCount(); count != 0 {
+		t.Error("semaphore must have count = 0, but has", count)
+	}
+}
+
+func TestDetector_Wrap_conformance(t *testing.T) {
+	d := NewDetector()
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return d.Wrap("sem", semaphore.New(limit))
+	})
+}
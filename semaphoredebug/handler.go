@@ -0,0 +1,298 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoredebug
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// HandlerOption configures the Handler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	authorize func(r *http.Request) bool
+	window    time.Duration
+}
+
+// WithAuthorizer enables limit changes by POST requests for which authorize returns true.
+// Without it limit changes are forbidden.
+func WithAuthorizer(authorize func(r *http.Request) bool) HandlerOption {
+	return func(o *handlerOptions) {
+		o.authorize = authorize
+	}
+}
+
+// WithToken enables limit changes by POST requests with the token
+// in the "Authorization: Bearer" header or in the "token" form field.
+func WithToken(token string) HandlerOption {
+	if token == "" {
+		panic("token must not be empty")
+	}
+	return WithAuthorizer(func(r *http.Request) bool {
+		got := r.PostFormValue("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	})
+}
+
+// WithWindow sets the period of recent statistics, 1 minute by default.
+func WithWindow(d time.Duration) HandlerOption {
+	return func(o *handlerOptions) {
+		o.window = d
+	}
+}
+
+// Handler serves the semaphores registered with semaphore.Register, mount it like
+//
+//	http.Handle("/debug/semaphores", semaphoredebug.NewHandler(semaphoredebug.WithToken(token)))
+//
+// GET lists the limit, count and statistics of every semaphore as an HTML page,
+// or as JSON if the request has "format=json" query or accepts "application/json".
+// Statistics are shown for semaphores implementing semaphore.StatsReporter,
+// recent ones are the difference to a snapshot taken by an earlier request at least a window ago.
+//
+// POST with "name" and "limit" form fields changes the limit of the named semaphore,
+// if it's allowed by WithToken or WithAuthorizer.
+type Handler struct {
+	opts handlerOptions
+
+	mu      sync.Mutex
+	samples map[string][]sample
+}
+
+// sample is a snapshot of statistics.
+type sample struct {
+	at    time.Time
+	stats semaphore.Stats
+}
+
+// NewHandler creates a Handler.
+func NewHandler(opts ...HandlerOption) *Handler {
+	o := handlerOptions{
+		window: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Handler{
+		opts:    o,
+		samples: make(map[string][]sample),
+	}
+}
+
+// Status is the JSON representation of a semaphore.
+type Status struct {
+	Name   string       `json:"name"`
+	Limit  int          `json:"limit"`
+	Count  int          `json:"count"`
+	Stats  *StatsStatus `json:"stats,omitempty"`
+	Recent *StatsStatus `json:"recent,omitempty"`
+}
+
+// StatsStatus is the JSON representation of semaphore.Stats, for all time or for the recent period.
+type StatsStatus struct {
+	// PeriodSeconds is the length of the recent period, zero for all time
+	PeriodSeconds float64 `json:"period_seconds,omitempty"`
+
+	Waiters         int     `json:"waiters"`
+	Waits           uint64  `json:"waits"`
+	Cancels         uint64  `json:"cancels"`
+	WaitTimeSeconds float64 `json:"wait_time_seconds"`
+	AvgWaitSeconds  float64 `json:"avg_wait_seconds"`
+	Preemptions     uint64  `json:"preemptions"`
+	ForcedReleases  uint64  `json:"forced_releases"`
+}
+
+func newStatsStatus(st semaphore.Stats) *StatsStatus {
+	s := &StatsStatus{
+		Waiters:         st.Waiters,
+		Waits:           st.Waits,
+		Cancels:         st.Cancels,
+		WaitTimeSeconds: st.WaitTime.Seconds(),
+		Preemptions:     st.Preemptions,
+		ForcedReleases:  st.ForcedReleases,
+	}
+	if st.Waits > 0 {
+		s.AvgWaitSeconds = s.WaitTimeSeconds / float64(st.Waits)
+	}
+	return s
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.serveList(w, r)
+	case http.MethodPost:
+		h.serveSetLimit(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (h *Handler) serveList(w http.ResponseWriter, r *http.Request) {
+	statuses := h.statuses(time.Now())
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listTemplate.Execute(w, struct {
+		Statuses []Status
+		CanSet   bool
+	}{statuses, h.opts.authorize != nil})
+}
+
+func (h *Handler) serveSetLimit(w http.ResponseWriter, r *http.Request) {
+	if h.opts.authorize == nil {
+		http.Error(w, "limit changes are disabled", http.StatusForbidden)
+		return
+	}
+	if !h.opts.authorize(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := r.PostFormValue("name")
+	sem := semaphore.Lookup(name)
+	if sem == nil {
+		http.Error(w, "semaphore "+strconv.Quote(name)+" is not registered", http.StatusNotFound)
+		return
+	}
+	// the semaphore keeps the limit in 32 bits
+	limit, err := strconv.ParseInt(r.PostFormValue("limit"), 10, strconv.IntSize)
+	if err != nil || limit < 0 || limit > math.MaxUint32 {
+		http.Error(w, "limit must be an integer between 0 and "+strconv.FormatUint(math.MaxUint32, 10), http.StatusBadRequest)
+		return
+	}
+	sem.SetLimit(int(limit))
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, h.status(name, sem, time.Now()))
+		return
+	}
+	http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// statuses returns the statuses of the registered semaphores and forgets samples of unregistered ones.
+func (h *Handler) statuses(now time.Time) []Status {
+	names := semaphore.Registered()
+	statuses := make([]Status, 0, len(names))
+	for _, name := range names {
+		if sem := semaphore.Lookup(name); sem != nil {
+			statuses = append(statuses, h.status(name, sem, now))
+		}
+	}
+
+	h.mu.Lock()
+	for name := range h.samples {
+		if semaphore.Lookup(name) == nil {
+			delete(h.samples, name)
+		}
+	}
+	h.mu.Unlock()
+	return statuses
+}
+
+func (h *Handler) status(name string, sem semaphore.Semaphore, now time.Time) Status {
+	s := Status{
+		Name:  name,
+		Limit: sem.GetLimit(),
+		Count: sem.GetCount(),
+	}
+	if sr, ok := sem.(semaphore.StatsReporter); ok {
+		st := sr.Stats()
+		s.Stats = newStatsStatus(st)
+		s.Recent = h.recent(name, st, now)
+	}
+	return s
+}
+
+// recent returns statistics since the newest sample taken at least a window ago,
+// or since the oldest sample if all of them are newer, and records the current sample.
+func (h *Handler) recent(name string, st semaphore.Stats, now time.Time) *StatsStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// the newest sample taken at least a window ago, or the oldest one;
+	// samples before it are not needed anymore
+	samples := h.samples[name]
+	base := 0
+	for base+1 < len(samples) && now.Sub(samples[base+1].at) >= h.opts.window {
+		base++
+	}
+	samples = samples[base:]
+	if len(samples) > 0 && st.Waits < samples[0].stats.Waits {
+		// another semaphore is registered with the same name
+		samples = nil
+	}
+
+	var res *StatsStatus
+	if len(samples) > 0 {
+		old := samples[0]
+		res = newStatsStatus(semaphore.Stats{
+			Waiters:        st.Waiters,
+			Waits:          st.Waits - old.stats.Waits,
+			Cancels:        st.Cancels - old.stats.Cancels,
+			WaitTime:       st.WaitTime - old.stats.WaitTime,
+			Preemptions:    st.Preemptions - old.stats.Preemptions,
+			ForcedReleases: st.ForcedReleases - old.stats.ForcedReleases,
+		})
+		res.PeriodSeconds = now.Sub(old.at).Seconds()
+	}
+
+	// a sample per tenth of the window is enough
+	if len(samples) == 0 || now.Sub(samples[len(samples)-1].at) >= h.opts.window/10 {
+		samples = append(samples, sample{at: now, stats: st})
+	}
+	h.samples[name] = samples
+	return res
+}
+
+var listTemplate = template.Must(template.New("list").Funcs(template.FuncMap{
+	"seconds": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Microsecond).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Semaphores</title></head>
+<body>
+<h1>Semaphores</h1>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Limit</th><th>Count</th><th>Waiters</th><th>Waits</th><th>Cancels</th><th>Avg wait</th><th>Recent waits</th><th>Recent cancels</th><th>Recent avg wait</th>{{if .CanSet}}<th>Set limit</th>{{end}}</tr>
+{{- range .Statuses}}
+<tr><td>{{.Name}}</td><td>{{.Limit}}</td><td>{{.Count}}</td>
+{{- with .Stats}}<td>{{.Waiters}}</td><td>{{.Waits}}</td><td>{{.Cancels}}</td><td>{{seconds .AvgWaitSeconds}}</td>{{else}}<td colspan="4">-</td>{{end}}
+{{- with .Recent}}<td>{{.Waits}}</td><td>{{.Cancels}}</td><td>{{seconds .AvgWaitSeconds}} (last {{seconds .PeriodSeconds}})</td>{{else}}<td colspan="3">-</td>{{end}}
+{{- if $.CanSet}}<td><form method="post"><input type="hidden" name="name" value="{{.Name}}"><input name="limit" size="6" value="{{.Limit}}"> <input type="password" name="token" placeholder="token"> <input type="submit" value="Set"></form></td>{{end}}</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
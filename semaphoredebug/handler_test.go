@@ -0,0 +1,193 @@
+package semaphoredebug
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func register(t *testing.T, name string, sem semaphore.Semaphore) {
+	semaphore.Register(name, sem)
+	t.Cleanup(func() { semaphore.Unregister(name) })
+}
+
+func getStatuses(t *testing.T, h http.Handler) []Status {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/semaphores?format=json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("status 200 expected, got", w.Code)
+	}
+	var statuses []Status
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func postLimit(h http.Handler, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/debug/semaphores", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler_list(t *testing.T) {
+	db := semaphore.New(10)
+	db.Acquire(nil, 3)
+	register(t, "db", db)
+	register(t, "wrapped", NewDetector().Wrap("wrapped", semaphore.New(2)))
+
+	h := NewHandler()
+	statuses := getStatuses(t, h)
+	if len(statuses) != 2 || statuses[0].Name != "db" || statuses[1].Name != "wrapped" {
+		t.Fatal("registered semaphores expected, got", statuses)
+	}
+	if s := statuses[0]; s.Limit != 10 || s.Count != 3 || s.Stats == nil {
+		t.Error("limit, count and stats expected, got", s)
+	}
+	if s := statuses[0]; s.Recent != nil {
+		t.Error("no recent stats expected on the first request, got", s.Recent)
+	}
+	if s := statuses[1]; s.Limit != 2 || s.Stats != nil {
+		t.Error("no stats expected for a semaphore without them, got", s)
+	}
+
+	// HTML
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/semaphores", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Error("HTML expected, got", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<td>db</td><td>10</td><td>3</td>") || strings.Contains(body, "<form") {
+		t.Error("semaphore row without forms expected, got", body)
+	}
+
+	// Accept header
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/semaphores", nil)
+	r.Header.Set("Accept", "application/json")
+	h.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Error("JSON expected, got", ct)
+	}
+}
+
+func TestHandler_recent(t *testing.T) {
+	sem := semaphore.New(1)
+	register(t, "recent", sem)
+	h := NewHandler(WithWindow(50 * time.Millisecond))
+	getStatuses(t, h)
+
+	sem.Acquire(nil, 1)
+	done := make(chan struct{})
+	go func() {
+		sem.Acquire(nil, 1)
+		close(done)
+	}()
+	for sem.(semaphore.StatsReporter).Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sem.Release(1)
+	<-done
+
+	// a sample is taken per tenth of the window
+	time.Sleep(10 * time.Millisecond)
+	s := getStatuses(t, h)[0]
+	if s.Recent == nil || s.Recent.Waits != 1 || s.Stats.Waits != 1 {
+		t.Fatal("recent wait expected, got", s.Recent)
+	}
+
+	// the wait is out of the window
+	time.Sleep(60 * time.Millisecond)
+	s = getStatuses(t, h)[0]
+	if s.Recent == nil || s.Recent.Waits != 0 || s.Stats.Waits != 1 {
+		t.Error("no recent waits expected, got", s.Recent)
+	}
+}
+
+func TestHandler_SetLimit(t *testing.T) {
+	sem := semaphore.New(1)
+	register(t, "db", sem)
+	h := NewHandler(WithToken("secret"))
+
+	w := postLimit(h, url.Values{"name": {"db"}, "limit": {"5"}}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("status 401 expected, got", w.Code)
+	}
+	w = postLimit(h, url.Values{"name": {"db"}, "limit": {"5"}, "token": {"wrong"}}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("status 401 expected, got", w.Code)
+	}
+	if sem.GetLimit() != 1 {
+		t.Fatal("limit must not be changed")
+	}
+
+	// form with token, as sent by the HTML page
+	w = postLimit(h, url.Values{"name": {"db"}, "limit": {"5"}, "token": {"secret"}}, nil)
+	if w.Code != http.StatusSeeOther || sem.GetLimit() != 5 {
+		t.Error("limit must be changed with redirect, got", w.Code, sem.GetLimit())
+	}
+
+	// bearer token, JSON response
+	w = postLimit(h, url.Values{"name": {"db"}, "limit": {"7"}}, http.Header{
+		"Authorization": {"Bearer secret"},
+		"Accept":        {"application/json"},
+	})
+	var s Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || w.Code != http.StatusOK || s.Limit != 7 {
+		t.Error("changed status expected, got", w.Code, w.Body.String())
+	}
+
+	bearer := http.Header{"Authorization": {"Bearer secret"}}
+	if w = postLimit(h, url.Values{"name": {"unknown"}, "limit": {"7"}}, bearer); w.Code != http.StatusNotFound {
+		t.Error("status 404 expected, got", w.Code)
+	}
+	for _, limit := range []string{"", "-1", "x", "4294967296", "9223372036854775808"} {
+		if w = postLimit(h, url.Values{"name": {"db"}, "limit": {limit}}, bearer); w.Code != http.StatusBadRequest {
+			t.Error("status 400 expected, got", w.Code)
+		}
+	}
+	if sem.GetLimit() != 7 {
+		t.Error("limit must not be changed by bad requests")
+	}
+
+	// the largest limit of the semaphore, if int holds it
+	if strconv.IntSize == 64 {
+		if w = postLimit(h, url.Values{"name": {"db"}, "limit": {"4294967295"}}, bearer); w.Code != http.StatusSeeOther {
+			t.Error("status 303 expected, got", w.Code)
+		}
+		if limit := uint64(sem.GetLimit()); limit != math.MaxUint32 {
+			t.Error("semaphore must have limit = ", uint32(math.MaxUint32), ", but has ", limit)
+		}
+	}
+}
+
+func TestHandler_SetLimit_disabled(t *testing.T) {
+	sem := semaphore.New(1)
+	register(t, "db", sem)
+	h := NewHandler()
+
+	w := postLimit(h, url.Values{"name": {"db"}, "limit": {"5"}}, nil)
+	if w.Code != http.StatusForbidden || sem.GetLimit() != 1 {
+		t.Error("limit changes must be forbidden, got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/debug/semaphores", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("status 405 expected, got", w.Code)
+	}
+}
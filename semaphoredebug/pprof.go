@@ -0,0 +1,245 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoredebug
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// Names of the profiles of semaphores wrapped by Profiled.
+const (
+	HoldersProfile = "semaphore_holders"
+	WaitersProfile = "semaphore_waiters"
+)
+
+// maxStackDepth is the maximum number of frames recorded for an acquisition, as in runtime/pprof.
+const maxStackDepth = 32
+
+var waitersProfile = pprof.NewProfile(WaitersProfile)
+
+// holders are the outstanding acquisitions of all the profiled semaphores.
+var holders = struct {
+	mu sync.Mutex
+	m  map[*profiledHolding]struct{}
+}{m: make(map[*profiledHolding]struct{})}
+
+// Profiled returns a Semaphore recording its permit holders and waiters in profiles:
+// HoldersProfile has the stack of every outstanding acquisition weighted by its acquired permits,
+// WaitersProfile has the stack of every goroutine blocked in Acquire.
+// WaitersProfile is served by net/http/pprof like the built-in profiles,
+// HoldersProfile is written by WriteHoldersProfile and served by HoldersHandler, e.g.
+//
+//	http.Handle("/debug/pprof/semaphore_holders", semaphoredebug.HoldersHandler())
+//
+//	go tool pprof http://localhost:6060/debug/pprof/semaphore_holders
+//	go tool pprof http://localhost:6060/debug/pprof/semaphore_waiters
+//
+// Release(n) doesn't tell which acquisition it ends, so it removes the latest permits
+// acquired by the calling goroutine first and then the oldest ones of other goroutines.
+// Bookkeeping costs a goroutine stack walk per call, like the Detector.
+func Profiled(sem semaphore.Semaphore) semaphore.Semaphore {
+	return &profiledSemaphore{
+		Semaphore: sem,
+	}
+}
+
+type profiledSemaphore struct {
+	semaphore.Semaphore
+
+	// holdings in acquisition order
+	mu       sync.Mutex
+	holdings []*profiledHolding
+}
+
+// profiledHolding is an acquisition of n entries, n is changed under holders.mu.
+type profiledHolding struct {
+	goroutine int64
+	n         int
+	stack     []uintptr
+}
+
+// waiter is a key of the waiters profile, it isn't zero-sized so that pointers to waiters are distinct.
+type waiter struct {
+	_ byte
+}
+
+func (s *profiledSemaphore) Acquire(ctx context.Context, n int) error {
+	if ctx != nil && ctx.Err() != nil {
+		// like the wrapped semaphore, don't acquire with a done context
+		return ctx.Err()
+	}
+	if s.Semaphore.TryAcquire(n) {
+		s.hold(n)
+		return nil
+	}
+
+	// skip counts frames from Add itself, the stack starts at the caller of Acquire
+	w := new(waiter)
+	waitersProfile.Add(w, 2)
+	err := s.Semaphore.Acquire(ctx, n)
+	waitersProfile.Remove(w)
+	if err != nil {
+		return err
+	}
+	s.hold(n)
+	return nil
+}
+
+func (s *profiledSemaphore) TryAcquire(n int) bool {
+	if !s.Semaphore.TryAcquire(n) {
+		return false
+	}
+	s.hold(n)
+	return true
+}
+
+func (s *profiledSemaphore) Release(n int) int {
+	count := s.Semaphore.Release(n)
+	s.release(n)
+	return count
+}
+
+// hold records the acquisition with the stack of the caller of Acquire or TryAcquire.
+func (s *profiledSemaphore) hold(n int) {
+	h := &profiledHolding{
+		goroutine: goroutineID(),
+		n:         n,
+	}
+	// skip Callers, hold and Acquire
+	var stack [maxStackDepth]uintptr
+	h.stack = append([]uintptr(nil), stack[:runtime.Callers(3, stack[:])]...)
+
+	holders.mu.Lock()
+	holders.m[h] = struct{}{}
+	holders.mu.Unlock()
+	s.mu.Lock()
+	s.holdings = append(s.holdings, h)
+	s.mu.Unlock()
+}
+
+// release removes n permits from the profile, of the calling goroutine first.
+func (s *profiledSemaphore) release(n int) {
+	id := goroutineID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	holders.mu.Lock()
+	defer holders.mu.Unlock()
+
+	for i := len(s.holdings) - 1; i >= 0 && n > 0; i-- {
+		if h := s.holdings[i]; h.goroutine == id {
+			n -= releaseHolding(h, n)
+		}
+	}
+	for _, h := range s.holdings {
+		if n == 0 {
+			break
+		}
+		n -= releaseHolding(h, n)
+	}
+
+	holdings := s.holdings[:0]
+	for _, h := range s.holdings {
+		if h.n > 0 {
+			holdings = append(holdings, h)
+		}
+	}
+	for i := len(holdings); i < len(s.holdings); i++ {
+		s.holdings[i] = nil
+	}
+	s.holdings = holdings
+}
+
+// releaseHolding releases up to n entries of h and returns how many were released,
+// h is removed from the profile when all its entries are released. Must be called under holders.mu.
+func releaseHolding(h *profiledHolding, n int) int {
+	if n > h.n {
+		n = h.n
+	}
+	h.n -= n
+	if h.n == 0 {
+		delete(holders.m, h)
+	}
+	return n
+}
+
+// WriteHoldersProfile writes HoldersProfile to w in the text format of runtime/pprof profiles read by go tool pprof:
+// a line per stack with the number of permits held by acquisitions from it, the largest first.
+// If debug > 0, the stacks are symbolized in comments like the ones written by pprof.Profile.WriteTo with debug = 1.
+func WriteHoldersProfile(w io.Writer, debug int) error {
+	type record struct {
+		n     int
+		stack []uintptr
+	}
+	var (
+		records []*record
+		total   int
+	)
+	byStack := make(map[string]*record)
+	holders.mu.Lock()
+	for h := range holders.m {
+		key := fmt.Sprint(h.stack)
+		r := byStack[key]
+		if r == nil {
+			r = &record{stack: h.stack}
+			byStack[key] = r
+			records = append(records, r)
+		}
+		r.n += h.n
+		total += h.n
+	}
+	holders.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].n > records[j].n
+	})
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%s profile: total %d\n", HoldersProfile, total)
+	for _, r := range records {
+		fmt.Fprintf(b, "%d @", r.n)
+		for _, pc := range r.stack {
+			fmt.Fprintf(b, " %#x", pc)
+		}
+		fmt.Fprintln(b)
+		if debug > 0 {
+			frames := runtime.CallersFrames(r.stack)
+			for {
+				frame, more := frames.Next()
+				fmt.Fprintf(b, "#\t%#x\t%s+%#x\t%s:%d\n", frame.PC, frame.Function, frame.PC-frame.Entry, frame.File, frame.Line)
+				if !more {
+					break
+				}
+			}
+			fmt.Fprintln(b)
+		}
+	}
+	return b.Flush()
+}
+
+// HoldersHandler serves HoldersProfile like net/http/pprof serves the built-in profiles,
+// the "debug" query parameter is passed to WriteHoldersProfile.
+func HoldersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+HoldersProfile+`"`)
+		}
+		WriteHoldersProfile(w, debug)
+	})
+}
@@ -0,0 +1,203 @@
+package semaphoredebug
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/semaphoretest"
+)
+
+func profileText(t *testing.T, name string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func holdersText(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteHoldersProfile(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// heldPermits returns the number of acquisitions and permits in the holders profile.
+func heldPermits() (acquisitions, permits int) {
+	holders.mu.Lock()
+	defer holders.mu.Unlock()
+	for h := range holders.m {
+		permits += h.n
+	}
+	return len(holders.m), permits
+}
+
+func checkHeldPermits(t *testing.T, acquisitions0, permits0, expectedAcquisitions, expectedPermits int) {
+	t.Helper()
+	acquisitions, permits := heldPermits()
+	if acquisitions-acquisitions0 != expectedAcquisitions || permits-permits0 != expectedPermits {
+		t.Fatal(expectedAcquisitions, "acquisitions of", expectedPermits, "permits expected in the profile, got",
+			acquisitions-acquisitions0, "of", permits-permits0)
+	}
+}
+
+func acquireInHolder(sem semaphore.Semaphore, n int) {
+	sem.Acquire(nil, n)
+}
+
+func tryAcquireInHolder(sem semaphore.Semaphore, n int) {
+	sem.TryAcquire(n)
+}
+
+func acquireInWaiter(sem semaphore.Semaphore, n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return sem.Acquire(ctx, n)
+}
+
+func TestProfiled_holders(t *testing.T) {
+	sem := Profiled(semaphore.New(10))
+	acquisitions, permits := heldPermits()
+
+	acquireInHolder(sem, 3)
+	tryAcquireInHolder(sem, 2)
+	checkHeldPermits(t, acquisitions, permits, 2, 5)
+	text := holdersText(t)
+	if !strings.Contains(text, "semaphoredebug.acquireInHolder") || !strings.Contains(text, "semaphoredebug.tryAcquireInHolder") {
+		t.Error("stacks of the holders expected, got", text)
+	}
+	if strings.Contains(text, "profiledSemaphore") {
+		t.Error("stacks must start at the caller of Acquire, got", text)
+	}
+
+	// latest permits of the goroutine are released first
+	sem.Release(3)
+	checkHeldPermits(t, acquisitions, permits, 1, 2)
+	if text = holdersText(t); !strings.Contains(text, "semaphoredebug.acquireInHolder") || strings.Contains(text, "tryAcquireInHolder") {
+		t.Error("permits of tryAcquireInHolder must be released first, got", text)
+	}
+	sem.Release(2)
+	checkHeldPermits(t, acquisitions, permits, 0, 0)
+}
+
+func TestProfiled_holders_large_weight(t *testing.T) {
+	sem := Profiled(semaphore.New(1 << 20))
+	acquisitions, permits := heldPermits()
+
+	// an acquisition is recorded once with its weight, e.g. of a semaphore counting bytes
+	acquireInHolder(sem, 1<<16)
+	acquireInHolder(sem, 3)
+	checkHeldPermits(t, acquisitions, permits, 2, 1<<16+3)
+
+	sem.Release(3)
+	sem.Release(1<<16 - 5)
+	checkHeldPermits(t, acquisitions, permits, 1, 5)
+	sem.Release(5)
+	checkHeldPermits(t, acquisitions, permits, 0, 0)
+}
+
+func TestWriteHoldersProfile(t *testing.T) {
+	sem := Profiled(semaphore.New(1 << 20))
+	// acquisitions from the same stack are summed up
+	for _, n := range []int{1 << 16, 3} {
+		acquireInHolder(sem, n)
+	}
+	defer sem.Release(1<<16 + 3)
+
+	var buf bytes.Buffer
+	if err := WriteHoldersProfile(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	if !strings.HasPrefix(text, HoldersProfile+" profile: total ") {
+		t.Error("profile header expected, got", text)
+	}
+	if !strings.Contains(text, "\n65539 @ 0x") {
+		t.Error("stack weighted by 65539 permits expected, got", text)
+	}
+	if strings.Contains(text, "#") {
+		t.Error("no symbols expected with debug = 0, got", text)
+	}
+
+	rec := httptest.NewRecorder()
+	HoldersHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/semaphore_holders?debug=1", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "\n65539 @ 0x") || !strings.Contains(body, "semaphoredebug.acquireInHolder") {
+		t.Error("symbolized profile expected, got", body)
+	}
+}
+
+func TestProfiled_release_by_other_goroutine(t *testing.T) {
+	sem := Profiled(semaphore.New(10))
+	acquisitions, permits := heldPermits()
+
+	acquireInHolder(sem, 1)
+	done := make(chan struct{})
+	go func() {
+		tryAcquireInHolder(sem, 1)
+		close(done)
+	}()
+	<-done
+
+	// the oldest permit of another goroutine is released
+	sem.Release(1)
+	if text := holdersText(t); strings.Contains(text, "semaphoredebug.acquireInHolder") || !strings.Contains(text, "semaphoredebug.tryAcquireInHolder") {
+		t.Error("permit of acquireInHolder must be released, got", text)
+	}
+	sem.Release(1)
+	checkHeldPermits(t, acquisitions, permits, 0, 0)
+}
+
+func TestProfiled_waiters(t *testing.T) {
+	sem := Profiled(semaphore.New(1))
+	count := waitersProfile.Count()
+	sem.Acquire(nil, 1)
+
+	done := make(chan error)
+	go func() {
+		done <- acquireInWaiter(sem, 1)
+	}()
+	for waitersProfile.Count()-count == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if text := profileText(t, WaitersProfile); !strings.Contains(text, "semaphoredebug.acquireInWaiter") || strings.Contains(text, "profiledSemaphore") {
+		t.Error("stack of the waiter from the caller of Acquire expected, got", text)
+	}
+
+	sem.Release(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c := waitersProfile.Count() - count; c != 0 {
+		t.Error("no waiters expected, got", c)
+	}
+	sem.Release(1)
+
+	// a done context neither waits nor acquires
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sem.Acquire(ctx, 1); err != context.Canceled || sem.GetCount() != 0 {
+		t.Error("context.Canceled expected, got", err)
+	}
+}
+
+func TestProfiled_conformance(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return Profiled(semaphore.New(limit))
+	})
+	holders.mu.Lock()
+	defer holders.mu.Unlock()
+	for h := range holders.m {
+		if h.n <= 0 {
+			t.Error("released acquisitions must be removed, got", h.n, "permits")
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoredist
+
+import (
+	"context"
+	"time"
+)
+
+// Backend is a shared storage of the distributed semaphore state.
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	// Load returns the state record stored under key and its version.
+	// A missing record is reported as nil data and zero version.
+	Load(ctx context.Context, key string) (data []byte, version uint64, err error)
+
+	// CompareAndSwap stores data under key only if the stored version still equals version
+	// and reports whether the record was replaced.
+	// Every successful swap must notify the watchers of key.
+	CompareAndSwap(ctx context.Context, key string, version uint64, data []byte) (bool, error)
+
+	// KeepAlive grants a lease with the given id or renews it for ttl more.
+	KeepAlive(ctx context.Context, lease string, ttl time.Duration) error
+
+	// Alive reports for each of the passed leases whether it is still valid.
+	Alive(ctx context.Context, leases []string) ([]bool, error)
+
+	// Revoke drops the lease immediately.
+	Revoke(ctx context.Context, lease string) error
+
+	// Watch returns a channel that is closed on the next change of the record stored under key.
+	Watch(ctx context.Context, key string) (<-chan struct{}, error)
+}
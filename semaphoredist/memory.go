@@ -0,0 +1,108 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoredist
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is an in-process Backend, useful for tests and single-process deployments.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	records map[string]*memoryRecord
+	leases  map[string]time.Time
+}
+
+type memoryRecord struct {
+	data    []byte
+	version uint64
+
+	// closed on every change of the record
+	broadcastCh chan struct{}
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend creates an empty in-process backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		records: make(map[string]*memoryRecord),
+		leases:  make(map[string]time.Time),
+	}
+}
+
+// getRecord returns the record stored under key, creating an empty one if needed. b.mu must be held.
+func (b *MemoryBackend) getRecord(key string) *memoryRecord {
+	r, ok := b.records[key]
+	if !ok {
+		r = &memoryRecord{broadcastCh: make(chan struct{})}
+		b.records[key] = r
+	}
+	return r
+}
+
+func (b *MemoryBackend) Load(ctx context.Context, key string) ([]byte, uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.getRecord(key)
+	if r.data == nil {
+		return nil, r.version, nil
+	}
+	return append([]byte(nil), r.data...), r.version, nil
+}
+
+func (b *MemoryBackend) CompareAndSwap(ctx context.Context, key string, version uint64, data []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.getRecord(key)
+	if r.version != version {
+		return false, nil
+	}
+	r.data = append([]byte(nil), data...)
+	r.version++
+
+	// send broadcast signal
+	close(r.broadcastCh)
+	r.broadcastCh = make(chan struct{})
+	return true, nil
+}
+
+func (b *MemoryBackend) KeepAlive(ctx context.Context, lease string, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leases[lease] = time.Now().Add(ttl)
+	return nil
+}
+
+func (b *MemoryBackend) Alive(ctx context.Context, leases []string) ([]bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	alive := make([]bool, len(leases))
+	for i, lease := range leases {
+		expiry, ok := b.leases[lease]
+		if ok && now.After(expiry) {
+			delete(b.leases, lease)
+			ok = false
+		}
+		alive[i] = ok
+	}
+	return alive, nil
+}
+
+func (b *MemoryBackend) Revoke(ctx context.Context, lease string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.leases, lease)
+	return nil
+}
+
+func (b *MemoryBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.getRecord(key).broadcastCh, nil
+}
@@ -0,0 +1,461 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoredist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisOption configures a RedisBackend.
+type RedisOption func(*RedisBackend)
+
+// WithRedisPrefix sets a prefix for all keys and channels used by the backend.
+func WithRedisPrefix(prefix string) RedisOption {
+	return func(b *RedisBackend) {
+		b.prefix = prefix
+	}
+}
+
+// WithRedisPassword makes the backend authenticate every new connection with AUTH.
+func WithRedisPassword(password string) RedisOption {
+	return func(b *RedisBackend) {
+		b.password = password
+	}
+}
+
+// RedisBackend is a Backend speaking the Redis protocol (RESP) to a Redis compatible server.
+//
+// A state record is stored as a string value prefixed by its version.
+// Compare-and-swap is a WATCH/MULTI/EXEC transaction that also PUBLISHes a notification for watchers.
+// Leases are keys with expiration.
+type RedisBackend struct {
+	addr     string
+	prefix   string
+	password string
+
+	// mu guards conn and serializes commands on it
+	mu   sync.Mutex
+	conn *redisConn
+
+	// subMu guards the subscription connection and the channels
+	subMu    sync.Mutex
+	sub      *redisConn
+	channels map[string]*redisChannel
+}
+
+type redisChannel struct {
+	// closed when SUBSCRIBE is confirmed
+	subscribed   chan struct{}
+	isSubscribed bool
+
+	// closed on every message
+	broadcastCh chan struct{}
+}
+
+var _ Backend = (*RedisBackend)(nil)
+
+// NewRedisBackend creates a backend for the server at addr. Connections are established lazily.
+func NewRedisBackend(addr string, opts ...RedisOption) *RedisBackend {
+	b := &RedisBackend{
+		addr:     addr,
+		channels: make(map[string]*redisChannel),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Close closes connections to the server.
+func (b *RedisBackend) Close() error {
+	b.mu.Lock()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	b.mu.Unlock()
+
+	b.subMu.Lock()
+	sub := b.sub
+	b.subMu.Unlock()
+	if sub != nil {
+		// reader goroutine will drop the subscription state
+		sub.Close()
+	}
+	return nil
+}
+
+func (b *RedisBackend) recordKey(key string) string {
+	return b.prefix + key
+}
+
+func (b *RedisBackend) leaseKey(lease string) string {
+	return b.prefix + "lease:" + lease
+}
+
+func (b *RedisBackend) channel(key string) string {
+	return b.prefix + "notify:" + key
+}
+
+func (b *RedisBackend) dial(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newRedisConn(c)
+	if b.password != "" {
+		if _, err := conn.do(ctx, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// withConn runs f on the command connection. The connection is dropped on any I/O error.
+func (b *RedisBackend) withConn(ctx context.Context, f func(c *redisConn) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		conn, err := b.dial(ctx)
+		if err != nil {
+			return err
+		}
+		b.conn = conn
+	}
+	err := f(b.conn)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *RedisBackend) Load(ctx context.Context, key string) ([]byte, uint64, error) {
+	var (
+		data    []byte
+		version uint64
+	)
+	err := b.withConn(ctx, func(c *redisConn) error {
+		reply, err := c.do(ctx, "GET", b.recordKey(key))
+		if err != nil {
+			return err
+		}
+		data, version, err = parseVersioned(reply)
+		return err
+	})
+	return data, version, err
+}
+
+func (b *RedisBackend) CompareAndSwap(ctx context.Context, key string, version uint64, data []byte) (bool, error) {
+	swapped := false
+	err := b.withConn(ctx, func(c *redisConn) error {
+		recordKey := b.recordKey(key)
+		if _, err := c.do(ctx, "WATCH", recordKey); err != nil {
+			return err
+		}
+		reply, err := c.do(ctx, "GET", recordKey)
+		if err != nil {
+			return err
+		}
+		_, current, err := parseVersioned(reply)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			_, err = c.do(ctx, "UNWATCH")
+			return err
+		}
+
+		value := strconv.FormatUint(version+1, 10) + " " + string(data)
+		replies, err := c.pipeline(ctx,
+			[]string{"MULTI"},
+			[]string{"SET", recordKey, value},
+			[]string{"PUBLISH", b.channel(key), value},
+			[]string{"EXEC"},
+		)
+		if err != nil {
+			return err
+		}
+		// EXEC returns null if the watched key was changed
+		swapped = replies[3] != nil
+		return nil
+	})
+	return swapped, err
+}
+
+func (b *RedisBackend) KeepAlive(ctx context.Context, lease string, ttl time.Duration) error {
+	return b.withConn(ctx, func(c *redisConn) error {
+		ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+		_, err := c.do(ctx, "SET", b.leaseKey(lease), "1", "PX", ms)
+		return err
+	})
+}
+
+func (b *RedisBackend) Alive(ctx context.Context, leases []string) ([]bool, error) {
+	alive := make([]bool, len(leases))
+	if len(leases) == 0 {
+		return alive, nil
+	}
+	err := b.withConn(ctx, func(c *redisConn) error {
+		args := make([]string, 0, len(leases)+1)
+		args = append(args, "MGET")
+		for _, lease := range leases {
+			args = append(args, b.leaseKey(lease))
+		}
+		reply, err := c.do(ctx, args...)
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != len(leases) {
+			return fmt.Errorf("semaphoredist: unexpected MGET reply %v", reply)
+		}
+		for i, v := range values {
+			alive[i] = v != nil
+		}
+		return nil
+	})
+	return alive, err
+}
+
+func (b *RedisBackend) Revoke(ctx context.Context, lease string) error {
+	return b.withConn(ctx, func(c *redisConn) error {
+		_, err := c.do(ctx, "DEL", b.leaseKey(lease))
+		return err
+	})
+}
+
+func (b *RedisBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	name := b.channel(key)
+
+	b.subMu.Lock()
+	if b.sub == nil {
+		sub, err := b.dial(ctx)
+		if err != nil {
+			b.subMu.Unlock()
+			return nil, err
+		}
+		b.sub = sub
+		go b.readSubscription(sub)
+	}
+	ch, ok := b.channels[name]
+	if !ok {
+		ch = &redisChannel{
+			subscribed:  make(chan struct{}),
+			broadcastCh: make(chan struct{}),
+		}
+		b.channels[name] = ch
+		b.sub.send("SUBSCRIBE", name)
+		if err := b.sub.w.Flush(); err != nil {
+			// reader goroutine will fail too and wake up the watchers
+			b.sub.Close()
+		}
+	}
+	subscribed, broadcastCh := ch.subscribed, ch.broadcastCh
+	b.subMu.Unlock()
+
+	// wait for the subscription, otherwise a notification may be missed
+	select {
+	case <-subscribed:
+		return broadcastCh, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readSubscription dispatches messages of the subscription connection until it fails.
+func (b *RedisBackend) readSubscription(sub *redisConn) {
+	for {
+		reply, err := sub.read()
+		if err != nil {
+			break
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) < 2 {
+			continue
+		}
+		kind, _ := msg[0].([]byte)
+		name, _ := msg[1].([]byte)
+
+		b.subMu.Lock()
+		if ch, ok := b.channels[string(name)]; ok {
+			switch string(kind) {
+			case "subscribe":
+				if !ch.isSubscribed {
+					ch.isSubscribed = true
+					close(ch.subscribed)
+				}
+			case "message":
+				close(ch.broadcastCh)
+				ch.broadcastCh = make(chan struct{})
+			}
+		}
+		b.subMu.Unlock()
+	}
+
+	// wake up all watchers, they will recheck the state and subscribe again
+	sub.Close()
+	b.subMu.Lock()
+	if b.sub == sub {
+		b.sub = nil
+	}
+	for _, ch := range b.channels {
+		if !ch.isSubscribed {
+			close(ch.subscribed)
+		}
+		close(ch.broadcastCh)
+	}
+	b.channels = make(map[string]*redisChannel)
+	b.subMu.Unlock()
+}
+
+// parseVersioned parses the "<version> <data>" record value.
+func parseVersioned(reply interface{}) ([]byte, uint64, error) {
+	if reply == nil {
+		return nil, 0, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, 0, fmt.Errorf("semaphoredist: unexpected record value %v", reply)
+	}
+	i := bytes.IndexByte(value, ' ')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("semaphoredist: malformed record value %q", value)
+	}
+	version, err := strconv.ParseUint(string(value[:i]), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("semaphoredist: malformed record version: %v", err)
+	}
+	return value[i+1:], version, nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "semaphoredist: redis: " + string(e)
+}
+
+// redisConn is a minimal RESP connection.
+// Replies are decoded as string (simple string), []byte (bulk string), int64, []interface{} or nil.
+type redisConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRedisConn(c net.Conn) *redisConn {
+	return &redisConn{
+		c: c,
+		r: bufio.NewReader(c),
+		w: bufio.NewWriter(c),
+	}
+}
+
+func (c *redisConn) Close() error {
+	return c.c.Close()
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends the commands at once and reads all their replies.
+// The first error reply is returned as redisError after all replies are read.
+func (c *redisConn) pipeline(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	if err := c.c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for _, args := range cmds {
+		c.send(args...)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var replyErr error
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := c.read()
+		if err != nil {
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// send buffers the command, it's written to the connection on flush.
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("semaphoredist: malformed reply %q", line)
+	}
+	kind, payload := line[0], string(line[1:len(line)-2])
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("semaphoredist: unknown reply type %q", kind)
+}
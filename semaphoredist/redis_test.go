@@ -0,0 +1,314 @@
+package semaphoredist
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a local stand-in for a Redis server implementing only the commands used by RedisBackend.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	values   map[string]fakeValue
+	versions map[string]uint64
+	subs     map[string]map[*fakeClient]bool
+}
+
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+type fakeClient struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	w    *bufio.Writer
+
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:       ln,
+		values:   make(map[string]fakeValue),
+		versions: make(map[string]uint64),
+		subs:     make(map[string]map[*fakeClient]bool),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeClient{conn: conn, w: bufio.NewWriter(conn)}
+	defer s.unsubscribe(c)
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		c.write(s.handle(c, args))
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// fakeStatus and fakeError are simple string and error replies, everything else is encoded by type.
+type fakeStatus string
+type fakeError string
+
+func (c *fakeClient) write(reply interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	encodeReply(c.w, reply)
+	c.w.Flush()
+}
+
+func encodeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case fakeError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			encodeReply(w, item)
+		}
+	case nil:
+		fmt.Fprintf(w, "$-1\r\n")
+	case nullArray:
+		fmt.Fprintf(w, "*-1\r\n")
+	}
+}
+
+type nullArray struct{}
+
+func (s *fakeRedis) handle(c *fakeClient, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	if c.multi && cmd != "EXEC" && cmd != "DISCARD" {
+		c.queued = append(c.queued, args)
+		return fakeStatus("QUEUED")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "WATCH":
+		if c.watched == nil {
+			c.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			s.expire(key)
+			c.watched[key] = s.versions[key]
+		}
+		return fakeStatus("OK")
+	case "UNWATCH":
+		c.watched = nil
+		return fakeStatus("OK")
+	case "MULTI":
+		c.multi = true
+		return fakeStatus("OK")
+	case "DISCARD":
+		c.multi, c.queued, c.watched = false, nil, nil
+		return fakeStatus("OK")
+	case "EXEC":
+		queued, watched := c.queued, c.watched
+		c.multi, c.queued, c.watched = false, nil, nil
+		for key, version := range watched {
+			s.expire(key)
+			if s.versions[key] != version {
+				return nullArray{}
+			}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, args := range queued {
+			replies[i] = s.exec(c, args)
+		}
+		return replies
+	}
+	return s.exec(c, args)
+}
+
+// exec executes a single data command. s.mu must be held.
+func (s *fakeRedis) exec(c *fakeClient, args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return fakeStatus("PONG")
+	case "AUTH":
+		return fakeStatus("OK")
+	case "GET":
+		s.expire(args[1])
+		if v, ok := s.values[args[1]]; ok {
+			return v.value
+		}
+		return nil
+	case "MGET":
+		replies := make([]interface{}, len(args)-1)
+		for i, key := range args[1:] {
+			s.expire(key)
+			if v, ok := s.values[key]; ok {
+				replies[i] = v.value
+			}
+		}
+		return replies
+	case "SET":
+		v := fakeValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.values[args[1]] = v
+		s.versions[args[1]]++
+		return fakeStatus("OK")
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				delete(s.values, key)
+				s.versions[key]++
+				deleted++
+			}
+		}
+		return deleted
+	case "PUBLISH":
+		for sub := range s.subs[args[1]] {
+			go sub.write([]interface{}{"message", args[1], args[2]})
+		}
+		return len(s.subs[args[1]])
+	case "SUBSCRIBE":
+		for _, name := range args[1:] {
+			if s.subs[name] == nil {
+				s.subs[name] = make(map[*fakeClient]bool)
+			}
+			s.subs[name][c] = true
+		}
+		return []interface{}{"subscribe", args[1], len(args) - 1}
+	}
+	return fakeError("ERR unknown command '" + args[0] + "'")
+}
+
+// expire drops the key if its TTL has passed. s.mu must be held.
+func (s *fakeRedis) expire(key string) {
+	v, ok := s.values[key]
+	if ok && !v.expires.IsZero() && time.Now().After(v.expires) {
+		delete(s.values, key)
+		s.versions[key]++
+	}
+}
+
+func (s *fakeRedis) unsubscribe(c *fakeClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, subs := range s.subs {
+		delete(subs, c)
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	server := startFakeRedis(t)
+	defer server.Close()
+
+	testBackend(t, func() Backend {
+		return NewRedisBackend(server.Addr(), WithRedisPrefix(t.Name()+":"))
+	})
+}
+
+func TestRedisBackend_server_restart(t *testing.T) {
+	server := startFakeRedis(t)
+	backend := NewRedisBackend(server.Addr())
+	defer backend.Close()
+
+	ctx := context.Background()
+	if _, _, err := backend.Load(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	watchCh, err := backend.Watch(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connections are dropped, watchers must be woken up
+	server.Close()
+	backend.mu.Lock()
+	backend.conn.Close()
+	backend.mu.Unlock()
+	backend.subMu.Lock()
+	backend.sub.Close()
+	backend.subMu.Unlock()
+
+	select {
+	case <-watchCh:
+	case <-time.After(time.Second):
+		t.Fatal("watcher is not woken up after connection loss")
+	}
+	if _, _, err := backend.Load(ctx, "k"); err == nil {
+		t.Error("error expected while the server is down")
+	}
+}
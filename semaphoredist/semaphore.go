@@ -0,0 +1,466 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoredist provides a cluster-wide counting semaphore with the same ergonomics as
+// semaphore.Semaphore. The semaphore state (limit and holders) is kept in a single record of a pluggable
+// Backend and changed with compare-and-swap. Every process holds its permits under a lease that is renewed
+// in background, so permits of a crashed process are dropped when its lease expires.
+package semaphoredist // import "github.com/marusama/semaphore/v2/semaphoredist"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+const (
+	defaultLeaseTTL     = 10 * time.Second
+	defaultPollInterval = time.Second
+	defaultTimeout      = 5 * time.Second
+)
+
+// Option configures a distributed Semaphore.
+type Option func(*options)
+
+type options struct {
+	leaseTTL     time.Duration
+	pollInterval time.Duration
+	timeout      time.Duration
+	onError      func(error)
+}
+
+// WithLeaseTTL sets how long the permits of this process survive without lease renewal.
+// The lease is renewed every ttl/3.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.leaseTTL = ttl
+	}
+}
+
+// WithPollInterval sets how often a blocked Acquire rechecks the state without a watch notification,
+// e.g. to notice holders whose lease has expired.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// WithTimeout sets the timeout of a single backend operation.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithErrorHandler sets a callback for backend errors that cannot be returned to the caller,
+// e.g. from TryAcquire, Release, SetLimit or lease renewal.
+func WithErrorHandler(f func(error)) Option {
+	return func(o *options) {
+		o.onError = f
+	}
+}
+
+// record is the state of a distributed semaphore stored in the backend.
+type record struct {
+	Limit   int            `json:"limit"`
+	Holders map[string]int `json:"holders,omitempty"`
+}
+
+func (r *record) count() int {
+	count := 0
+	for _, n := range r.Holders {
+		count += n
+	}
+	return count
+}
+
+func decodeRecord(data []byte) (record, error) {
+	var r record
+	if len(data) == 0 {
+		return r, nil
+	}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Semaphore is a distributed counting resizable semaphore, it implements semaphore.Semaphore.
+// Limit and count are shared by all Semaphore instances created with the same backend and key.
+type Semaphore struct {
+	backend Backend
+	key     string
+	lease   string
+	opts    options
+
+	// held is the number of entries held by this instance
+	mu   sync.Mutex
+	held int
+
+	// last observed limit and count, reported when the backend is unreachable
+	limit int64
+	count int64
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+var _ semaphore.Semaphore = (*Semaphore)(nil)
+
+// New creates a distributed semaphore stored under key in the backend and starts its lease renewal.
+// If there is no record under key yet, it is created with the passed limit,
+// otherwise the limit already shared by the cluster is kept.
+func New(ctx context.Context, backend Backend, key string, limit int, opts ...Option) (*Semaphore, error) {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	o := options{
+		leaseTTL:     defaultLeaseTTL,
+		pollInterval: defaultPollInterval,
+		timeout:      defaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lease, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	s := &Semaphore{
+		backend: backend,
+		key:     key,
+		lease:   lease,
+		opts:    o,
+		closeCh: make(chan struct{}),
+	}
+	if err := backend.KeepAlive(ctx, lease, o.leaseTTL); err != nil {
+		return nil, err
+	}
+	for {
+		data, version, err := backend.Load(ctx, key)
+		if err != nil {
+			// the lease is already registered, don't leave it alive until its TTL
+			backend.Revoke(ctx, lease)
+			return nil, err
+		}
+		if data != nil {
+			break
+		}
+		data, _ = json.Marshal(record{Limit: limit})
+		ok, err := backend.CompareAndSwap(ctx, key, version, data)
+		if err != nil {
+			backend.Revoke(ctx, lease)
+			return nil, err
+		}
+		if ok {
+			break
+		}
+	}
+
+	s.wg.Add(1)
+	go s.keepAlive()
+	return s, nil
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Close stops the lease renewal, returns the entries held by this instance and revokes its lease.
+// The Semaphore must not be used after Close.
+func (s *Semaphore) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.wg.Wait()
+
+		_, _, err = s.update(ctx, func(r *record) bool {
+			if _, ok := r.Holders[s.lease]; !ok {
+				return false
+			}
+			delete(r.Holders, s.lease)
+			return true
+		})
+		if revokeErr := s.backend.Revoke(ctx, s.lease); err == nil {
+			err = revokeErr
+		}
+	})
+	return err
+}
+
+func (s *Semaphore) keepAlive() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.leaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			ctx, cancel := s.opContext()
+			err := s.backend.KeepAlive(ctx, s.lease, s.opts.leaseTTL)
+			cancel()
+			if err != nil {
+				s.handleError(err)
+			}
+		}
+	}
+}
+
+func (s *Semaphore) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.opts.timeout)
+}
+
+func (s *Semaphore) handleError(err error) {
+	if s.opts.onError != nil {
+		s.opts.onError(err)
+	}
+}
+
+// update applies fn to the current state record and stores the result with compare-and-swap,
+// retrying on concurrent modification. Holders with expired leases are dropped from the record.
+// fn may be called several times and reports whether it changed the record.
+func (s *Semaphore) update(ctx context.Context, fn func(r *record) bool) (record, bool, error) {
+	for {
+		data, version, err := s.backend.Load(ctx, s.key)
+		if err != nil {
+			return record{}, false, err
+		}
+		r, err := decodeRecord(data)
+		if err != nil {
+			return record{}, false, err
+		}
+		pruned, err := s.prune(ctx, &r)
+		if err != nil {
+			return record{}, false, err
+		}
+		changed := fn(&r)
+		if !changed && !pruned {
+			s.observe(&r)
+			return r, false, nil
+		}
+
+		data, err = json.Marshal(r)
+		if err != nil {
+			return record{}, false, err
+		}
+		ok, err := s.backend.CompareAndSwap(ctx, s.key, version, data)
+		if err != nil {
+			return record{}, false, err
+		}
+		if ok {
+			s.observe(&r)
+			return r, changed, nil
+		}
+	}
+}
+
+// prune drops holders with expired leases and reports whether any were dropped.
+func (s *Semaphore) prune(ctx context.Context, r *record) (bool, error) {
+	if len(r.Holders) == 0 {
+		return false, nil
+	}
+	leases := make([]string, 0, len(r.Holders))
+	for lease := range r.Holders {
+		leases = append(leases, lease)
+	}
+	alive, err := s.backend.Alive(ctx, leases)
+	if err != nil {
+		return false, err
+	}
+	pruned := false
+	for i, lease := range leases {
+		if !alive[i] {
+			delete(r.Holders, lease)
+			pruned = true
+		}
+	}
+	return pruned, nil
+}
+
+func (s *Semaphore) observe(r *record) {
+	atomic.StoreInt64(&s.limit, int64(r.Limit))
+	atomic.StoreInt64(&s.count, int64(r.count()))
+}
+
+func (s *Semaphore) tryAcquire(n int) (bool, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+
+	_, acquired, err := s.update(ctx, func(r *record) bool {
+		if r.count()+n > r.Limit {
+			return false
+		}
+		if r.Holders == nil {
+			r.Holders = make(map[string]int)
+		}
+		r.Holders[s.lease] += n
+		return true
+	})
+	if acquired {
+		s.mu.Lock()
+		s.held += n
+		s.mu.Unlock()
+	}
+	return acquired, err
+}
+
+// Acquire enters the semaphore a specified number of times, blocking only until ctx is done.
+// Only the waiting is cancelled by ctx, a started backend operation is bounded by the timeout option.
+func (s *Semaphore) Acquire(ctx context.Context, n int) error {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// subscribe before checking the state, so the change in between is not missed
+		watchCh, err := s.backend.Watch(ctx, s.key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.handleError(err)
+		}
+
+		acquired, err := s.tryAcquire(n)
+		if err != nil {
+			s.handleError(err)
+		} else if acquired {
+			return nil
+		}
+
+		timer := time.NewTimer(s.opts.pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-watchCh:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// TryAcquire acquires the semaphore without blocking.
+// Backend errors are passed to the error handler and reported as failure.
+func (s *Semaphore) TryAcquire(n int) bool {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	acquired, err := s.tryAcquire(n)
+	if err != nil {
+		s.handleError(err)
+	}
+	return acquired
+}
+
+// Release exits the semaphore a specified number of times and returns the previous count.
+// Release retries on backend errors until the lease TTL passes, after that the entries
+// are considered dropped together with the expired lease.
+func (s *Semaphore) Release(n int) int {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	s.mu.Lock()
+	if s.held < n {
+		s.mu.Unlock()
+		panic("semaphore release without acquire")
+	}
+	s.held -= n
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(s.opts.leaseTTL)
+	for {
+		var prevCount int
+		ctx, cancel := s.opContext()
+		_, _, err := s.update(ctx, func(r *record) bool {
+			prevCount = r.count()
+			held, ok := r.Holders[s.lease]
+			if !ok {
+				// lease has already expired and holdings are dropped
+				return false
+			}
+			if held > n {
+				r.Holders[s.lease] = held - n
+			} else {
+				delete(r.Holders, s.lease)
+			}
+			return true
+		})
+		cancel()
+		if err == nil {
+			return prevCount
+		}
+		s.handleError(err)
+
+		if time.Now().After(deadline) {
+			return int(atomic.LoadInt64(&s.count))
+		}
+		select {
+		case <-s.closeCh:
+			return int(atomic.LoadInt64(&s.count))
+		case <-time.After(s.opts.pollInterval):
+		}
+	}
+}
+
+// SetLimit changes the limit shared by the cluster.
+// Backend errors are passed to the error handler.
+func (s *Semaphore) SetLimit(limit int) {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, _, err := s.update(ctx, func(r *record) bool {
+		if r.Limit == limit {
+			return false
+		}
+		r.Limit = limit
+		return true
+	})
+	if err != nil {
+		s.handleError(err)
+	}
+}
+
+// GetLimit returns current semaphore limit.
+// If the backend is unreachable the last observed limit is returned.
+func (s *Semaphore) GetLimit() int {
+	s.refresh()
+	return int(atomic.LoadInt64(&s.limit))
+}
+
+// GetCount returns current number of occupied entries in the whole cluster.
+// If the backend is unreachable the last observed count is returned.
+func (s *Semaphore) GetCount() int {
+	s.refresh()
+	return int(atomic.LoadInt64(&s.count))
+}
+
+func (s *Semaphore) refresh() {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, _, err := s.update(ctx, func(r *record) bool {
+		return false
+	})
+	if err != nil {
+		s.handleError(err)
+	}
+}
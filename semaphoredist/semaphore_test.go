@@ -0,0 +1,252 @@
+package semaphoredist
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/semaphoretest"
+)
+
+func newTestSemaphore(t *testing.T, backend Backend, key string, limit int, opts ...Option) *Semaphore {
+	opts = append([]Option{
+		WithLeaseTTL(300 * time.Millisecond),
+		WithPollInterval(50 * time.Millisecond),
+		WithErrorHandler(func(err error) { t.Error("backend error:", err) }),
+	}, opts...)
+	sem, err := New(context.Background(), backend, key, limit, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sem
+}
+
+func checkLimitAndCount(t *testing.T, sem *Semaphore, expectedLimit, expectedCount int) {
+	if limit := sem.GetLimit(); limit != expectedLimit {
+		t.Error("semaphore must have limit = ", expectedLimit, ", but has ", limit)
+	}
+	if count := sem.GetCount(); count != expectedCount {
+		t.Error("semaphore must have count = ", expectedCount, ", but has ", count)
+	}
+}
+
+// crash stops the lease renewal without returning the held entries.
+func crash(sem *Semaphore) {
+	sem.closeOnce.Do(func() {
+		close(sem.closeCh)
+		sem.wg.Wait()
+	})
+}
+
+func testBackend(t *testing.T, newBackend func() Backend) {
+	t.Run("shared limit", func(t *testing.T) {
+		backend := newBackend()
+		a := newTestSemaphore(t, backend, "shared", 2)
+		b := newTestSemaphore(t, backend, "shared", 100)
+		defer a.Close(context.Background())
+		defer b.Close(context.Background())
+
+		// limit of the existing record is kept
+		checkLimitAndCount(t, b, 2, 0)
+
+		if !a.TryAcquire(1) || !b.TryAcquire(1) {
+			t.Fatal("acquire under limit failed")
+		}
+		if a.TryAcquire(1) || b.TryAcquire(1) {
+			t.Error("acquire over limit succeeded")
+		}
+		checkLimitAndCount(t, a, 2, 2)
+
+		if prev := b.Release(1); prev != 2 {
+			t.Error("semaphore must have old count = ", 2, ", but has ", prev)
+		}
+		checkLimitAndCount(t, a, 2, 1)
+
+		b.SetLimit(3)
+		checkLimitAndCount(t, a, 3, 1)
+		if !a.TryAcquire(2) {
+			t.Error("acquire after SetLimit failed")
+		}
+		a.Release(3)
+		checkLimitAndCount(t, b, 3, 0)
+	})
+
+	t.Run("wake on release", func(t *testing.T) {
+		backend := newBackend()
+		a := newTestSemaphore(t, backend, "wake", 1, WithPollInterval(time.Hour))
+		b := newTestSemaphore(t, backend, "wake", 1, WithPollInterval(time.Hour))
+		defer a.Close(context.Background())
+		defer b.Close(context.Background())
+
+		if err := a.Acquire(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() {
+			done <- b.Acquire(context.Background(), 1)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		a.Release(1)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter is not woken up by release")
+		}
+		checkLimitAndCount(t, a, 1, 1)
+		b.Release(1)
+	})
+
+	t.Run("ctx done", func(t *testing.T) {
+		backend := newBackend()
+		a := newTestSemaphore(t, backend, "ctx", 1)
+		defer a.Close(context.Background())
+
+		if err := a.Acquire(nil, 1); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := a.Acquire(ctx, 1); err != context.DeadlineExceeded {
+			t.Error("context.DeadlineExceeded expected, got", err)
+		}
+		checkLimitAndCount(t, a, 1, 1)
+	})
+
+	t.Run("lease expiry", func(t *testing.T) {
+		backend := newBackend()
+		a := newTestSemaphore(t, backend, "lease", 2)
+		b := newTestSemaphore(t, backend, "lease", 2)
+		defer b.Close(context.Background())
+
+		if !a.TryAcquire(2) {
+			t.Fatal("acquire under limit failed")
+		}
+		crash(a)
+
+		start := time.Now()
+		if err := b.Acquire(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Error("entries of the crashed holder are dropped before lease expiry")
+		}
+		checkLimitAndCount(t, b, 2, 1)
+	})
+
+	t.Run("close returns entries", func(t *testing.T) {
+		backend := newBackend()
+		a := newTestSemaphore(t, backend, "close", 2)
+		b := newTestSemaphore(t, backend, "close", 2)
+		defer b.Close(context.Background())
+
+		if !a.TryAcquire(2) {
+			t.Fatal("acquire under limit failed")
+		}
+		if err := a.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		checkLimitAndCount(t, b, 2, 0)
+	})
+
+	t.Run("contention", func(t *testing.T) {
+		backend := newBackend()
+		const limit = 3
+		var inUse, maxInUse int32
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			sem := newTestSemaphore(t, backend, "contention", limit)
+			defer sem.Close(context.Background())
+			for j := 0; j < 3; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for k := 0; k < 10; k++ {
+						if err := sem.Acquire(context.Background(), 1); err != nil {
+							t.Error(err)
+							return
+						}
+						cur := atomic.AddInt32(&inUse, 1)
+						for {
+							max := atomic.LoadInt32(&maxInUse)
+							if cur <= max || atomic.CompareAndSwapInt32(&maxInUse, max, cur) {
+								break
+							}
+						}
+						time.Sleep(time.Millisecond)
+						atomic.AddInt32(&inUse, -1)
+						sem.Release(1)
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		if maxInUse > limit {
+			t.Error("limit exceeded: ", maxInUse, " > ", limit)
+		}
+	})
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, func() Backend {
+		return NewMemoryBackend()
+	})
+}
+
+// failingBackend fails loading the state record.
+type failingBackend struct {
+	*MemoryBackend
+}
+
+func (b failingBackend) Load(ctx context.Context, key string) ([]byte, uint64, error) {
+	return nil, 0, errors.New("load failed")
+}
+
+func TestNew_error_revokes_lease(t *testing.T) {
+	backend := failingBackend{NewMemoryBackend()}
+	if _, err := New(context.Background(), backend, "failing", 1); err == nil {
+		t.Fatal("error expected")
+	}
+	if len(backend.leases) != 0 {
+		t.Error("lease must be revoked, but", len(backend.leases), "leases are alive")
+	}
+}
+
+func TestSemaphore_Release_without_Acquire_panic_expected(t *testing.T) {
+	sem := newTestSemaphore(t, NewMemoryBackend(), "panic", 1)
+	defer sem.Close(context.Background())
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected")
+		}
+	}()
+	sem.Release(1)
+}
+
+func TestSemaphore_Acquire_zero_panic_expected(t *testing.T) {
+	sem := newTestSemaphore(t, NewMemoryBackend(), "panic", 1)
+	defer sem.Close(context.Background())
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected")
+		}
+	}()
+	sem.Acquire(nil, 0)
+}
+
+func TestMemoryBackend_conformance(t *testing.T) {
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		sem := newTestSemaphore(t, NewMemoryBackend(), "conformance", limit)
+		t.Cleanup(func() { sem.Close(context.Background()) })
+		return sem
+	})
+}
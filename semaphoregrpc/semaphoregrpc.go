@@ -0,0 +1,205 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoregrpc provides gRPC server and client interceptors limiting concurrency of calls with a Semaphore.
+// Unary calls hold permits while the call is handled, streams hold permits for the whole stream lifetime.
+// Calls that cannot acquire permits fail with codes.ResourceExhausted.
+package semaphoregrpc // import "github.com/marusama/semaphore/v2/semaphoregrpc"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Option configures the interceptors.
+type Option func(*options)
+
+type options struct {
+	weight     func(method string) int
+	semaphores map[string]semaphore.Semaphore
+	maxWait    time.Duration
+}
+
+// WithWeight sets a callback computing how many permits a call of the full method name needs.
+// Calls with non-positive weight are not limited. By default every call needs one permit.
+func WithWeight(weight func(method string) int) Option {
+	return func(o *options) {
+		o.weight = weight
+	}
+}
+
+// WithMethodSemaphore limits calls of the full method name (e.g. "/pkg.Service/Method")
+// with sem instead of the semaphore passed to the interceptor.
+func WithMethodSemaphore(method string, sem semaphore.Semaphore) Option {
+	return func(o *options) {
+		o.semaphores[method] = sem
+	}
+}
+
+// WithMaxWait makes calls wait for permits up to d (but not longer than the call context allows)
+// before they fail. By default calls fail immediately when the semaphore is full.
+func WithMaxWait(d time.Duration) Option {
+	return func(o *options) {
+		o.maxWait = d
+	}
+}
+
+type limiter struct {
+	sem  semaphore.Semaphore
+	opts options
+}
+
+func newLimiter(sem semaphore.Semaphore, opts []Option) *limiter {
+	o := options{
+		semaphores: make(map[string]semaphore.Semaphore),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &limiter{
+		sem:  sem,
+		opts: o,
+	}
+}
+
+// acquire acquires permits for the method and returns the function releasing them.
+func (l *limiter) acquire(ctx context.Context, method string) (func(), error) {
+	sem, ok := l.opts.semaphores[method]
+	if !ok {
+		sem = l.sem
+	}
+	n := 1
+	if l.opts.weight != nil {
+		n = l.opts.weight(method)
+	}
+	if sem == nil || n <= 0 {
+		return func() {}, nil
+	}
+
+	if l.opts.maxWait <= 0 {
+		if !sem.TryAcquire(n) {
+			return nil, status.Errorf(codes.ResourceExhausted, "semaphoregrpc: concurrency limit of %s is exceeded", method)
+		}
+	} else {
+		waitCtx, cancel := context.WithTimeout(ctx, l.opts.maxWait)
+		err := sem.Acquire(waitCtx, n)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				// the call itself is cancelled or timed out
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+			return nil, status.Errorf(codes.ResourceExhausted, "semaphoregrpc: concurrency limit of %s is exceeded", method)
+		}
+	}
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			sem.Release(n)
+		})
+	}, nil
+}
+
+// UnaryServerInterceptor returns a server interceptor holding permits of sem while a unary call is handled.
+func UnaryServerInterceptor(sem semaphore.Semaphore, opts ...Option) grpc.UnaryServerInterceptor {
+	l := newLimiter(sem, opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, err := l.acquire(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a server interceptor holding permits of sem while a stream is handled.
+func StreamServerInterceptor(sem semaphore.Semaphore, opts ...Option) grpc.StreamServerInterceptor {
+	l := newLimiter(sem, opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, err := l.acquire(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
+
+// UnaryClientInterceptor returns a client interceptor holding permits of sem while a unary call is in flight.
+func UnaryClientInterceptor(sem semaphore.Semaphore, opts ...Option) grpc.UnaryClientInterceptor {
+	l := newLimiter(sem, opts)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		release, err := l.acquire(ctx, method)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return invoker(ctx, method, req, reply, cc, callOpts...)
+	}
+}
+
+// StreamClientInterceptor returns a client interceptor holding permits of sem for a stream lifetime.
+// Permits are released when the stream is finished: RecvMsg returns an error (including io.EOF),
+// the single response of a non server-streaming call is received or the stream context is done.
+func StreamClientInterceptor(sem semaphore.Semaphore, opts ...Option) grpc.StreamClientInterceptor {
+	l := newLimiter(sem, opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		release, err := l.acquire(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, callOpts...)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		s := &clientStream{
+			ClientStream:  cs,
+			serverStreams: desc.ServerStreams,
+			release:       release,
+			done:          make(chan struct{}),
+		}
+		go func() {
+			select {
+			case <-cs.Context().Done():
+				release()
+			case <-s.done:
+			}
+		}()
+		return s, nil
+	}
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	release       func()
+
+	doneOnce sync.Once
+	done     chan struct{}
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.finish()
+	}
+	return err
+}
+
+func (s *clientStream) finish() {
+	s.doneOnce.Do(func() {
+		s.release()
+		close(s.done)
+	})
+}
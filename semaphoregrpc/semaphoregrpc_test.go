@@ -0,0 +1,245 @@
+package semaphoregrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	checkMethod = "/grpc.health.v1.Health/Check"
+	watchMethod = "/grpc.health.v1.Health/Watch"
+)
+
+func checkCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	count := sem.GetCount()
+	if count != expected {
+		t.Error("semaphore must have count = ", expected, ", but has ", count)
+	}
+}
+
+// waitCount waits until the count is changed by a call finished in other goroutine.
+func waitCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for sem.GetCount() != expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	checkCount(t, sem, expected)
+}
+
+func checkCode(t *testing.T, err error, expected codes.Code) {
+	if code := status.Code(err); code != expected {
+		t.Error("code ", expected, " expected, got ", err)
+	}
+}
+
+// startServer starts in-process health server and returns a client connected to it.
+func startServer(t *testing.T, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) (healthpb.HealthClient, func()) {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(serverOpts...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+
+	dialOpts = append(dialOpts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return healthpb.NewHealthClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+// blockingInterceptor blocks unary calls until unblock is closed.
+func blockingInterceptor(started chan<- struct{}, unblock <-chan struct{}) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		started <- struct{}{}
+		<-unblock
+		return handler(ctx, req)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	sem := semaphore.New(1)
+	started, unblock := make(chan struct{}, 1), make(chan struct{})
+	client, stop := startServer(t, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(sem), blockingInterceptor(started, unblock)),
+	})
+	defer stop()
+
+	ctx := context.Background()
+	done := make(chan error)
+	go func() {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		done <- err
+	}()
+	<-started
+	checkCount(t, sem, 1)
+
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	checkCode(t, err, codes.ResourceExhausted)
+
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	checkCount(t, sem, 0)
+}
+
+func TestUnaryServerInterceptor_max_wait(t *testing.T) {
+	sem := semaphore.New(1)
+	started, unblock := make(chan struct{}, 2), make(chan struct{})
+	client, stop := startServer(t, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(sem, WithMaxWait(5*time.Second)), blockingInterceptor(started, unblock)),
+	})
+	defer stop()
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+			done <- err
+		}()
+	}
+	<-started
+	select {
+	case <-started:
+		t.Fatal("second call is handled over limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	checkCount(t, sem, 0)
+}
+
+func TestUnaryServerInterceptor_wait_timeout(t *testing.T) {
+	sem := semaphore.New(1)
+	sem.Acquire(nil, 1)
+	client, stop := startServer(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(UnaryServerInterceptor(sem, WithMaxWait(20*time.Millisecond))),
+	})
+	defer stop()
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	checkCode(t, err, codes.ResourceExhausted)
+	checkCount(t, sem, 1)
+}
+
+func TestUnaryServerInterceptor_per_method(t *testing.T) {
+	sem := semaphore.New(10)
+	checkSem := semaphore.New(1)
+	var count int
+	client, stop := startServer(t, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			UnaryServerInterceptor(sem,
+				WithMethodSemaphore(checkMethod, checkSem),
+				WithWeight(func(method string) int {
+					return 3
+				}),
+			),
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				count = checkSem.GetCount()
+				return handler(ctx, req)
+			},
+		),
+	})
+	defer stop()
+
+	// weight 3 is over the limit of the method semaphore
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	checkCode(t, err, codes.ResourceExhausted)
+
+	checkSem.SetLimit(3)
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Error("call must hold 3 permits, but holds", count)
+	}
+	checkCount(t, checkSem, 0)
+	checkCount(t, sem, 0)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	sem := semaphore.New(1)
+	client, stop := startServer(t, []grpc.ServerOption{
+		grpc.StreamInterceptor(StreamServerInterceptor(sem)),
+	})
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(t, sem, 1)
+
+	stream2, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream2.Recv()
+	checkCode(t, err, codes.ResourceExhausted)
+
+	cancel()
+	waitCount(t, sem, 0)
+}
+
+func TestClientInterceptors(t *testing.T) {
+	sem := semaphore.New(1)
+	client, stop := startServer(t, nil,
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(sem)),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(sem)),
+	)
+	defer stop()
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(t, sem, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(t, sem, 1)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	checkCode(t, err, codes.ResourceExhausted)
+	_, err = client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	checkCode(t, err, codes.ResourceExhausted)
+
+	cancel()
+	if _, err := stream.Recv(); err == nil {
+		t.Error("stream error expected after cancel")
+	}
+	waitCount(t, sem, 0)
+}
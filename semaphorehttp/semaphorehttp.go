@@ -0,0 +1,212 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphorehttp provides HTTP server middleware limiting concurrency of requests with a Semaphore.
+// Every request acquires permits before the wrapped handler is called and releases them
+// when the response is completed, or when the connection is closed for hijacked requests.
+package semaphorehttp // import "github.com/marusama/semaphore/v2/semaphorehttp"
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+const (
+	// LimitHeader is the response header with the semaphore limit, see WithCountHeaders.
+	LimitHeader = "X-Concurrency-Limit"
+
+	// CountHeader is the response header with the semaphore count, see WithCountHeaders.
+	CountHeader = "X-Concurrency-Count"
+
+	defaultRetryAfter = time.Second
+)
+
+// Option configures the middleware.
+type Option func(*options)
+
+type options struct {
+	weight        func(r *http.Request) int
+	maxWait       time.Duration
+	retryAfter    time.Duration
+	countHeaders  bool
+	rejectHandler http.Handler
+}
+
+// WithWeight sets a callback computing how many permits a request needs, e.g. by route or Content-Length.
+// Requests with non-positive weight are not limited. By default every request needs one permit.
+func WithWeight(weight func(r *http.Request) int) Option {
+	return func(o *options) {
+		o.weight = weight
+	}
+}
+
+// WithMaxWait makes requests wait for permits up to d before they are rejected.
+// By default requests are rejected immediately when the semaphore is full.
+func WithMaxWait(d time.Duration) Option {
+	return func(o *options) {
+		o.maxWait = d
+	}
+}
+
+// WithRetryAfter sets the Retry-After header value of rejected requests, 1 second by default.
+func WithRetryAfter(d time.Duration) Option {
+	return func(o *options) {
+		o.retryAfter = d
+	}
+}
+
+// WithCountHeaders adds LimitHeader and CountHeader with current GetLimit and GetCount values to responses.
+func WithCountHeaders() Option {
+	return func(o *options) {
+		o.countHeaders = true
+	}
+}
+
+// WithRejectHandler sets a handler for rejected requests instead of the default 503 Service Unavailable response.
+// Retry-After and count headers are set before the handler is called.
+func WithRejectHandler(h http.Handler) Option {
+	return func(o *options) {
+		o.rejectHandler = h
+	}
+}
+
+// Middleware returns a middleware limiting concurrency of requests with sem.
+func Middleware(sem semaphore.Semaphore, opts ...Option) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Handler(sem, next, opts...)
+	}
+}
+
+// Handler wraps next so that every request holds permits of sem while it's served.
+func Handler(sem semaphore.Semaphore, next http.Handler, opts ...Option) http.Handler {
+	o := options{
+		retryAfter: defaultRetryAfter,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.rejectHandler == nil {
+		o.rejectHandler = http.HandlerFunc(reject)
+	}
+	return &handler{
+		sem:  sem,
+		next: next,
+		opts: o,
+	}
+}
+
+type handler struct {
+	sem  semaphore.Semaphore
+	next http.Handler
+	opts options
+}
+
+func reject(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := 1
+	if h.opts.weight != nil {
+		n = h.opts.weight(r)
+	}
+	if n <= 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if !h.acquire(r.Context(), n) {
+		if h.opts.countHeaders {
+			h.setCountHeaders(w)
+		}
+		seconds := int((h.opts.retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		h.opts.rejectHandler.ServeHTTP(w, r)
+		return
+	}
+	if h.opts.countHeaders {
+		h.setCountHeaders(w)
+	}
+
+	rw := &responseWriter{
+		ResponseWriter: w,
+		release: func() {
+			h.sem.Release(n)
+		},
+	}
+	defer func() {
+		// hijacked connection releases permits on close
+		if !rw.hijacked {
+			rw.releaseOnce.Do(rw.release)
+		}
+	}()
+	h.next.ServeHTTP(rw, r)
+}
+
+func (h *handler) acquire(ctx context.Context, n int) bool {
+	if h.opts.maxWait <= 0 {
+		return h.sem.TryAcquire(n)
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.opts.maxWait)
+	defer cancel()
+	return h.sem.Acquire(ctx, n) == nil
+}
+
+func (h *handler) setCountHeaders(w http.ResponseWriter) {
+	w.Header().Set(LimitHeader, strconv.Itoa(h.sem.GetLimit()))
+	w.Header().Set(CountHeader, strconv.Itoa(h.sem.GetCount()))
+}
+
+// responseWriter tracks hijacking of the connection, so permits are held until the hijacked connection is closed.
+type responseWriter struct {
+	http.ResponseWriter
+
+	release     func()
+	releaseOnce sync.Once
+	hijacked    bool
+}
+
+// Flush sends buffered data to the client, it's no-op if the underlying ResponseWriter doesn't support flushing.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, permits are released when the returned connection is closed.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return &hijackedConn{Conn: conn, w: w}, rw, nil
+}
+
+// Unwrap returns the underlying ResponseWriter, it's used by http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type hijackedConn struct {
+	net.Conn
+	w *responseWriter
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.w.releaseOnce.Do(c.w.release)
+	return err
+}
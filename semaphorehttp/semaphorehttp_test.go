@@ -0,0 +1,251 @@
+package semaphorehttp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func checkCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	count := sem.GetCount()
+	if count != expected {
+		t.Error("semaphore must have count = ", expected, ", but has ", count)
+	}
+}
+
+// waitCount waits until the count is changed by a request handled in other goroutine.
+func waitCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for sem.GetCount() != expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	checkCount(t, sem, expected)
+}
+
+// blockingHandler blocks requests until unblock is closed.
+func blockingHandler(started chan<- struct{}, unblock <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestHandler_reject_when_full(t *testing.T) {
+	sem := semaphore.New(1)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	h := Handler(sem, blockingHandler(started, unblock), WithRetryAfter(1500*time.Millisecond), WithCountHeaders())
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		done <- w
+	}()
+	<-started
+	checkCount(t, sem, 1)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("status 503 expected, got", w.Code)
+	}
+	if v := w.Header().Get("Retry-After"); v != "2" {
+		t.Error("Retry-After must be 2, got", v)
+	}
+	if v := w.Header().Get(LimitHeader); v != "1" {
+		t.Error(LimitHeader, " must be 1, got ", v)
+	}
+	if v := w.Header().Get(CountHeader); v != "1" {
+		t.Error(CountHeader, " must be 1, got ", v)
+	}
+
+	close(unblock)
+	w = <-done
+	if w.Code != http.StatusOK {
+		t.Error("status 200 expected, got", w.Code)
+	}
+	if v := w.Header().Get(CountHeader); v != "1" {
+		t.Error(CountHeader, " must be 1, got ", v)
+	}
+	checkCount(t, sem, 0)
+}
+
+func TestHandler_max_wait(t *testing.T) {
+	sem := semaphore.New(1)
+	started, unblock := make(chan struct{}, 2), make(chan struct{})
+	h := Handler(sem, blockingHandler(started, unblock), WithMaxWait(5*time.Second))
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			done <- w.Code
+		}()
+	}
+	<-started
+
+	// second request is queued
+	select {
+	case <-started:
+		t.Fatal("second request is served over limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Error("status 200 expected, got", code)
+		}
+	}
+	checkCount(t, sem, 0)
+}
+
+func TestHandler_max_wait_timeout(t *testing.T) {
+	sem := semaphore.New(1)
+	sem.Acquire(nil, 1)
+	h := Handler(sem, http.NotFoundHandler(), WithMaxWait(20*time.Millisecond))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("status 503 expected, got", w.Code)
+	}
+	checkCount(t, sem, 1)
+}
+
+func TestHandler_weight(t *testing.T) {
+	sem := semaphore.New(10)
+	var count int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count = sem.GetCount()
+	})
+	h := Handler(sem, next, WithWeight(func(r *http.Request) int {
+		if r.URL.Path == "/free" {
+			return 0
+		}
+		return int(r.ContentLength)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("12345")))
+	if count != 5 {
+		t.Error("request must hold 5 permits, but holds", count)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/free", strings.NewReader("12345")))
+	if count != 0 {
+		t.Error("request must hold no permits, but holds", count)
+	}
+	checkCount(t, sem, 0)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("12345678901")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("status 503 expected for weight over limit, got", w.Code)
+	}
+}
+
+func TestHandler_reject_handler(t *testing.T) {
+	sem := semaphore.New(0)
+	h := Handler(sem, http.NotFoundHandler(), WithRejectHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Error("status 429 expected, got", w.Code)
+	}
+	if v := w.Header().Get("Retry-After"); v != "1" {
+		t.Error("Retry-After must be 1, got", v)
+	}
+}
+
+func TestHandler_panic_releases(t *testing.T) {
+	sem := semaphore.New(1)
+	h := Handler(sem, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	func() {
+		defer func() {
+			recover()
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	checkCount(t, sem, 0)
+}
+
+func TestHandler_streaming(t *testing.T) {
+	sem := semaphore.New(1)
+	flushed := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	})
+	server := httptest.NewServer(Handler(sem, next))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != "first\n" {
+		t.Fatal("flushed line expected, got", line, err)
+	}
+	checkCount(t, sem, 1)
+
+	close(flushed)
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(rest) != "second\n" {
+		t.Fatal("rest of response expected, got", string(rest), err)
+	}
+	waitCount(t, sem, 0)
+}
+
+func TestHandler_hijack(t *testing.T) {
+	sem := semaphore.New(1)
+	conns := make(chan net.Conn, 1)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		rw.Flush()
+		conns <- conn
+	})
+	server := httptest.NewServer(Handler(sem, next))
+	defer server.Close()
+
+	client, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	conn := <-conns
+
+	// handler has returned, but the hijacked connection is still open
+	time.Sleep(20 * time.Millisecond)
+	checkCount(t, sem, 1)
+
+	conn.Close()
+	checkCount(t, sem, 0)
+
+	// double close must not release twice
+	conn.Close()
+	checkCount(t, sem, 0)
+}
@@ -0,0 +1,328 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoreio provides io.Reader and io.Writer wrappers budgeting in-flight bytes with a Semaphore.
+// Every read or write acquires permits weighted by the buffer size, so a single semaphore with limit in bytes
+// caps memory used by buffering across all transfers sharing it.
+package semaphoreio // import "github.com/marusama/semaphore/v2/semaphoreio"
+
+import (
+	"context"
+	"io"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+const defaultMaxChunk = 32 * 1024
+
+// Option configures a Reader or Writer.
+type Option func(*options)
+
+type options struct {
+	maxChunk int
+}
+
+// WithMaxChunk sets the maximum number of bytes (and so permits) handled by a single underlying Read or Write call,
+// 32KB by default. A chunk is never bigger than the current semaphore limit.
+func WithMaxChunk(n int) Option {
+	if n <= 0 {
+		panic("chunk size must be positive number")
+	}
+	return func(o *options) {
+		o.maxChunk = n
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		maxChunk: defaultMaxChunk,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// chunkSize returns how many of n bytes can be handled at once.
+func chunkSize(sem semaphore.Semaphore, o *options, n int) int {
+	if n > o.maxChunk {
+		n = o.maxChunk
+	}
+	if limit := sem.GetLimit(); n > limit {
+		n = limit
+	}
+	if n < 1 {
+		// wait until the limit is raised
+		n = 1
+	}
+	return n
+}
+
+// Reader is an io.Reader acquiring permits of a semaphore for the bytes it has read.
+// The bytes returned by Read are considered in use by the caller until the next Read or Close,
+// when their permits are released.
+// The Reader and the Writer of one copy may share a semaphore if the copy is done by io.Copy,
+// which hands the permits of the read bytes over to the Writer. A copy reading and writing by itself
+// counts the bytes twice, and copies holding read bytes could wait for each other forever.
+type Reader struct {
+	r    io.Reader
+	sem  semaphore.Semaphore
+	ctx  context.Context
+	opts options
+
+	// permits of the bytes returned by the last Read
+	held int
+}
+
+// NewReader returns a Reader reading from r. ctx cancels waiting for permits.
+func NewReader(ctx context.Context, r io.Reader, sem semaphore.Semaphore, opts ...Option) *Reader {
+	return &Reader{
+		r:    r,
+		sem:  sem,
+		ctx:  ctx,
+		opts: newOptions(opts),
+	}
+}
+
+// Read releases permits of the previously read bytes, acquires permits for the buffer and reads into it.
+// Permits for the part of the buffer that was not filled are released immediately.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.read(p, nil)
+}
+
+// read is Read calling flush, if set, before it waits for permits.
+func (r *Reader) read(p []byte, flush func() error) (int, error) {
+	r.release()
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+
+	p = p[:chunkSize(r.sem, &r.opts, len(p))]
+	if !r.sem.TryAcquire(len(p)) {
+		if flush != nil {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+		if err := r.sem.Acquire(r.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.r.Read(p)
+	if n < len(p) {
+		r.sem.Release(len(p) - n)
+	}
+	r.held = n
+	return n, err
+}
+
+// WriteTo implements io.WriterTo. If w is a Writer, it's flushed before waiting for read permits,
+// and if it's of the same semaphore, the permits of the read bytes are handed over to it instead of being acquired again.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if sw, ok := w.(*Writer); ok {
+		return copyReader(sw, r)
+	}
+	// hide WriteTo, so io.Copy doesn't call it again
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// Close releases permits of the last read bytes and closes the underlying reader if it's an io.Closer.
+func (r *Reader) Close() error {
+	r.release()
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r *Reader) release() {
+	if r.held > 0 {
+		r.sem.Release(r.held)
+		r.held = 0
+	}
+}
+
+// flusher is implemented by buffered writers like bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// bufferedCounter is implemented by buffered writers reporting how many bytes they hold, like bufio.Writer.
+type bufferedCounter interface {
+	Buffered() int
+}
+
+// Writer is an io.Writer acquiring permits of a semaphore for the bytes it writes.
+// If the underlying writer is buffered (has Flush() error method), the permits of written bytes
+// are held until they are flushed, otherwise they are released as soon as the underlying Write returns.
+// Buffered writers that don't report their Buffered() size are considered flushed only by Flush or Close.
+// Write flushes the underlying writer before it waits for permits, but between writes the permits
+// of buffered bytes stay held, so don't wait for other permits (e.g. by reading from a Reader)
+// while a buffered Writer holds them: flush it first.
+type Writer struct {
+	w    io.Writer
+	sem  semaphore.Semaphore
+	ctx  context.Context
+	opts options
+
+	// permits of the bytes buffered by the underlying writer
+	held int
+}
+
+// NewWriter returns a Writer writing to w. ctx cancels waiting for permits.
+func NewWriter(ctx context.Context, w io.Writer, sem semaphore.Semaphore, opts ...Option) *Writer {
+	return &Writer{
+		w:    w,
+		sem:  sem,
+		ctx:  ctx,
+		opts: newOptions(opts),
+	}
+}
+
+// Write writes p in chunks, acquiring permits for every chunk before it's written.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		chunk = chunk[:chunkSize(w.sem, &w.opts, len(chunk))]
+		if !w.sem.TryAcquire(len(chunk)) {
+			// don't wait while holding buffered bytes, writers waiting for each other would never flush
+			if err := w.Flush(); err != nil {
+				return written, err
+			}
+			if err := w.sem.Acquire(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.writeChunk(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom implements io.ReaderFrom. If r is a Reader, the Writer is flushed before r waits for permits,
+// and if r is of the same semaphore, the permits of the read bytes are handed over to the Writer instead of being acquired again.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if sr, ok := r.(*Reader); ok {
+		return copyReader(w, sr)
+	}
+	// hide ReadFrom, so io.Copy doesn't call it again
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// writeChunk writes chunk, whose permits are held, and keeps the permits of the bytes left buffered.
+func (w *Writer) writeChunk(chunk []byte) (int, error) {
+	_, buffered := w.w.(flusher)
+	n, err := w.w.Write(chunk)
+	if buffered && n > 0 {
+		w.held += n
+		if n < len(chunk) {
+			w.sem.Release(len(chunk) - n)
+		}
+		w.releaseFlushed()
+	} else {
+		w.sem.Release(len(chunk))
+	}
+	return n, err
+}
+
+// writeAcquired writes p, whose permits are already held, in chunks.
+func (w *Writer) writeAcquired(p []byte) (int, error) {
+	written := 0
+	for done := 0; done < len(p); {
+		chunk := p[done:]
+		if len(chunk) > w.opts.maxChunk {
+			chunk = chunk[:w.opts.maxChunk]
+		}
+		done += len(chunk)
+		n, err := w.writeChunk(chunk)
+		written += n
+		if err != nil {
+			if rest := len(p) - done; rest > 0 {
+				w.sem.Release(rest)
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// copyReader copies r to w. Like Write, it flushes w before it waits for read permits,
+// so copies don't hold buffered bytes while waiting for each other.
+// If r and w share the semaphore, the permits of the read bytes move to w.
+func copyReader(w *Writer, r *Reader) (int64, error) {
+	shared := w.sem == r.sem
+	buf := make([]byte, r.opts.maxChunk)
+	var written int64
+	for {
+		n, err := r.read(buf, w.Flush)
+		if n > 0 {
+			var (
+				nw   int
+				werr error
+			)
+			if shared {
+				r.held = 0
+				nw, werr = w.writeAcquired(buf[:n])
+			} else {
+				nw, werr = w.Write(buf[:n])
+			}
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// releaseFlushed releases permits of the bytes the underlying writer has already flushed by itself.
+func (w *Writer) releaseFlushed() {
+	b, ok := w.w.(bufferedCounter)
+	if !ok {
+		return
+	}
+	if flushed := w.held - b.Buffered(); flushed > 0 {
+		w.sem.Release(flushed)
+		w.held -= flushed
+	}
+}
+
+// Flush flushes the underlying writer if it's buffered and releases permits of the flushed bytes.
+func (w *Writer) Flush() error {
+	if f, ok := w.w.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if w.held > 0 {
+		w.sem.Release(w.held)
+		w.held = 0
+	}
+	return nil
+}
+
+// Close flushes the writer and closes the underlying writer if it's an io.Closer.
+// Permits are released even if flushing fails.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if w.held > 0 {
+		w.sem.Release(w.held)
+		w.held = 0
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
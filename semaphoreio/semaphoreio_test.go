@@ -0,0 +1,351 @@
+package semaphoreio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func checkCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	count := sem.GetCount()
+	if count != expected {
+		t.Error("semaphore must have count = ", expected, ", but has ", count)
+	}
+}
+
+func TestReader(t *testing.T) {
+	sem := semaphore.New(4)
+	r := NewReader(context.Background(), strings.NewReader("0123456789"), sem)
+
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	if err != nil || n != 4 || string(buf[:n]) != "0123" {
+		t.Fatal("chunk limited by semaphore limit expected, got", n, err)
+	}
+	checkCount(t, sem, 4)
+
+	// previous chunk is released before the next read
+	n, err = r.Read(buf[:3])
+	if err != nil || n != 3 || string(buf[:n]) != "456" {
+		t.Fatal("next chunk expected, got", n, err)
+	}
+	checkCount(t, sem, 3)
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(rest) != "789" {
+		t.Fatal("rest of data expected, got", string(rest), err)
+	}
+	checkCount(t, sem, 0)
+
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	checkCount(t, sem, 0)
+}
+
+func TestReader_Close_releases(t *testing.T) {
+	sem := semaphore.New(100)
+	r := NewReader(context.Background(), strings.NewReader("0123456789"), sem, WithMaxChunk(5))
+
+	buf := make([]byte, 10)
+	if n, _ := r.Read(buf); n != 5 {
+		t.Fatal("chunk limited by max chunk expected, got", n)
+	}
+	checkCount(t, sem, 5)
+	r.Close()
+	checkCount(t, sem, 0)
+}
+
+func TestReader_ctx_done(t *testing.T) {
+	sem := semaphore.New(4)
+	sem.Acquire(nil, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r := NewReader(ctx, strings.NewReader("0123456789"), sem)
+
+	if _, err := r.Read(make([]byte, 10)); err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	checkCount(t, sem, 4)
+}
+
+func TestWriter_unbuffered(t *testing.T) {
+	sem := semaphore.New(4)
+	var out bytes.Buffer
+	w := NewWriter(context.Background(), &out, sem)
+
+	n, err := w.Write([]byte("0123456789"))
+	if err != nil || n != 10 || out.String() != "0123456789" {
+		t.Fatal("all data must be written, got", n, err)
+	}
+	checkCount(t, sem, 0)
+}
+
+// countingWriter records the largest single write.
+type countingWriter struct {
+	maxWrite int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return len(p), nil
+}
+
+func TestWriter_chunks(t *testing.T) {
+	sem := semaphore.New(100)
+	cw := &countingWriter{}
+	w := NewWriter(context.Background(), cw, sem, WithMaxChunk(3))
+
+	if n, err := w.Write([]byte("0123456789")); err != nil || n != 10 {
+		t.Fatal("all data must be written, got", n, err)
+	}
+	if cw.maxWrite != 3 {
+		t.Error("writes must be limited by max chunk, got", cw.maxWrite)
+	}
+}
+
+func TestWriter_buffered(t *testing.T) {
+	sem := semaphore.New(100)
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+	w := NewWriter(context.Background(), bw, sem)
+
+	w.Write([]byte("01234"))
+	checkCount(t, sem, 5)
+	w.Write([]byte("56789"))
+	checkCount(t, sem, 10)
+	if out.Len() != 0 {
+		t.Error("data must be buffered")
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(t, sem, 0)
+	if out.String() != "0123456789" {
+		t.Error("flushed data expected, got", out.String())
+	}
+
+	w.Write([]byte("x"))
+	checkCount(t, sem, 1)
+	w.Close()
+	checkCount(t, sem, 0)
+}
+
+func TestWriter_ctx_done(t *testing.T) {
+	sem := semaphore.New(4)
+	sem.Acquire(nil, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	w := NewWriter(ctx, &out, sem)
+
+	n, err := w.Write([]byte("01"))
+	if n != 0 || err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", n, err)
+	}
+	checkCount(t, sem, 4)
+}
+
+// unsizedBuffer is a buffered writer that does not report its buffered size.
+type unsizedBuffer struct {
+	w *bufio.Writer
+}
+
+func (b *unsizedBuffer) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (b *unsizedBuffer) Flush() error {
+	return b.w.Flush()
+}
+
+func TestWriter_buffered_self_flushing(t *testing.T) {
+	sem := semaphore.New(100)
+	var out bytes.Buffer
+	bw := bufio.NewWriterSize(&out, 16)
+
+	// bufio.Writer flushes by itself when its buffer is full
+	w := NewWriter(context.Background(), bw, sem)
+	w.Write([]byte("0123456789"))
+	checkCount(t, sem, 10)
+	w.Write([]byte("0123456789"))
+	checkCount(t, sem, bw.Buffered())
+
+	// unknown buffered size, permits are held until Flush
+	out.Reset()
+	bw.Reset(&out)
+	w = NewWriter(context.Background(), &unsizedBuffer{bw}, sem)
+	w.Write([]byte("0123456789"))
+	w.Write([]byte("0123456789"))
+	checkCount(t, sem, 20+4)
+	w.Flush()
+	checkCount(t, sem, 4)
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	const limit = 64
+	sem := semaphore.New(limit)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	// the reader and the buffered writer of every copy share one semaphore
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			bw := bufio.NewWriterSize(&out, 16)
+			w := NewWriter(context.Background(), bw, sem, WithMaxChunk(16))
+			r := NewReader(context.Background(), bytes.NewReader(data), sem, WithMaxChunk(16))
+			if _, err := io.Copy(w, r); err != nil {
+				t.Error(err)
+			}
+			r.Close()
+			w.Close()
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data is corrupted")
+			}
+			if count := sem.GetCount(); count > limit {
+				t.Error("count is over limit: ", count)
+			}
+		}()
+	}
+	wg.Wait()
+	checkCount(t, sem, 0)
+}
+
+func TestConcurrentTransfers_separate(t *testing.T) {
+	const limit = 64
+	readSem, writeSem := semaphore.New(limit), semaphore.New(limit)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			w := NewWriter(context.Background(), bufio.NewWriterSize(&out, 16), writeSem, WithMaxChunk(16))
+			r := NewReader(context.Background(), bytes.NewReader(data), readSem, WithMaxChunk(16))
+			if _, err := io.Copy(w, r); err != nil {
+				t.Error(err)
+			}
+			r.Close()
+			w.Close()
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data is corrupted")
+			}
+		}()
+	}
+	wg.Wait()
+	checkCount(t, readSem, 0)
+	checkCount(t, writeSem, 0)
+}
+
+func TestCopy_shared_hands_permits_over(t *testing.T) {
+	sem := semaphore.New(100)
+	var out bytes.Buffer
+	w := NewWriter(context.Background(), bufio.NewWriterSize(&out, 16), sem)
+	r := NewReader(context.Background(), strings.NewReader("0123456789"), sem, WithMaxChunk(4))
+
+	// read bytes are counted once, while buffered by the writer
+	if n, err := io.Copy(w, r); err != nil || n != 10 {
+		t.Fatal("all data must be copied, got", n, err)
+	}
+	checkCount(t, sem, 10)
+	w.Close()
+	checkCount(t, sem, 0)
+	if out.String() != "0123456789" {
+		t.Error("copied data expected, got", out.String())
+	}
+}
+
+func TestCopy_shared_by_hand_blocks(t *testing.T) {
+	sem := semaphore.New(4)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	w := NewWriter(ctx, &out, sem)
+	r := NewReader(ctx, strings.NewReader("0123456789"), sem)
+
+	// a copy not done by io.Copy counts the read bytes twice and waits for its own permits
+	buf := make([]byte, 4)
+	n, err := r.Read(buf)
+	if err != nil || n != 4 {
+		t.Fatal("chunk expected, got", n, err)
+	}
+	if _, err := w.Write(buf[:n]); err != context.DeadlineExceeded {
+		t.Error("context.DeadlineExceeded expected, got", err)
+	}
+	r.Close()
+	checkCount(t, sem, 0)
+}
+
+func TestConcurrentTransfers_buffered(t *testing.T) {
+	const limit = 64
+	sem := semaphore.New(limit)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	// buffered writers of concurrent copies share one semaphore
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			bw := bufio.NewWriterSize(&out, 16)
+			w := NewWriter(context.Background(), bw, sem, WithMaxChunk(16))
+			if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+			w.Close()
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data is corrupted")
+			}
+			if count := sem.GetCount(); count > limit {
+				t.Error("count is over limit: ", count)
+			}
+		}()
+	}
+	wg.Wait()
+	checkCount(t, sem, 0)
+}
+
+func TestConcurrentWriters_buffered(t *testing.T) {
+	const limit = 32
+	sem := semaphore.New(limit)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	// every writer holds a full buffer, they must flush instead of waiting for each other
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			w := NewWriter(context.Background(), bufio.NewWriterSize(&out, 16), sem)
+			for j := 0; j < len(data); j += 16 {
+				if _, err := w.Write(data[j : j+16]); err != nil {
+					t.Error(err)
+				}
+			}
+			w.Close()
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data is corrupted")
+			}
+		}()
+	}
+	wg.Wait()
+	checkCount(t, sem, 0)
+}
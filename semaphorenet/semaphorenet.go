@@ -0,0 +1,72 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphorenet provides a net.Listener wrapper limiting the number of concurrent connections with a Semaphore.
+// Since the Semaphore limit can be changed at runtime, so can the maximum number of connections.
+package semaphorenet // import "github.com/marusama/semaphore/v2/semaphorenet"
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// NewListener returns a Listener that accepts a connection only after it has acquired one permit of sem.
+// The permit is released exactly once when the connection is closed.
+// Lowering the limit with SetLimit stops accepting until enough connections are closed.
+func NewListener(l net.Listener, sem semaphore.Semaphore) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listener{
+		Listener: l,
+		sem:      sem,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+type listener struct {
+	net.Listener
+	sem semaphore.Semaphore
+
+	// cancelled on Close to stop waiting for a permit
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	if err := l.sem.Acquire(l.ctx, 1); err != nil {
+		// listener is closed, a connection without a permit must not be handed out
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.sem.Release(1)
+		return nil, err
+	}
+	return &conn{Conn: c, sem: l.sem}, nil
+}
+
+// Close closes the underlying listener before it stops the waiting Accept calls,
+// so they can't accept a connection in between.
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.cancel()
+	return err
+}
+
+type conn struct {
+	net.Conn
+	sem         semaphore.Semaphore
+	releaseOnce sync.Once
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(func() {
+		c.sem.Release(1)
+	})
+	return err
+}
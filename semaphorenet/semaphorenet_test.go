@@ -0,0 +1,146 @@
+package semaphorenet
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func checkCount(t *testing.T, sem semaphore.Semaphore, expected int) {
+	count := sem.GetCount()
+	if count != expected {
+		t.Error("semaphore must have count = ", expected, ", but has ", count)
+	}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// startAccepting accepts connections in background and sends them to the returned channel.
+func startAccepting(l net.Listener) <-chan acceptResult {
+	accepted := make(chan acceptResult)
+	go func() {
+		for {
+			c, err := l.Accept()
+			accepted <- acceptResult{c, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return accepted
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func expectAccepted(t *testing.T, accepted <-chan acceptResult) net.Conn {
+	select {
+	case r := <-accepted:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not accepted")
+	}
+	return nil
+}
+
+func expectNotAccepted(t *testing.T, accepted <-chan acceptResult) {
+	select {
+	case <-accepted:
+		t.Fatal("connection is accepted over limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func newListener(t *testing.T, sem semaphore.Semaphore) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewListener(l, sem)
+}
+
+func TestListener_limit(t *testing.T) {
+	sem := semaphore.New(1)
+	l := newListener(t, sem)
+	defer l.Close()
+	accepted := startAccepting(l)
+
+	defer dial(t, l).Close()
+	defer dial(t, l).Close()
+
+	c1 := expectAccepted(t, accepted)
+	checkCount(t, sem, 1)
+	expectNotAccepted(t, accepted)
+
+	c1.Close()
+	c2 := expectAccepted(t, accepted)
+	checkCount(t, sem, 1)
+
+	// double close must not release twice
+	c1.Close()
+	checkCount(t, sem, 1)
+
+	c2.Close()
+	checkCount(t, sem, 0)
+}
+
+func TestListener_SetLimit(t *testing.T) {
+	sem := semaphore.New(2)
+	l := newListener(t, sem)
+	defer l.Close()
+	accepted := startAccepting(l)
+
+	for i := 0; i < 3; i++ {
+		defer dial(t, l).Close()
+	}
+	c1 := expectAccepted(t, accepted)
+	c2 := expectAccepted(t, accepted)
+	expectNotAccepted(t, accepted)
+
+	sem.SetLimit(1)
+	c1.Close()
+	expectNotAccepted(t, accepted)
+
+	c2.Close()
+	c3 := expectAccepted(t, accepted)
+	defer c3.Close()
+
+	sem.SetLimit(2)
+	defer dial(t, l).Close()
+	defer expectAccepted(t, accepted).Close()
+}
+
+func TestListener_Close_while_waiting(t *testing.T) {
+	sem := semaphore.New(0)
+	l := newListener(t, sem)
+	accepted := startAccepting(l)
+	defer dial(t, l).Close()
+
+	l.Close()
+	select {
+	case r := <-accepted:
+		if !errors.Is(r.err, net.ErrClosed) {
+			t.Error("net.ErrClosed expected from Accept of closed listener, got", r.err)
+		}
+		if r.conn != nil {
+			t.Error("connection without a permit is accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept is not unblocked by Close")
+	}
+	checkCount(t, sem, 0)
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoreotel provides OpenTelemetry tracing of Semaphore waits.
+package semaphoreotel // import "github.com/marusama/semaphore/v2/semaphoreotel"
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/marusama/semaphore/v2/semaphoreotel"
+
+// Attribute keys set on spans and events.
+const (
+	NameKey         = attribute.Key("semaphore.name")
+	WeightKey       = attribute.Key("semaphore.weight")
+	CountKey        = attribute.Key("semaphore.count")
+	LimitKey        = attribute.Key("semaphore.limit")
+	OutcomeKey      = attribute.Key("semaphore.outcome")
+	HoldDurationKey = attribute.Key("semaphore.hold_duration")
+)
+
+// Outcomes of a blocking acquire.
+const (
+	OutcomeAcquired  = "acquired"
+	OutcomeCancelled = "cancelled"
+	OutcomeTimedOut  = "timed_out"
+)
+
+// ReleaseEventName is the name of the span event recorded at Release.
+const ReleaseEventName = "semaphore.release"
+
+// MaxHoldings is the maximum number of acquisitions remembered for release events, the oldest are dropped.
+const MaxHoldings = 1024
+
+// Option configures the wrapper.
+type Option func(*options)
+
+type options struct {
+	tracerProvider trace.TracerProvider
+}
+
+// WithTracerProvider sets the TracerProvider used to create spans, the global one by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+	}
+}
+
+// Wrap returns a Semaphore tracing waits of sem.
+//
+// An Acquire which can't enter the semaphore immediately starts a "semaphore.Acquire" span
+// with the semaphore name, requested weight, count and limit, ending with the outcome.
+// Acquisitions that don't block create no spans.
+//
+// Release records a "semaphore.release" event with the hold duration on the span
+// that was current in the Acquire context, if it's still recording.
+// Release(n) doesn't know which acquisition it ends, so entries are matched in acquisition order:
+// when holders release out of order, as concurrent ones do, the events get each other's durations.
+// Acquisitions whose entries are released past the wrapper, by the wrapped semaphore, are forgotten
+// once the count of the wrapped semaphore shows it, at most MaxHoldings acquisitions are remembered.
+func Wrap(name string, sem semaphore.Semaphore, opts ...Option) semaphore.Semaphore {
+	o := options{
+		tracerProvider: otel.GetTracerProvider(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &tracedSemaphore{
+		Semaphore: sem,
+		name:      name,
+		tracer:    o.tracerProvider.Tracer(instrumentationName),
+	}
+}
+
+type tracedSemaphore struct {
+	semaphore.Semaphore
+	name   string
+	tracer trace.Tracer
+
+	// holdings in acquisition order and their total weight
+	mu       sync.Mutex
+	holdings []holding
+	held     int
+}
+
+type holding struct {
+	n     int
+	start time.Time
+	span  trace.Span
+}
+
+func (s *tracedSemaphore) Acquire(ctx context.Context, n int) error {
+	// a done context takes the traced path to fail like the wrapped semaphore
+	if (ctx == nil || ctx.Err() == nil) && s.Semaphore.TryAcquire(n) {
+		s.hold(ctx, n)
+		return nil
+	}
+
+	spanCtx := ctx
+	if spanCtx == nil {
+		spanCtx = context.Background()
+	}
+	_, span := s.tracer.Start(spanCtx, "semaphore.Acquire", trace.WithAttributes(
+		NameKey.String(s.name),
+		WeightKey.Int(n),
+		CountKey.Int(s.Semaphore.GetCount()),
+		LimitKey.Int(s.Semaphore.GetLimit()),
+	))
+	defer span.End()
+
+	err := s.Semaphore.Acquire(ctx, n)
+	switch {
+	case err == nil:
+		span.SetAttributes(OutcomeKey.String(OutcomeAcquired))
+		s.hold(ctx, n)
+	case errors.Is(err, context.DeadlineExceeded):
+		span.SetAttributes(OutcomeKey.String(OutcomeTimedOut))
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(OutcomeKey.String(OutcomeCancelled))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (s *tracedSemaphore) TryAcquire(n int) bool {
+	if !s.Semaphore.TryAcquire(n) {
+		return false
+	}
+	s.hold(nil, n)
+	return true
+}
+
+func (s *tracedSemaphore) Release(n int) int {
+	count, released := s.release(n)
+
+	now := time.Now()
+	for _, h := range released {
+		if h.span.IsRecording() {
+			h.span.AddEvent(ReleaseEventName, trace.WithAttributes(
+				NameKey.String(s.name),
+				WeightKey.Int(h.n),
+				HoldDurationKey.Float64(now.Sub(h.start).Seconds()),
+			), trace.WithTimestamp(now))
+		}
+	}
+	return count
+}
+
+// release releases n entries of the wrapped semaphore and takes them from the holdings in acquisition order.
+// Both change under the lock, so hold compares them consistently.
+func (s *tracedSemaphore) release(n int) (int, []holding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := s.Semaphore.Release(n)
+
+	var released []holding
+	for n > 0 && len(s.holdings) > 0 {
+		h := &s.holdings[0]
+		part := *h
+		if h.n > n {
+			h.n -= n
+			part.n = n
+		} else {
+			s.holdings = s.holdings[1:]
+		}
+		n -= part.n
+		s.held -= part.n
+		released = append(released, part)
+	}
+	return count, released
+}
+
+// hold remembers the acquisition to record its duration at Release.
+func (s *tracedSemaphore) hold(ctx context.Context, n int) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := trace.SpanFromContext(ctx)
+	s.mu.Lock()
+	// the count includes all remembered acquisitions, the weight over it was released past the wrapper
+	count := s.Semaphore.GetCount()
+	s.holdings = append(s.holdings, holding{n: n, start: time.Now(), span: span})
+	s.held += n
+	for excess := s.held - count; len(s.holdings) > 1 && (excess > 0 || len(s.holdings) > MaxHoldings); {
+		h := &s.holdings[0]
+		if excess > 0 && h.n > excess {
+			h.n -= excess
+			s.held -= excess
+			excess = 0
+			continue
+		}
+		excess -= h.n
+		s.held -= h.n
+		*h = holding{}
+		s.holdings = s.holdings[1:]
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,247 @@
+package semaphoreotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/semaphoretest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return tp, exporter
+}
+
+func attr(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func acquireSpans(spans tracetest.SpanStubs) tracetest.SpanStubs {
+	var res tracetest.SpanStubs
+	for _, s := range spans {
+		if s.Name == "semaphore.Acquire" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func TestWrap_non_blocking_acquire_has_no_span(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(2), WithTracerProvider(tp))
+
+	sem.Acquire(context.Background(), 1)
+	sem.TryAcquire(1)
+	sem.Release(2)
+
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Error("no spans expected, got", len(spans))
+	}
+}
+
+func TestWrap_blocking_acquire(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(3), WithTracerProvider(tp))
+	sem.Acquire(nil, 2)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		sem.Release(2)
+	}()
+	if err := sem.Acquire(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	sem.Release(2)
+	parent.End()
+
+	spans := exporter.GetSpans()
+	acquires := acquireSpans(spans)
+	if len(acquires) != 1 {
+		t.Fatal("1 acquire span expected, got", len(acquires))
+	}
+	span := acquires[0]
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("acquire span must be a child of the request span")
+	}
+	if v := attr(span.Attributes, NameKey).AsString(); v != "db" {
+		t.Error("unexpected name", v)
+	}
+	if v := attr(span.Attributes, WeightKey).AsInt64(); v != 2 {
+		t.Error("unexpected weight", v)
+	}
+	if v := attr(span.Attributes, CountKey).AsInt64(); v != 2 {
+		t.Error("unexpected count", v)
+	}
+	if v := attr(span.Attributes, LimitKey).AsInt64(); v != 3 {
+		t.Error("unexpected limit", v)
+	}
+	if v := attr(span.Attributes, OutcomeKey).AsString(); v != OutcomeAcquired {
+		t.Error("unexpected outcome", v)
+	}
+	if d := span.EndTime.Sub(span.StartTime); d < 20*time.Millisecond {
+		t.Error("acquire span is too short", d)
+	}
+
+	// hold duration is recorded on the request span
+	var request tracetest.SpanStub
+	for _, s := range spans {
+		if s.Name == "request" {
+			request = s
+		}
+	}
+	if len(request.Events) != 1 || request.Events[0].Name != ReleaseEventName {
+		t.Fatal("release event expected, got", request.Events)
+	}
+	ev := request.Events[0]
+	if v := attr(ev.Attributes, WeightKey).AsInt64(); v != 2 {
+		t.Error("unexpected released weight", v)
+	}
+	if v := attr(ev.Attributes, HoldDurationKey).AsFloat64(); v < 0.005 {
+		t.Error("hold duration is too short", v)
+	}
+}
+
+func TestWrap_acquire_outcomes(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(1), WithTracerProvider(tp))
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := sem.Acquire(ctx, 1); err != context.Canceled {
+		t.Error("Error is not context.Canceled")
+	}
+
+	acquires := acquireSpans(exporter.GetSpans())
+	if len(acquires) != 2 {
+		t.Fatal("2 acquire spans expected, got", len(acquires))
+	}
+	for i, outcome := range []string{OutcomeTimedOut, OutcomeCancelled} {
+		if v := attr(acquires[i].Attributes, OutcomeKey).AsString(); v != outcome {
+			t.Error("outcome", outcome, "expected, got", v)
+		}
+		if acquires[i].Status.Code != codes.Error {
+			t.Error("error status expected")
+		}
+	}
+}
+
+func TestWrap_partial_release(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(5), WithTracerProvider(tp))
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	sem.Acquire(ctx, 3)
+	sem.Release(1)
+	sem.Release(2)
+	span.End()
+
+	events := exporter.GetSpans()[0].Events
+	if len(events) != 2 {
+		t.Fatal("2 release events expected, got", len(events))
+	}
+	for i, weight := range []int64{1, 2} {
+		if v := attr(events[i].Attributes, WeightKey).AsInt64(); v != weight {
+			t.Error("released weight", weight, "expected, got", v)
+		}
+	}
+	if sem.GetCount() != 0 {
+		t.Error("semaphore must be released")
+	}
+}
+
+func TestWrap_acquire_ctx_done(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(1), WithTracerProvider(tp))
+
+	// a done context fails even if the semaphore is free, like the wrapped semaphore
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sem.Acquire(ctx, 1); err != context.Canceled {
+		t.Error("Error is not context.Canceled")
+	}
+	if sem.GetCount() != 0 {
+		t.Error("semaphore must not be acquired")
+	}
+	acquires := acquireSpans(exporter.GetSpans())
+	if len(acquires) != 1 {
+		t.Fatal("1 acquire span expected, got", len(acquires))
+	}
+	if v := attr(acquires[0].Attributes, OutcomeKey).AsString(); v != OutcomeCancelled {
+		t.Error("outcome", OutcomeCancelled, "expected, got", v)
+	}
+}
+
+func TestWrap_release_order(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	sem := Wrap("db", semaphore.New(2), WithTracerProvider(tp))
+
+	ctxA, spanA := tp.Tracer("test").Start(context.Background(), "a")
+	ctxB, spanB := tp.Tracer("test").Start(context.Background(), "b")
+	sem.Acquire(ctxA, 1)
+	sem.Acquire(ctxB, 1)
+
+	// b releases first, but its event goes to the oldest acquisition
+	sem.Release(1)
+	spanA.End()
+	spanB.End()
+
+	for _, span := range exporter.GetSpans() {
+		events := len(span.Events)
+		if span.Name == "a" && events != 1 || span.Name == "b" && events != 0 {
+			t.Error("release must be matched in acquisition order, span", span.Name, "has", events, "events")
+		}
+	}
+	sem.Release(1)
+}
+
+func TestWrap_holdings_bounded(t *testing.T) {
+	inner := semaphore.New(MaxHoldings * 2)
+	sem := Wrap("db", inner).(*tracedSemaphore)
+
+	// entries released past the wrapper are forgotten
+	for i := 0; i < 10; i++ {
+		sem.Acquire(nil, 1)
+		inner.Release(1)
+	}
+	if len(sem.holdings) != 1 || sem.held != 1 {
+		t.Error("1 holding expected, got", len(sem.holdings), "of weight", sem.held)
+	}
+
+	// entries acquired past the wrapper keep the count up, the number of holdings is capped
+	inner.Acquire(nil, MaxHoldings)
+	for i := 0; i < MaxHoldings+10; i++ {
+		sem.Acquire(nil, 1)
+		inner.Release(1)
+	}
+	if len(sem.holdings) != MaxHoldings {
+		t.Error(MaxHoldings, "holdings expected, got", len(sem.holdings))
+	}
+}
+
+func TestWrap_conformance(t *testing.T) {
+	tp, _ := newTracerProvider()
+	semaphoretest.Run(t, func(limit int) semaphore.Semaphore {
+		return Wrap("sem", semaphore.New(limit), WithTracerProvider(tp))
+	})
+}
@@ -0,0 +1,291 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoreschedule changes the limit of a semaphore by the time of day,
+// e.g. higher concurrency at night and lower during business hours.
+//
+// A Scheduler has a base limit and rules active during some minutes of the week,
+// given by a cron-like spec or by a daily interval:
+//
+//	rules := []semaphoreschedule.Rule{
+//		{Name: "night", From: "22:00", To: "06:00", Limit: 50},
+//		{Name: "business", Cron: "* 9-16 * * 1-5", Limit: 5},
+//		{Name: "backup", Cron: "0-29 3 * * *", Limit: 1, Priority: 1},
+//	}
+//
+// If active rules overlap, the one with the highest priority wins, of equal ones the first in the list.
+// Rules are matched with minute resolution against the wall clock of the scheduler location.
+package semaphoreschedule // import "github.com/marusama/semaphore/v2/semaphoreschedule"
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// Clock is the time source of the Scheduler, tests can replace it to fast-forward.
+type Clock interface {
+	Now() time.Time
+
+	// After waits for d to elapse and then sends the current time on the returned channel, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Option configures the Scheduler.
+type Option func(*options)
+
+type options struct {
+	location *time.Location
+	clock    Clock
+	onChange func(Change)
+}
+
+// WithLocation sets the time zone of the rules, time.Local by default.
+func WithLocation(loc *time.Location) Option {
+	return func(o *options) {
+		o.location = loc
+	}
+}
+
+// WithClock sets the time source, the system clock by default.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithOnChange sets a function called when the scheduler changes the limit.
+func WithOnChange(f func(Change)) Option {
+	return func(o *options) {
+		o.onChange = f
+	}
+}
+
+// Rule sets the limit while it's active. Either Cron or From and To must be set.
+type Rule struct {
+	// Name identifies the rule in changes and errors.
+	Name string
+
+	// Cron is a cron-like spec of the minutes the rule is active:
+	// "minute hour day-of-month month day-of-week" with *, numbers, ranges, lists and steps,
+	// e.g. "* 9-16 * * 1-5" is active from 9:00 to 16:59 on weekdays.
+	// Sunday is 0 or 7. Like in cron, if both days are restricted, either of them matches.
+	Cron string
+
+	// From and To are a daily interval "15:04", To is excluded.
+	// An interval with To not after From passes midnight, e.g. "22:00" to "06:00".
+	From, To string
+
+	// Days are the days of the week a daily interval starts on, every day by default.
+	Days []time.Weekday
+
+	// Limit is the limit of the semaphore while the rule is active.
+	Limit int
+
+	// Priority decides between overlapping rules, the highest one wins.
+	Priority int
+}
+
+// Change is a limit changed by the Scheduler.
+type Change struct {
+	At       time.Time
+	Rule     string // name of the active rule, empty for the base limit
+	Old, New int
+}
+
+func (c Change) String() string {
+	rule := c.Rule
+	if rule == "" {
+		rule = "base"
+	}
+	return fmt.Sprintf("%s: %s: %d -> %d", c.At.Format(time.RFC3339), rule, c.Old, c.New)
+}
+
+// Scheduler sets the limit of a semaphore according to the rules.
+type Scheduler struct {
+	sem   semaphore.Semaphore
+	base  int
+	rules []rule
+	opts  options
+
+	mu        sync.Mutex
+	scheduled int // last applied scheduled limit, -1 before the first Apply
+}
+
+// rule is a parsed Rule.
+type rule struct {
+	Rule
+	active func(t time.Time) bool
+}
+
+// New creates a Scheduler of sem, the limit is base while no rule is active.
+// It returns an error if a rule is invalid.
+func New(sem semaphore.Semaphore, base int, rules []Rule, opts ...Option) (*Scheduler, error) {
+	if base < 0 {
+		return nil, fmt.Errorf("semaphoreschedule: base limit must not be negative")
+	}
+	o := options{
+		location: time.Local,
+		clock:    realClock{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s := &Scheduler{
+		sem:       sem,
+		base:      base,
+		rules:     make([]rule, len(rules)),
+		opts:      o,
+		scheduled: -1,
+	}
+	for i, r := range rules {
+		active, err := parseRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("semaphoreschedule: rule %d %q: %v", i, r.Name, err)
+		}
+		s.rules[i] = rule{Rule: r, active: active}
+	}
+	return s, nil
+}
+
+func parseRule(r Rule) (func(t time.Time) bool, error) {
+	if r.Limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
+	}
+	switch {
+	case r.Cron != "" && (r.From != "" || r.To != ""):
+		return nil, fmt.Errorf("either cron or daily interval must be set, not both")
+	case r.Cron != "":
+		if len(r.Days) > 0 {
+			return nil, fmt.Errorf("days are set by the cron spec")
+		}
+		c, err := parseCron(r.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return c.match, nil
+	case r.From != "" && r.To != "":
+		return parseDaily(r.From, r.To, r.Days)
+	default:
+		return nil, fmt.Errorf("either cron or daily interval must be set")
+	}
+}
+
+// parseDaily returns a check of the interval from-to starting on days.
+func parseDaily(from, to string, days []time.Weekday) (func(t time.Time) bool, error) {
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return nil, err
+	}
+	onDay := func(time.Weekday) bool { return true }
+	if len(days) > 0 {
+		var set [7]bool
+		for _, d := range days {
+			if d < time.Sunday || d > time.Saturday {
+				return nil, fmt.Errorf("invalid day %d", d)
+			}
+			set[d] = true
+		}
+		onDay = func(d time.Weekday) bool { return set[d] }
+	}
+
+	return func(t time.Time) bool {
+		m := t.Hour()*60 + t.Minute()
+		if start < end {
+			return start <= m && m < end && onDay(t.Weekday())
+		}
+		// passes midnight, the part after it belongs to the previous day
+		return m >= start && onDay(t.Weekday()) ||
+			m < end && onDay((t.Weekday()+6)%7)
+	}, nil
+}
+
+// parseTimeOfDay parses "15:04" to minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid time of day %q, expected \"15:04\"", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// active returns the rule active at t, or nil.
+func (s *Scheduler) active(t time.Time) *rule {
+	t = t.In(s.opts.location)
+	var res *rule
+	for i := range s.rules {
+		r := &s.rules[i]
+		if (res == nil || r.Priority > res.Priority) && r.active(t) {
+			res = r
+		}
+	}
+	return res
+}
+
+// LimitAt returns the scheduled limit at t and the name of the active rule, empty for the base limit.
+func (s *Scheduler) LimitAt(t time.Time) (limit int, rule string) {
+	if r := s.active(t); r != nil {
+		return r.Limit, r.Name
+	}
+	return s.base, ""
+}
+
+// Apply sets the limit scheduled for now, if it differs from the previously scheduled one.
+// A limit changed at runtime by other means is kept until the schedule changes.
+// It returns whether the limit was changed.
+func (s *Scheduler) Apply() bool {
+	now := s.opts.clock.Now()
+	limit, name := s.LimitAt(now)
+
+	s.mu.Lock()
+	if limit == s.scheduled {
+		s.mu.Unlock()
+		return false
+	}
+	s.scheduled = limit
+	old := s.sem.GetLimit()
+	if old != limit {
+		s.sem.SetLimit(limit)
+	}
+	s.mu.Unlock()
+
+	if old == limit {
+		return false
+	}
+	if s.opts.onChange != nil {
+		s.opts.onChange(Change{At: now, Rule: name, Old: old, New: limit})
+	}
+	return true
+}
+
+// Run applies the schedule at the start of every minute until ctx is done, it returns ctx.Err().
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		s.Apply()
+		now := s.opts.clock.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.opts.clock.After(next.Sub(now)):
+		}
+	}
+}
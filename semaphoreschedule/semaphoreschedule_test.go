@@ -0,0 +1,266 @@
+package semaphoreschedule
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// fakeClock is a Clock moved forward by the test.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+
+	// receives on every After call
+	waiting chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now:     now,
+		waiting: make(chan struct{}, 1),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.mu.Lock()
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	c.mu.Unlock()
+	c.waiting <- struct{}{}
+	return ch
+}
+
+// fireNext moves the clock to the earliest timer and fires it.
+func (c *fakeClock) fireNext() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := 0
+	for i, t := range c.timers {
+		if t.at.Before(c.timers[next].at) {
+			next = i
+		}
+	}
+	t := c.timers[next]
+	c.timers = append(c.timers[:next], c.timers[next+1:]...)
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+	t.ch <- c.now
+}
+
+var est = time.FixedZone("EST", -5*60*60)
+
+var testRules = []Rule{
+	{Name: "night", From: "22:00", To: "06:00", Limit: 50},
+	{Name: "business", Cron: "* 9-16 * * 1-5", Limit: 5},
+	{Name: "backup", Cron: "0-29 12 * * *", Limit: 1, Priority: 1},
+}
+
+func TestScheduler_LimitAt(t *testing.T) {
+	s, err := New(semaphore.New(10), 10, testRules, WithLocation(est))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-01 is Monday
+	for _, test := range []struct {
+		at    string
+		limit int
+		rule  string
+	}{
+		{"2024-01-01 00:00", 50, "night"},
+		{"2024-01-01 05:59", 50, "night"},
+		{"2024-01-01 06:00", 10, ""},
+		{"2024-01-01 09:00", 5, "business"},
+		{"2024-01-01 12:00", 1, "backup"},
+		{"2024-01-01 12:29", 1, "backup"},
+		{"2024-01-01 12:30", 5, "business"},
+		{"2024-01-01 16:59", 5, "business"},
+		{"2024-01-01 17:00", 10, ""},
+		{"2024-01-01 22:00", 50, "night"},
+		{"2024-01-06 10:00", 10, ""}, // Saturday
+		{"2024-01-06 12:15", 1, "backup"},
+	} {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", test.at, est)
+		if limit, rule := s.LimitAt(at); limit != test.limit || rule != test.rule {
+			t.Error(test.at, "limit", test.limit, test.rule, "expected, got", limit, rule)
+		}
+	}
+
+	// time zone of the scheduler, not of the time
+	at := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC) // 9:00 EST
+	if limit, _ := s.LimitAt(at); limit != 5 {
+		t.Error("limit 5 expected, got", limit)
+	}
+}
+
+func TestScheduler_rules(t *testing.T) {
+	for _, test := range []struct {
+		rule    Rule
+		active  []string
+		passive []string
+	}{
+		{
+			Rule{From: "22:00", To: "02:00", Days: []time.Weekday{time.Friday}},
+			[]string{"2024-01-05 22:00", "2024-01-05 23:59", "2024-01-06 01:59"},
+			[]string{"2024-01-05 01:00", "2024-01-06 02:00", "2024-01-06 23:00"},
+		},
+		{
+			Rule{From: "08:00", To: "08:00"}, // all day
+			[]string{"2024-01-05 08:00", "2024-01-05 00:00", "2024-01-05 07:59"},
+			nil,
+		},
+		{
+			Rule{Cron: "*/15 * * * *"},
+			[]string{"2024-01-05 10:00", "2024-01-05 10:15", "2024-01-05 10:45"},
+			[]string{"2024-01-05 10:01", "2024-01-05 10:50"},
+		},
+		{
+			Rule{Cron: "5/20,59 * * * *"},
+			[]string{"2024-01-05 10:05", "2024-01-05 10:25", "2024-01-05 10:45", "2024-01-05 10:59"},
+			[]string{"2024-01-05 10:00", "2024-01-05 10:20"},
+		},
+		{
+			// day of month or day of week
+			Rule{Cron: "* * 1 * 7"},
+			[]string{"2024-01-01 10:00", "2024-01-07 10:00"},
+			[]string{"2024-01-02 10:00"},
+		},
+		{
+			Rule{Cron: "* 0-2,22-23 * 6-8 1-5"},
+			[]string{"2024-07-01 23:00", "2024-06-03 01:00"},
+			[]string{"2024-07-01 03:00", "2024-07-06 23:00", "2024-05-06 23:00"},
+		},
+	} {
+		test.rule.Limit = 1
+		s, err := New(semaphore.New(0), 0, []Rule{test.rule}, WithLocation(time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, at := range test.active {
+			tm, _ := time.Parse("2006-01-02 15:04", at)
+			if limit, _ := s.LimitAt(tm); limit != 1 {
+				t.Error(test.rule, "must be active at", at)
+			}
+		}
+		for _, at := range test.passive {
+			tm, _ := time.Parse("2006-01-02 15:04", at)
+			if limit, _ := s.LimitAt(tm); limit != 0 {
+				t.Error(test.rule, "must not be active at", at)
+			}
+		}
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	for _, r := range []Rule{
+		{},
+		{Cron: "* * * *"},
+		{Cron: "60 * * * *"},
+		{Cron: "* 5-3 * * *"},
+		{Cron: "*/0 * * * *"},
+		{Cron: "x * * * *"},
+		{Cron: "* * 0 * *"},
+		{Cron: "* * * * *", From: "10:00", To: "11:00"},
+		{Cron: "* * * * *", Days: []time.Weekday{time.Monday}},
+		{From: "10:00"},
+		{From: "24:00", To: "01:00"},
+		{From: "10:00", To: "1100"},
+		{From: "10:00", To: "11:00", Days: []time.Weekday{7}},
+		{Cron: "* * * * *", Limit: -1},
+	} {
+		if _, err := New(semaphore.New(1), 1, []Rule{r}); err == nil {
+			t.Errorf("%+v: error expected", r)
+		}
+	}
+	if _, err := New(semaphore.New(1), -1, nil); err == nil {
+		t.Error("error expected for negative base limit")
+	}
+}
+
+func TestScheduler_Apply(t *testing.T) {
+	sem := semaphore.New(10)
+	clock := newFakeClock(time.Date(2024, 1, 1, 10, 0, 0, 0, est))
+	s, _ := New(sem, 10, testRules, WithLocation(est), WithClock(clock))
+
+	if !s.Apply() || sem.GetLimit() != 5 {
+		t.Fatal("limit 5 expected, got", sem.GetLimit())
+	}
+
+	// a runtime change is kept until the schedule changes
+	sem.SetLimit(7)
+	if s.Apply() || sem.GetLimit() != 7 {
+		t.Error("limit 7 expected, got", sem.GetLimit())
+	}
+	clock.now = time.Date(2024, 1, 1, 12, 0, 0, 0, est)
+	if !s.Apply() || sem.GetLimit() != 1 {
+		t.Error("limit 1 expected, got", sem.GetLimit())
+	}
+}
+
+func TestScheduler_Run_day(t *testing.T) {
+	sem := semaphore.New(10)
+	start := time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC) // Monday 0:00 EST
+	clock := newFakeClock(start)
+
+	var changes []Change
+	s, err := New(sem, 10, testRules,
+		WithLocation(est),
+		WithClock(clock),
+		WithOnChange(func(c Change) { changes = append(changes, c) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	for i := 0; i < 24*60; i++ {
+		<-clock.waiting
+		clock.fireNext()
+	}
+	<-clock.waiting
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("context.Canceled expected, got", err)
+	}
+
+	at := func(hour, min int) time.Time {
+		return start.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+	expected := []Change{
+		{at(0, 0), "night", 10, 50},
+		{at(6, 0), "", 50, 10},
+		{at(9, 0), "business", 10, 5},
+		{at(12, 0), "backup", 5, 1},
+		{at(12, 30), "business", 1, 5},
+		{at(17, 0), "", 5, 10},
+		{at(22, 0), "night", 10, 50},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Error("changes", expected, "expected, got", changes)
+	}
+	if sem.GetLimit() != 50 {
+		t.Error("limit 50 expected, got", sem.GetLimit())
+	}
+}
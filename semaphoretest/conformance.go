@@ -0,0 +1,586 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoretest
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// blockTimeout is how long an Acquire must stay blocked to be considered blocked.
+const blockTimeout = 20 * time.Millisecond
+
+// wakeTimeout is how long a blocked Acquire may take to return after it's unblocked.
+const wakeTimeout = 10 * time.Second
+
+// Run runs the conformance suite of the Semaphore interface against semaphores created by newSem
+// with the given limit, each test creates its own semaphore. The suite covers weighted acquisition,
+// panics on invalid arguments, context cancellation, SetLimit semantics including waking up waiters,
+// stress over the limit and linearizability of concurrent histories, see CheckLinearizable.
+//
+// It doesn't require Release without Acquire to panic, as the interface doesn't promise it.
+// With -short the stress tests run fewer iterations.
+func Run(t *testing.T, newSem func(limit int) semaphore.Semaphore, opts ...Option) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	tests := []struct {
+		name string
+		f    func(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options)
+	}{
+		{"New", testNew},
+		{"Acquire_weighted", testAcquireWeighted},
+		{"TryAcquire", testTryAcquire},
+		{"Release_previous_count", testReleasePreviousCount},
+		{"invalid_arguments_panic", testInvalidArgumentsPanic},
+		{"Acquire_ctx_done", testAcquireCtxDone},
+		{"Acquire_waits_for_Release", testAcquireWaitsForRelease},
+		{"Acquire_weighted_waits", testAcquireWeightedWaits},
+		{"SetLimit", testSetLimit},
+		{"SetLimit_increase_broadcast", testSetLimitIncreaseBroadcast},
+		{"SetLimit_decrease", testSetLimitDecrease},
+		{"stress_over_limit", testStressOverLimit},
+		{"stress_SetLimit", testStressSetLimit},
+		{"stress_ctx_done", testStressCtxDone},
+		{"broadcast_race", testBroadcastRace},
+		{"weighted_acquire_gt_release", testWeightedAcquireGtRelease},
+		{"linearizable", testLinearizable},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, newSem, o)
+		})
+	}
+}
+
+// Option configures Run.
+type Option func(*options)
+
+type options struct {
+	releaseLowerBound bool
+}
+
+// WithReleaseLowerBound accepts any result of Release between n and the previous count,
+// for semaphores documenting that Release returns a lower bound of the previous count.
+func WithReleaseLowerBound() Option {
+	return func(o *options) {
+		o.releaseLowerBound = true
+	}
+}
+
+func checkLimitAndCount(t *testing.T, sem semaphore.Semaphore, expectedLimit, expectedCount int) {
+	t.Helper()
+	if limit := sem.GetLimit(); limit != expectedLimit {
+		t.Error("semaphore must have limit = ", expectedLimit, ", but has ", limit)
+	}
+	if count := sem.GetCount(); count != expectedCount {
+		t.Error("semaphore must have count = ", expectedCount, ", but has ", count)
+	}
+}
+
+func checkPreviousCount(t *testing.T, o *options, n, expected, oldCnt int) {
+	t.Helper()
+	if o.releaseLowerBound {
+		if oldCnt < n || oldCnt > expected {
+			t.Error("semaphore must have old count between ", n, " and ", expected, ", but has ", oldCnt)
+		}
+	} else if oldCnt != expected {
+		t.Error("semaphore must have old count = ", expected, ", but has ", oldCnt)
+	}
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Error("Panic expected:", name)
+		}
+	}()
+	f()
+}
+
+// acquireAsync starts Acquire in a new goroutine and returns the channel receiving its result.
+func acquireAsync(ctx context.Context, sem semaphore.Semaphore, n int) <-chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- sem.Acquire(ctx, n)
+	}()
+	return res
+}
+
+func expectBlocked(t *testing.T, res <-chan error) {
+	t.Helper()
+	select {
+	case err := <-res:
+		t.Fatal("Acquire must block, but returned", err)
+	case <-time.After(blockTimeout):
+	}
+}
+
+func expectAcquired(t *testing.T, res <-chan error, expected error) {
+	t.Helper()
+	select {
+	case err := <-res:
+		if err != expected {
+			t.Fatalf("Acquire must return %v, but returned %v", expected, err)
+		}
+	case <-time.After(wakeTimeout):
+		t.Fatal("Acquire is not woken up")
+	}
+}
+
+// iterations shortens stress tests in -short mode.
+func iterations(n int) int {
+	if testing.Short() {
+		return n / 10
+	}
+	return n
+}
+
+func testNew(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	for _, limit := range []int{0, 1, 5} {
+		checkLimitAndCount(t, newSem(limit), limit, 0)
+	}
+}
+
+func testAcquireWeighted(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(5)
+
+	if err := sem.Acquire(nil, 2); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 2)
+
+	if err := sem.Acquire(context.Background(), 3); err != nil {
+		t.Fatal("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 5)
+
+	checkPreviousCount(t, o, 3, 5, sem.Release(3))
+	checkPreviousCount(t, o, 2, 2, sem.Release(2))
+	checkLimitAndCount(t, sem, 5, 0)
+}
+
+func testTryAcquire(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(3)
+
+	if sem.TryAcquire(4) {
+		t.Error("TryAcquire over the limit must fail")
+	}
+	checkLimitAndCount(t, sem, 3, 0)
+
+	if !sem.TryAcquire(2) {
+		t.Error("TryAcquire under the limit must succeed")
+	}
+	checkLimitAndCount(t, sem, 3, 2)
+
+	if sem.TryAcquire(2) {
+		t.Error("TryAcquire over the limit must fail")
+	}
+	checkLimitAndCount(t, sem, 3, 2)
+
+	if !sem.TryAcquire(1) {
+		t.Error("TryAcquire up to the limit must succeed")
+	}
+	checkLimitAndCount(t, sem, 3, 3)
+	sem.Release(3)
+}
+
+func testReleasePreviousCount(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(2)
+	sem.Acquire(nil, 1)
+	sem.Acquire(nil, 1)
+	checkPreviousCount(t, o, 1, 2, sem.Release(1))
+	checkLimitAndCount(t, sem, 2, 1)
+	checkPreviousCount(t, o, 1, 1, sem.Release(1))
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+func testInvalidArgumentsPanic(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	expectPanic(t, "negative limit", func() { newSem(-1) })
+
+	sem := newSem(1)
+	expectPanic(t, "Acquire(0)", func() { sem.Acquire(nil, 0) })
+	expectPanic(t, "Acquire(-1)", func() { sem.Acquire(context.Background(), -1) })
+	expectPanic(t, "TryAcquire(0)", func() { sem.TryAcquire(0) })
+	expectPanic(t, "TryAcquire(-1)", func() { sem.TryAcquire(-1) })
+
+	sem.Acquire(nil, 1)
+	expectPanic(t, "Release(0)", func() { sem.Release(0) })
+	expectPanic(t, "Release(-1)", func() { sem.Release(-1) })
+	expectPanic(t, "SetLimit(-1)", func() { sem.SetLimit(-1) })
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func testAcquireCtxDone(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(1)
+	sem.Acquire(nil, 1)
+
+	// already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sem.Acquire(ctx, 1); err != context.Canceled {
+		t.Error("Error is not context.Canceled:", err)
+	}
+
+	// cancelled while waiting
+	ctx, cancel = context.WithCancel(context.Background())
+	res := acquireAsync(ctx, sem, 1)
+	expectBlocked(t, res)
+	cancel()
+	expectAcquired(t, res, context.Canceled)
+
+	// timed out while waiting
+	ctx, cancel = context.WithTimeout(context.Background(), blockTimeout)
+	defer cancel()
+	expectAcquired(t, acquireAsync(ctx, sem, 1), context.DeadlineExceeded)
+
+	checkLimitAndCount(t, sem, 1, 1)
+	sem.Release(1)
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func testAcquireWaitsForRelease(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(1)
+	sem.Acquire(nil, 1)
+
+	res := acquireAsync(nil, sem, 1)
+	expectBlocked(t, res)
+	sem.Release(1)
+	expectAcquired(t, res, nil)
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func testAcquireWeightedWaits(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(3)
+	sem.Acquire(nil, 1)
+	sem.Acquire(nil, 1)
+
+	res := acquireAsync(nil, sem, 3)
+	expectBlocked(t, res)
+
+	// 1 + 3 is still over the limit
+	sem.Release(1)
+	expectBlocked(t, res)
+
+	sem.Release(1)
+	expectAcquired(t, res, nil)
+	checkLimitAndCount(t, sem, 3, 3)
+}
+
+func testSetLimit(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(0)
+	checkLimitAndCount(t, sem, 0, 0)
+
+	sem.SetLimit(2)
+	checkLimitAndCount(t, sem, 2, 0)
+
+	sem.Acquire(nil, 1)
+	sem.SetLimit(3)
+	checkLimitAndCount(t, sem, 3, 1)
+
+	sem.SetLimit(1)
+	checkLimitAndCount(t, sem, 1, 1)
+
+	sem.Release(1)
+	sem.SetLimit(0)
+	checkLimitAndCount(t, sem, 0, 0)
+}
+
+func testSetLimitIncreaseBroadcast(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(1)
+	sem.Acquire(nil, 1)
+
+	res1 := acquireAsync(nil, sem, 1)
+	res2 := acquireAsync(nil, sem, 2)
+	expectBlocked(t, res1)
+	expectBlocked(t, res2)
+
+	// both waiters fit into the new limit
+	sem.SetLimit(4)
+	expectAcquired(t, res1, nil)
+	expectAcquired(t, res2, nil)
+	checkLimitAndCount(t, sem, 4, 4)
+
+	// limit 0 blocks everybody
+	sem.Release(4)
+	sem.SetLimit(0)
+	res := acquireAsync(nil, sem, 1)
+	expectBlocked(t, res)
+	sem.SetLimit(1)
+	expectAcquired(t, res, nil)
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func testSetLimitDecrease(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(3)
+	sem.Acquire(nil, 3)
+
+	// held entries stay held over the new limit
+	sem.SetLimit(1)
+	checkLimitAndCount(t, sem, 1, 3)
+	if sem.TryAcquire(1) {
+		t.Error("TryAcquire over the limit must fail")
+	}
+
+	res := acquireAsync(nil, sem, 1)
+	expectBlocked(t, res)
+
+	// count 2 >= limit 1
+	sem.Release(1)
+	expectBlocked(t, res)
+
+	sem.Release(2)
+	expectAcquired(t, res, nil)
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func testStressOverLimit(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	const limit = 3
+	sem := newSem(limit)
+	var inUse int32
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-c
+			n := i%limit + 1
+			for j := 0; j < iterations(1000); j++ {
+				if j%2 == 0 {
+					if err := sem.Acquire(nil, n); err != nil {
+						t.Error("Error returned:", err.Error())
+						return
+					}
+				} else if !sem.TryAcquire(n) {
+					continue
+				}
+				if atomic.AddInt32(&inUse, int32(n)) > limit {
+					t.Error("entries in use exceed the limit")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&inUse, -int32(n))
+				sem.Release(n)
+			}
+		}(i)
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkLimitAndCount(t, sem, limit, 0)
+}
+
+func testStressSetLimit(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(1)
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-c
+			for j := 0; j < iterations(1000); j++ {
+				if err := sem.Acquire(nil, 1); err != nil {
+					t.Error("Error returned:", err.Error())
+					return
+				}
+				runtime.Gosched()
+				sem.Release(1)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-c
+		rnd := rand.New(rand.NewSource(1))
+		for {
+			select {
+			case <-stop:
+				// let the remaining waiters finish
+				sem.SetLimit(1)
+				return
+			default:
+			}
+			sem.SetLimit(rnd.Intn(20)) // range [0, 19]
+			runtime.Gosched()
+		}
+	}()
+
+	close(c) // start
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	// limit 0 might be the last one set, so keep changing it until all goroutines are done
+	<-done
+	close(stop)
+	<-stopped
+
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func testStressCtxDone(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	sem := newSem(2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(iterations(500))*time.Millisecond)
+	defer cancel()
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-c
+			n := i%2 + 1
+			for {
+				err := sem.Acquire(ctx, n)
+				if err != nil {
+					if err != context.DeadlineExceeded {
+						t.Error("Error is not context.DeadlineExceeded:", err)
+					}
+					return
+				}
+				runtime.Gosched()
+				sem.Release(n)
+			}
+		}(i)
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkLimitAndCount(t, sem, 2, 0)
+}
+
+// testBroadcastRace checks that the last goroutine of a short contention doesn't hang.
+func testBroadcastRace(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	for run := 0; run < iterations(500); run++ {
+		sem := newSem(1)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					runtime.Gosched()
+					if err := sem.Acquire(context.Background(), 1); err != nil {
+						t.Error(err)
+						return
+					}
+					sem.Release(1)
+				}
+			}()
+		}
+		waitGroupTimeout(t, &wg)
+	}
+}
+
+// testWeightedAcquireGtRelease checks that a heavy waiter is woken up by many light releases.
+func testWeightedAcquireGtRelease(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	const limit = 100
+	for run := 0; run < iterations(500); run++ {
+		sem := newSem(limit)
+		releaseCh := make(chan struct{})
+		for i := 0; i < limit; i++ {
+			sem.Acquire(nil, 1)
+			go func() {
+				<-releaseCh
+				sem.Release(1)
+			}()
+		}
+		close(releaseCh)
+		expectAcquired(t, acquireAsync(context.Background(), sem, 10), nil)
+	}
+}
+
+func testLinearizable(t *testing.T, newSem func(limit int) semaphore.Semaphore, o *options) {
+	for round := 0; round < iterations(20); round++ {
+		rec := NewRecorder(newSem(3))
+		randomOps(rec, 8, 200, int64(round*100))
+		if err := checkLinearizable(rec.limit, rec.count, rec.History(), o.releaseLowerBound); err != nil {
+			t.Fatal(err)
+		}
+		if count := rec.GetCount(); count != 0 {
+			t.Fatal("semaphore must have count = 0, but has", count)
+		}
+	}
+}
+
+// randomOps runs random operations on rec from many goroutines.
+func randomOps(rec *Recorder, goroutines, ops int, seed int64) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed + int64(i)))
+			held := 0
+			for j := 0; j < ops; j++ {
+				n := rnd.Intn(2) + 1
+				switch k := rnd.Intn(10); {
+				case k < 3:
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rnd.Intn(100))*time.Microsecond)
+					if rec.Acquire(ctx, n) == nil {
+						held += n
+					}
+					cancel()
+				case k < 5:
+					if rec.TryAcquire(n) {
+						held += n
+					}
+				case k < 8:
+					if held > 0 {
+						n = rnd.Intn(held) + 1
+						rec.Release(n)
+						held -= n
+					}
+				case k < 9:
+					rec.GetCount()
+				default:
+					if i == 0 {
+						rec.SetLimit(rnd.Intn(4) + 1)
+					} else {
+						rec.GetLimit()
+					}
+				}
+			}
+			if held > 0 {
+				rec.Release(held)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func waitGroupTimeout(t *testing.T, wg *sync.WaitGroup) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wakeTimeout):
+		t.Fatal("goroutines are not done, Acquire hangs")
+	}
+}
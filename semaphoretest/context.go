@@ -0,0 +1,81 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoretest
+
+import (
+	"context"
+	"time"
+)
+
+// simContext is a context cancelled by virtual goroutines or by the virtual clock.
+type simContext struct {
+	context.Context // parent, for values
+
+	done     chan struct{}
+	err      error
+	deadline time.Time
+	timer    *timer
+	children []*simContext
+}
+
+// WithCancel is like context.WithCancel, cancellation by a simulated parent is propagated.
+func (s *Sim) WithCancel(parent context.Context) (context.Context, context.CancelFunc) {
+	c := s.newContext(parent)
+	return c, func() { c.cancel(context.Canceled) }
+}
+
+// WithTimeout is like context.WithTimeout, but the deadline is in the virtual time.
+func (s *Sim) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	c := s.newContext(parent)
+	c.deadline = s.now.Add(d)
+	if c.err == nil {
+		c.timer = s.afterFunc(d, func() { c.cancel(context.DeadlineExceeded) })
+	}
+	return c, func() { c.cancel(context.Canceled) }
+}
+
+func (s *Sim) newContext(parent context.Context) *simContext {
+	c := &simContext{
+		Context: parent,
+		done:    make(chan struct{}),
+	}
+	if p, ok := parent.(*simContext); ok {
+		if p.err != nil {
+			c.cancel(p.err)
+		} else {
+			p.children = append(p.children, c)
+		}
+	}
+	return c
+}
+
+func (c *simContext) cancel(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.stopped = true
+	}
+	for _, child := range c.children {
+		child.cancel(err)
+	}
+}
+
+func (c *simContext) Deadline() (time.Time, bool) {
+	if !c.deadline.IsZero() {
+		return c.deadline, true
+	}
+	return c.Context.Deadline()
+}
+
+func (c *simContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *simContext) Err() error {
+	return c.err
+}
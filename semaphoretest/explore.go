@@ -0,0 +1,147 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoretest
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Scenario sets up semaphores and virtual goroutines of a simulation.
+// It's called once for every explored interleaving, so it must not keep state between calls.
+type Scenario func(sim *Sim)
+
+// Explore runs the scenario with runs random schedules seeded by seed, seed+1, ...
+// and fails t on the first failing run, reporting how to reproduce it.
+func Explore(t testing.TB, seed int64, runs int, scenario Scenario) {
+	t.Helper()
+	for i := 0; i < runs; i++ {
+		c := &randomChooser{rng: rand.New(rand.NewSource(seed + int64(i)))}
+		if err := runScenario(c, scenario); err != nil {
+			t.Fatalf("seed %d: %v\nreproduce with semaphoretest.Explore(t, %d, 1, scenario) or semaphoretest.Replay(t, %q, scenario)",
+				seed+int64(i), err, seed+int64(i), c.schedule())
+		}
+	}
+}
+
+// ExploreAll runs the scenario with every possible schedule, up to maxRuns of them,
+// fails t on the first failing run and returns the number of explored schedules.
+func ExploreAll(t testing.TB, maxRuns int, scenario Scenario) int {
+	t.Helper()
+	var prefix []int
+	for runs := 1; ; runs++ {
+		c := &prefixChooser{prefix: prefix}
+		if err := runScenario(c, scenario); err != nil {
+			t.Fatalf("schedule %q: %v\nreproduce with semaphoretest.Replay(t, %q, scenario)", c.schedule(), err, c.schedule())
+		}
+		if c.err != nil {
+			t.Fatal(c.err)
+		}
+
+		// depth first: the next schedule changes the last choice that has untried options
+		i := len(c.choices) - 1
+		for i >= 0 && c.choices[i]+1 >= c.options[i] {
+			i--
+		}
+		if i < 0 || runs >= maxRuns {
+			return runs
+		}
+		prefix = append(append([]int(nil), c.choices[:i]...), c.choices[i]+1)
+	}
+}
+
+// Replay runs the scenario with the schedule reported by Explore or ExploreAll and fails t if the run fails.
+func Replay(t testing.TB, schedule string, scenario Scenario) {
+	t.Helper()
+	var prefix []int
+	if schedule != "" {
+		for _, s := range strings.Split(schedule, ".") {
+			choice, err := strconv.Atoi(s)
+			if err != nil {
+				t.Fatalf("invalid schedule %q: %v", schedule, err)
+			}
+			prefix = append(prefix, choice)
+		}
+	}
+	c := &prefixChooser{prefix: prefix}
+	if err := runScenario(c, scenario); err != nil {
+		t.Fatalf("schedule %q: %v", schedule, err)
+	}
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+}
+
+func runScenario(c chooser, scenario Scenario) error {
+	sim := newSim(c)
+	scenario(sim)
+	return sim.run()
+}
+
+// chooser makes the scheduling choices of a simulation.
+type chooser interface {
+	// choose returns a number in [0, n)
+	choose(n int) int
+}
+
+// choiceLog records choices having more than one option, they make the schedule of a run.
+type choiceLog struct {
+	choices []int
+	options []int
+}
+
+func (c *choiceLog) record(choice, n int) int {
+	c.choices = append(c.choices, choice)
+	c.options = append(c.options, n)
+	return choice
+}
+
+// schedule encodes the choices as a string accepted by Replay.
+func (c *choiceLog) schedule() string {
+	s := make([]string, len(c.choices))
+	for i, choice := range c.choices {
+		s[i] = strconv.Itoa(choice)
+	}
+	return strings.Join(s, ".")
+}
+
+type randomChooser struct {
+	choiceLog
+	rng *rand.Rand
+}
+
+func (c *randomChooser) choose(n int) int {
+	if n == 1 {
+		return 0
+	}
+	return c.record(c.rng.Intn(n), n)
+}
+
+// prefixChooser makes the choices of the prefix and then always chooses the first option.
+type prefixChooser struct {
+	choiceLog
+	prefix []int
+	err    error
+}
+
+func (c *prefixChooser) choose(n int) int {
+	if n == 1 {
+		return 0
+	}
+	choice := 0
+	if i := len(c.choices); i < len(c.prefix) {
+		choice = c.prefix[i]
+		if choice >= n {
+			if c.err == nil {
+				c.err = fmt.Errorf("schedule doesn't match the scenario: choice %d of %d options at step %d", choice, n, i)
+			}
+			choice = 0
+		}
+	}
+	return c.record(choice, n)
+}
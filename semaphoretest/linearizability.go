@@ -0,0 +1,356 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphoretest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+// OpKind is a kind of recorded semaphore operation.
+type OpKind int
+
+// Recorded operations, one per method of semaphore.Semaphore.
+const (
+	OpAcquire OpKind = iota
+	OpTryAcquire
+	OpRelease
+	OpSetLimit
+	OpGetLimit
+	OpGetCount
+)
+
+var opNames = [...]string{"Acquire", "TryAcquire", "Release", "SetLimit", "GetLimit", "GetCount"}
+
+func (k OpKind) String() string {
+	if k >= 0 && int(k) < len(opNames) {
+		return opNames[k]
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// Operation is a completed call of a semaphore method.
+type Operation struct {
+	Kind OpKind
+
+	// N is the argument of Acquire, TryAcquire, Release and SetLimit
+	N int
+
+	// Result is the result of Release, GetLimit and GetCount
+	Result int
+	// OK is the result of TryAcquire
+	OK bool
+	// Err is the result of Acquire
+	Err error
+
+	// Call and Return are logical timestamps of the call and the return:
+	// if a.Return < b.Call, then a completed before b started.
+	Call, Return int64
+}
+
+func (op Operation) String() string {
+	var s string
+	switch op.Kind {
+	case OpAcquire:
+		s = fmt.Sprintf("Acquire(%d) = %v", op.N, op.Err)
+	case OpTryAcquire:
+		s = fmt.Sprintf("TryAcquire(%d) = %t", op.N, op.OK)
+	case OpRelease:
+		s = fmt.Sprintf("Release(%d) = %d", op.N, op.Result)
+	case OpSetLimit:
+		s = fmt.Sprintf("SetLimit(%d)", op.N)
+	default:
+		s = fmt.Sprintf("%s() = %d", op.Kind, op.Result)
+	}
+	return fmt.Sprintf("%s [%d, %d]", s, op.Call, op.Return)
+}
+
+// Recorder is a semaphore.Semaphore recording the history of operations on the wrapped semaphore.
+// Only operations made through the Recorder are recorded, the wrapped semaphore must not be used directly
+// while recording. Calls that panic are not recorded.
+type Recorder struct {
+	sem          semaphore.Semaphore
+	limit, count int
+
+	clock int64
+
+	mu      sync.Mutex
+	history []Operation
+}
+
+// NewRecorder starts recording operations on sem, its current limit and count are the initial state of the history.
+func NewRecorder(sem semaphore.Semaphore) *Recorder {
+	return &Recorder{
+		sem:   sem,
+		limit: sem.GetLimit(),
+		count: sem.GetCount(),
+	}
+}
+
+func (r *Recorder) tick() int64 {
+	return atomic.AddInt64(&r.clock, 1)
+}
+
+func (r *Recorder) record(op Operation) {
+	op.Return = r.tick()
+	r.mu.Lock()
+	r.history = append(r.history, op)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) Acquire(ctx context.Context, n int) error {
+	op := Operation{Kind: OpAcquire, N: n, Call: r.tick()}
+	op.Err = r.sem.Acquire(ctx, n)
+	r.record(op)
+	return op.Err
+}
+
+func (r *Recorder) TryAcquire(n int) bool {
+	op := Operation{Kind: OpTryAcquire, N: n, Call: r.tick()}
+	op.OK = r.sem.TryAcquire(n)
+	r.record(op)
+	return op.OK
+}
+
+func (r *Recorder) Release(n int) int {
+	op := Operation{Kind: OpRelease, N: n, Call: r.tick()}
+	op.Result = r.sem.Release(n)
+	r.record(op)
+	return op.Result
+}
+
+func (r *Recorder) SetLimit(limit int) {
+	op := Operation{Kind: OpSetLimit, N: limit, Call: r.tick()}
+	r.sem.SetLimit(limit)
+	r.record(op)
+}
+
+func (r *Recorder) GetLimit() int {
+	op := Operation{Kind: OpGetLimit, Call: r.tick()}
+	op.Result = r.sem.GetLimit()
+	r.record(op)
+	return op.Result
+}
+
+func (r *Recorder) GetCount() int {
+	op := Operation{Kind: OpGetCount, Call: r.tick()}
+	op.Result = r.sem.GetCount()
+	r.record(op)
+	return op.Result
+}
+
+// History returns the operations completed so far.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation(nil), r.history...)
+}
+
+// Check checks the history recorded so far, see CheckLinearizable.
+// Operations still in progress are not checked, so call it when the goroutines using the Recorder are done.
+func (r *Recorder) Check() error {
+	return CheckLinearizable(r.limit, r.count, r.History())
+}
+
+// ErrNotLinearizable is returned by CheckLinearizable if the history can't be explained by a sequential semaphore.
+var ErrNotLinearizable = errors.New("semaphoretest: history is not linearizable")
+
+// model is the state of a sequential counting semaphore.
+type model struct {
+	limit, count int
+
+	// releaseLowerBound accepts results of Release between n and the count
+	releaseLowerBound bool
+}
+
+// step applies op to the model, it reports false if op couldn't return its results in state m.
+func (m model) step(op *Operation) (model, bool) {
+	switch op.Kind {
+	case OpAcquire:
+		if op.Err != nil {
+			// cancelled Acquire leaves the semaphore unchanged
+			return m, true
+		}
+		if m.count+op.N > m.limit {
+			return m, false
+		}
+		m.count += op.N
+	case OpTryAcquire:
+		if m.count+op.N > m.limit {
+			return m, !op.OK
+		}
+		if !op.OK {
+			return m, false
+		}
+		m.count += op.N
+	case OpRelease:
+		if m.count < op.N {
+			return m, false
+		}
+		if m.releaseLowerBound {
+			if op.Result < op.N || op.Result > m.count {
+				return m, false
+			}
+		} else if op.Result != m.count {
+			return m, false
+		}
+		m.count -= op.N
+	case OpSetLimit:
+		m.limit = op.N
+	case OpGetLimit:
+		return m, op.Result == m.limit
+	case OpGetCount:
+		return m, op.Result == m.count
+	}
+	return m, true
+}
+
+// event is a call or a return of an operation in the doubly linked list of the WGL algorithm.
+type event struct {
+	op         int
+	time       int64
+	call       bool
+	match      *event // return event of a call event
+	prev, next *event
+}
+
+// lift removes the call event and its return event from the list.
+func (e *event) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts the lifted call event and its return event back to the list.
+func (e *event) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// CheckLinearizable checks that the history of a semaphore with the initial limit and count is linearizable:
+// every operation can be ordered at some point between its call and its return,
+// so that the results match a sequential counting semaphore. An Acquire returning an error must not take entries.
+// It uses the Wing & Gong search with the memoization by Lowe. It returns nil or an error wrapping ErrNotLinearizable.
+func CheckLinearizable(limit, count int, ops []Operation) error {
+	return checkLinearizable(limit, count, ops, false)
+}
+
+// checkLinearizable is CheckLinearizable optionally accepting a lower bound of the previous count from Release.
+func checkLinearizable(limit, count int, ops []Operation, releaseLowerBound bool) error {
+	events := make([]*event, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := &event{op: i, time: op.Return}
+		call := &event{op: i, time: op.Call, call: true, match: ret}
+		events = append(events, call, ret)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time < events[j].time
+	})
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		e.prev = prev
+		prev.next = e
+		prev = e
+	}
+
+	type frame struct {
+		e     *event
+		state model
+	}
+	var (
+		stack      []frame
+		state      = model{limit: limit, count: count, releaseLowerBound: releaseLowerBound}
+		linearized = make([]uint64, (len(ops)+63)/64)
+		cache      = make(map[string]struct{})
+		deepest    []int
+		stuck      int
+	)
+	buf := make([]byte, 8*len(linearized)+16)
+	key := func(m model) string {
+		for i, w := range linearized {
+			binary.LittleEndian.PutUint64(buf[8*i:], w)
+		}
+		binary.LittleEndian.PutUint64(buf[len(buf)-16:], uint64(m.limit))
+		binary.LittleEndian.PutUint64(buf[len(buf)-8:], uint64(m.count))
+		return string(buf)
+	}
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			if next, ok := state.step(&ops[e.op]); ok {
+				linearized[e.op/64] |= 1 << uint(e.op%64)
+				k := key(next)
+				if _, seen := cache[k]; !seen {
+					cache[k] = struct{}{}
+					stack = append(stack, frame{e, state})
+					state = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized[e.op/64] &^= 1 << uint(e.op%64)
+			}
+			e = e.next
+			continue
+		}
+
+		// the operation returned before any of the pending ones could be linearized, backtrack
+		if deepest == nil || len(stack) > len(deepest) {
+			deepest = make([]int, len(stack))
+			for i, f := range stack {
+				deepest[i] = f.e.op
+			}
+			stuck = e.op
+		}
+		if len(stack) == 0 {
+			return notLinearizable(ops, state, deepest, stuck)
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		linearized[f.e.op/64] &^= 1 << uint(f.e.op%64)
+		f.e.unlift()
+		e = f.e.next
+	}
+	return nil
+}
+
+// notLinearizable describes the longest linearizable prefix found by the search.
+func notLinearizable(ops []Operation, m model, prefix []int, stuck int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "initial limit %d, count %d", m.limit, m.count)
+	done := make(map[int]bool, len(prefix))
+	for _, i := range prefix {
+		m, _ = m.step(&ops[i])
+		done[i] = true
+		fmt.Fprintf(&b, "\n\t%v -> limit %d, count %d", ops[i], m.limit, m.count)
+	}
+	fmt.Fprintf(&b, "\nthen none of the pending operations can be linearized before %v returns:", ops[stuck])
+	for i, op := range ops {
+		if !done[i] && op.Call < ops[stuck].Return {
+			fmt.Fprintf(&b, "\n\t%v", op)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotLinearizable, b.String())
+}
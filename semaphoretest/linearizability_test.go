@@ -0,0 +1,237 @@
+package semaphoretest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+)
+
+func TestCheckLinearizable(t *testing.T) {
+	cases := []struct {
+		name         string
+		limit, count int
+		ops          []Operation
+		ok           bool
+	}{
+		{
+			name:  "sequential",
+			limit: 2,
+			ops: []Operation{
+				{Kind: OpAcquire, N: 2, Call: 1, Return: 2},
+				{Kind: OpTryAcquire, N: 1, OK: false, Call: 3, Return: 4},
+				{Kind: OpGetCount, Result: 2, Call: 5, Return: 6},
+				{Kind: OpRelease, N: 1, Result: 2, Call: 7, Return: 8},
+				{Kind: OpSetLimit, N: 1, Call: 9, Return: 10},
+				{Kind: OpGetLimit, Result: 1, Call: 11, Return: 12},
+				{Kind: OpAcquire, N: 1, Err: context.Canceled, Call: 13, Return: 14},
+				{Kind: OpRelease, N: 1, Result: 1, Call: 15, Return: 16},
+			},
+			ok: true,
+		},
+		{
+			name:  "concurrent try acquire",
+			limit: 1,
+			ops: []Operation{
+				{Kind: OpTryAcquire, N: 1, OK: false, Call: 1, Return: 4},
+				{Kind: OpTryAcquire, N: 1, OK: true, Call: 2, Return: 3},
+			},
+			ok: true,
+		},
+		{
+			name:  "overlapping release and get count",
+			limit: 1,
+			count: 1,
+			ops: []Operation{
+				{Kind: OpGetCount, Result: 0, Call: 1, Return: 4},
+				{Kind: OpRelease, N: 1, Result: 1, Call: 2, Return: 3},
+			},
+			ok: true,
+		},
+		{
+			name:  "acquire over limit",
+			limit: 1,
+			ops: []Operation{
+				{Kind: OpAcquire, N: 1, Call: 1, Return: 2},
+				{Kind: OpTryAcquire, N: 1, OK: true, Call: 3, Return: 4},
+			},
+		},
+		{
+			name:  "stale count",
+			limit: 1,
+			count: 1,
+			ops: []Operation{
+				{Kind: OpRelease, N: 1, Result: 1, Call: 1, Return: 2},
+				{Kind: OpGetCount, Result: 1, Call: 3, Return: 4},
+			},
+		},
+		{
+			name:  "wrong previous count",
+			limit: 2,
+			ops: []Operation{
+				{Kind: OpAcquire, N: 2, Call: 1, Return: 2},
+				{Kind: OpRelease, N: 1, Result: 1, Call: 3, Return: 4},
+			},
+		},
+		{
+			name:  "spurious try acquire failure",
+			limit: 2,
+			ops: []Operation{
+				{Kind: OpAcquire, N: 1, Call: 1, Return: 2},
+				{Kind: OpTryAcquire, N: 1, OK: false, Call: 3, Return: 4},
+			},
+		},
+	}
+	for _, c := range cases {
+		err := CheckLinearizable(c.limit, c.count, c.ops)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, ErrNotLinearizable) {
+			t.Errorf("%s: ErrNotLinearizable expected, got %v", c.name, err)
+		}
+	}
+}
+
+func TestCheckLinearizable_release_lower_bound(t *testing.T) {
+	ops := []Operation{
+		{Kind: OpAcquire, N: 2, Call: 1, Return: 2},
+		{Kind: OpRelease, N: 1, Result: 1, Call: 3, Return: 4},
+	}
+	if err := checkLinearizable(2, 0, ops, true); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// the previous count is at least n and at most the count
+	for _, result := range []int{0, 3} {
+		ops[1].Result = result
+		if err := checkLinearizable(2, 0, ops, true); !errors.Is(err, ErrNotLinearizable) {
+			t.Error("ErrNotLinearizable expected for result", result, "got", err)
+		}
+	}
+}
+
+// stress runs random operations on rec from many goroutines.
+func stress(rec *Recorder, goroutines, ops int, seed int64) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed + int64(i)))
+			held := 0
+			for j := 0; j < ops; j++ {
+				n := rnd.Intn(2) + 1
+				switch k := rnd.Intn(10); {
+				case k < 3:
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rnd.Intn(100))*time.Microsecond)
+					if rec.Acquire(ctx, n) == nil {
+						held += n
+					}
+					cancel()
+				case k < 5:
+					if rec.TryAcquire(n) {
+						held += n
+					}
+				case k < 8:
+					if held > 0 {
+						n = rnd.Intn(held) + 1
+						rec.Release(n)
+						held -= n
+					}
+				case k < 9:
+					rec.GetCount()
+				default:
+					if i == 0 {
+						rec.SetLimit(rnd.Intn(4) + 1)
+					} else {
+						rec.GetLimit()
+					}
+				}
+			}
+			if held > 0 {
+				rec.Release(held)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLinearizable_stress(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		rec := NewRecorder(semaphore.New(3))
+		stress(rec, 8, 200, int64(round*100))
+		if err := rec.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if count := rec.GetCount(); count != 0 {
+			t.Fatal("semaphore must have count = 0, but has", count)
+		}
+	}
+}
+
+func TestLinearizable_stress_spin(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		rec := NewRecorder(semaphore.NewWithOptions(3, semaphore.WithAdaptiveSpin(0)))
+		stress(rec, 8, 200, int64(round*100))
+		if err := rec.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLinearizable_simulated(t *testing.T) {
+	Explore(t, 1, 300, func(sim *Sim) {
+		rec := NewRecorder(sim.New(2))
+		running := 4
+		// the last goroutine checks the complete history
+		done := func() {
+			if running--; running == 0 {
+				if err := rec.Check(); err != nil {
+					sim.Errorf("%v", err)
+				}
+			}
+		}
+		for i := 0; i < 3; i++ {
+			sim.Go(func() {
+				defer done()
+				ctx, cancel := sim.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				if rec.Acquire(ctx, 2) == nil {
+					rec.GetCount()
+					rec.Release(1)
+					rec.Release(1)
+				} else if rec.TryAcquire(1) {
+					rec.Release(1)
+				}
+			})
+		}
+		sim.Go(func() {
+			defer done()
+			rec.SetLimit(3)
+			rec.GetLimit()
+			rec.SetLimit(2)
+		})
+	})
+}
+
+// newCountReleaser is a broken semaphore: Release returns the new count instead of the previous one.
+type newCountReleaser struct {
+	semaphore.Semaphore
+}
+
+func (s newCountReleaser) Release(n int) int {
+	return s.Semaphore.Release(n) - n
+}
+
+func TestLinearizable_stress_broken(t *testing.T) {
+	rec := NewRecorder(newCountReleaser{semaphore.New(3)})
+	stress(rec, 4, 100, 1)
+	if err := rec.Check(); !errors.Is(err, ErrNotLinearizable) {
+		t.Error("ErrNotLinearizable expected, got", err)
+	}
+}
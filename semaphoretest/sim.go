@@ -0,0 +1,354 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package semaphoretest provides a deterministic simulation harness for testing code using semaphores
+// and the semaphore implementation itself.
+//
+// A simulation runs virtual goroutines one at a time, switching between them at every step
+// of the instrumented semaphores: loads and CASes of the state, broadcast channel swaps and closes,
+// and waits. The scheduler picks the next goroutine by a seeded random choice or by exhaustive search,
+// so every interleaving it finds can be reproduced. Time is virtual too: contexts created with
+// Sim.WithTimeout expire when the scheduler advances the clock, which is a scheduling choice as well.
+//
+//	semaphoretest.Explore(t, 1, 1000, func(sim *semaphoretest.Sim) {
+//		sem := sim.New(1)
+//		for i := 0; i < 3; i++ {
+//			sim.Go(func() {
+//				ctx, cancel := sim.WithTimeout(context.Background(), time.Second)
+//				defer cancel()
+//				if sem.Acquire(ctx, 1) == nil {
+//					sem.Release(1)
+//				}
+//			})
+//		}
+//	})
+//
+// Only Acquire, TryAcquire, Release and SetLimit of semaphores created by Sim.New are simulated,
+// virtual goroutines must not block on anything else except Sim.Sleep.
+package semaphoretest // import "github.com/marusama/semaphore/v2/semaphoretest"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/marusama/semaphore/v2"
+	"github.com/marusama/semaphore/v2/internal/testhooks"
+)
+
+// DefaultMaxSteps is the default limit of scheduling steps of a simulation.
+const DefaultMaxSteps = 100000
+
+// traceTail is the number of the last steps shown in failure reports.
+const traceTail = 40
+
+// errAborted unwinds virtual goroutines of a finished simulation.
+var errAborted = errors.New("semaphoretest: simulation aborted")
+
+// Sim is a single run of a simulation.
+type Sim struct {
+	chooser  chooser
+	hooks    *testhooks.Hooks
+	maxSteps int
+
+	gs      []*goroutine
+	current *goroutine
+
+	// yielded receives a signal when the running goroutine gives control back
+	yielded chan struct{}
+	// abort is closed when the simulation is over
+	abort chan struct{}
+
+	now      time.Time
+	timers   []*timer
+	timerSeq int
+
+	steps int
+	trace []string
+	errs  []string
+}
+
+type goroutine struct {
+	id       int
+	wake     chan struct{}
+	point    string
+	parked   []<-chan struct{}
+	finished bool
+}
+
+type timer struct {
+	at      time.Time
+	seq     int
+	f       func()
+	stopped bool
+}
+
+func newSim(c chooser) *Sim {
+	s := &Sim{
+		chooser:  c,
+		maxSteps: DefaultMaxSteps,
+		yielded:  make(chan struct{}),
+		abort:    make(chan struct{}),
+		now:      time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	s.hooks = &testhooks.Hooks{
+		Yield: s.yield,
+		Park:  s.park,
+	}
+	return s
+}
+
+// New creates a semaphore instrumented by the simulation.
+func (s *Sim) New(limit int) semaphore.Semaphore {
+	return testhooks.New(limit, s.hooks).(semaphore.Semaphore)
+}
+
+// Go starts f in a new virtual goroutine. It can be called by the scenario and by virtual goroutines.
+func (s *Sim) Go(f func()) {
+	g := &goroutine{
+		id:   len(s.gs) + 1,
+		wake: make(chan struct{}),
+	}
+	s.gs = append(s.gs, g)
+	go func() {
+		select {
+		case <-g.wake:
+		case <-s.abort:
+			return
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if r == errAborted {
+					return
+				}
+				s.Errorf("goroutine %d panicked: %v\n%s", g.id, r, debug.Stack())
+			}
+			g.finished = true
+			s.yielded <- struct{}{}
+		}()
+		f()
+	}()
+}
+
+// Yield lets the scheduler switch to another goroutine, e.g. before cancelling a context.
+func (s *Sim) Yield() {
+	s.yield("yield")
+}
+
+// Sleep blocks the virtual goroutine until the virtual clock advances by d.
+func (s *Sim) Sleep(d time.Duration) {
+	ch := make(chan struct{})
+	s.afterFunc(d, func() {
+		close(ch)
+	})
+	s.park("sleep", ch)
+}
+
+// Now returns the virtual time.
+func (s *Sim) Now() time.Time {
+	return s.now
+}
+
+// SetMaxSteps changes the limit of scheduling steps, reaching it fails the simulation.
+func (s *Sim) SetMaxSteps(n int) {
+	s.maxSteps = n
+}
+
+// Errorf fails the simulation, it doesn't stop the calling goroutine.
+func (s *Sim) Errorf(format string, args ...interface{}) {
+	s.errs = append(s.errs, fmt.Sprintf(format, args...))
+}
+
+// yield gives control back to the scheduler and waits until it's scheduled again.
+func (s *Sim) yield(point string) {
+	g := s.current
+	if g == nil {
+		if isClosed(s.abort) {
+			// unwinding goroutines of a failed simulation
+			panic(errAborted)
+		}
+		// called while setting the simulation up
+		return
+	}
+	g.point = point
+	s.trace = append(s.trace, fmt.Sprintf("g%d %s", g.id, point))
+	s.yielded <- struct{}{}
+	select {
+	case <-g.wake:
+	case <-s.abort:
+		panic(errAborted)
+	}
+}
+
+// park blocks the goroutine until one of chs is closed and returns its index.
+func (s *Sim) park(point string, chs ...<-chan struct{}) int {
+	if s.current == nil {
+		if isClosed(s.abort) {
+			panic(errAborted)
+		}
+		cases := make([]reflect.SelectCase, len(chs))
+		for i, ch := range chs {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+		}
+		i, _, _ := reflect.Select(cases)
+		return i
+	}
+
+	g := s.current
+	g.parked = chs
+	// the scheduler resumes the goroutine when some channel is closed
+	s.yield(point)
+	g.parked = nil
+
+	var closed []int
+	for i, ch := range chs {
+		if isClosed(ch) {
+			closed = append(closed, i)
+		}
+	}
+	// like select, pick any of the ready channels
+	return closed[s.chooser.choose(len(closed))]
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	if ch == nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// run schedules the goroutines until all of them finish, and returns the failure if any.
+func (s *Sim) run() error {
+	defer close(s.abort)
+	for len(s.errs) == 0 {
+		runnable := s.runnable()
+		options := len(runnable)
+		if s.hasTimers() {
+			// advancing the clock is a choice too, so timeouts race with the goroutines
+			options++
+		}
+		if options == 0 {
+			if parked := s.parked(); len(parked) > 0 {
+				s.Errorf("deadlock, parked goroutines: %s", strings.Join(parked, ", "))
+			}
+			break
+		}
+		if s.steps >= s.maxSteps {
+			s.Errorf("no completion after %d steps", s.steps)
+			break
+		}
+		s.steps++
+
+		i := s.chooser.choose(options)
+		if i == len(runnable) {
+			s.fireTimer()
+			continue
+		}
+		g := runnable[i]
+		s.current = g
+		g.wake <- struct{}{}
+		<-s.yielded
+		s.current = nil
+	}
+	return s.err()
+}
+
+// runnable returns goroutines which are not finished and not parked on open channels.
+func (s *Sim) runnable() []*goroutine {
+	var res []*goroutine
+	for _, g := range s.gs {
+		if g.finished {
+			continue
+		}
+		if g.parked != nil {
+			ready := false
+			for _, ch := range g.parked {
+				if isClosed(ch) {
+					ready = true
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+// parked describes the goroutines blocked forever.
+func (s *Sim) parked() []string {
+	var res []string
+	for _, g := range s.gs {
+		if !g.finished {
+			res = append(res, fmt.Sprintf("g%d at %s", g.id, g.point))
+		}
+	}
+	return res
+}
+
+func (s *Sim) err() error {
+	if len(s.errs) == 0 {
+		return nil
+	}
+	trace := s.trace
+	if len(trace) > traceTail {
+		trace = trace[len(trace)-traceTail:]
+	}
+	return fmt.Errorf("%s\nlast steps at %s:\n\t%s",
+		strings.Join(s.errs, "\n"), s.now.Format(time.StampMicro), strings.Join(trace, "\n\t"))
+}
+
+// afterFunc calls f in the scheduler when the virtual clock reaches now+d.
+func (s *Sim) afterFunc(d time.Duration, f func()) *timer {
+	s.timerSeq++
+	t := &timer{
+		at:  s.now.Add(d),
+		seq: s.timerSeq,
+		f:   f,
+	}
+	s.timers = append(s.timers, t)
+	return t
+}
+
+func (s *Sim) hasTimers() bool {
+	for _, t := range s.timers {
+		if !t.stopped {
+			return true
+		}
+	}
+	return false
+}
+
+// fireTimer advances the clock to the earliest timer and fires it.
+func (s *Sim) fireTimer() {
+	var next *timer
+	timers := s.timers[:0]
+	for _, t := range s.timers {
+		if t.stopped {
+			continue
+		}
+		timers = append(timers, t)
+		if next == nil || t.at.Before(next.at) || t.at.Equal(next.at) && t.seq < next.seq {
+			next = t
+		}
+	}
+	s.timers = timers
+
+	next.stopped = true
+	if next.at.After(s.now) {
+		s.now = next.at
+	}
+	s.trace = append(s.trace, fmt.Sprintf("clock %s", s.now.Format(time.StampMicro)))
+	next.f()
+}
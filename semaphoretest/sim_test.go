@@ -0,0 +1,223 @@
+package semaphoretest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTB records the failure of Explore, ExploreAll or Replay.
+type fakeTB struct {
+	testing.TB
+	failure string
+}
+
+type fatal struct{}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Fatal(args ...interface{}) {
+	tb.failure = fmt.Sprint(args...)
+	panic(fatal{})
+}
+
+func (tb *fakeTB) Fatalf(format string, args ...interface{}) {
+	tb.failure = fmt.Sprintf(format, args...)
+	panic(fatal{})
+}
+
+// expectFailure runs f and returns the failure reported to the fake TB.
+func expectFailure(t *testing.T, f func(tb testing.TB)) string {
+	t.Helper()
+	tb := &fakeTB{TB: t}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(fatal); !ok {
+					panic(r)
+				}
+			}
+		}()
+		f(tb)
+	}()
+	if tb.failure == "" {
+		t.Fatal("failure expected")
+	}
+	return tb.failure
+}
+
+func acquireReleaseScenario(sim *Sim) {
+	sem := sim.New(1)
+	for i := 0; i < 3; i++ {
+		sim.Go(func() {
+			ctx, cancel := sim.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if sem.Acquire(ctx, 1) == nil {
+				// the limit is raised to 2 for a while
+				if count := sem.GetCount(); count > 2 {
+					sim.Errorf("count is over limit: %d", count)
+				}
+				sem.Release(1)
+			}
+		})
+	}
+	sim.Go(func() {
+		sem.SetLimit(2)
+		sem.SetLimit(1)
+	})
+}
+
+func TestExplore(t *testing.T) {
+	Explore(t, 1, 300, acquireReleaseScenario)
+}
+
+func TestExploreAll(t *testing.T) {
+	runs := ExploreAll(t, 100000, func(sim *Sim) {
+		sem := sim.New(1)
+		for i := 0; i < 2; i++ {
+			sim.Go(func() {
+				sem.Acquire(nil, 1)
+				sem.Release(1)
+			})
+		}
+	})
+	if runs < 2 || runs >= 100000 {
+		t.Error("unexpected number of explored schedules:", runs)
+	}
+}
+
+func TestExplore_deterministic(t *testing.T) {
+	var schedules, traces [2]string
+	for i := range schedules {
+		c := &randomChooser{rng: rand.New(rand.NewSource(42))}
+		sim := newSim(c)
+		acquireReleaseScenario(sim)
+		if err := sim.run(); err != nil {
+			t.Fatal(err)
+		}
+		schedules[i], traces[i] = c.schedule(), strings.Join(sim.trace, "\n")
+	}
+	if schedules[0] != schedules[1] || traces[0] != traces[1] {
+		t.Error("the same seed must give the same run")
+	}
+	if schedules[0] == "" {
+		t.Error("the run must have choices")
+	}
+}
+
+// lostUpdateScenario has a data race which only some interleavings hit.
+func lostUpdateScenario(sim *Sim) {
+	counter, finished := 0, 0
+	for i := 0; i < 2; i++ {
+		sim.Go(func() {
+			c := counter
+			sim.Yield()
+			counter = c + 1
+			if finished++; finished == 2 && counter != 2 {
+				sim.Errorf("lost update, counter = %d", counter)
+			}
+		})
+	}
+}
+
+var scheduleRe = regexp.MustCompile(`Replay\(t, "([0-9.]*)", scenario\)`)
+
+func TestExplore_reproduce(t *testing.T) {
+	failure := expectFailure(t, func(tb testing.TB) {
+		Explore(tb, 1, 1000, lostUpdateScenario)
+	})
+	if !strings.Contains(failure, "lost update") {
+		t.Fatal("unexpected failure:", failure)
+	}
+	m := scheduleRe.FindStringSubmatch(failure)
+	if m == nil {
+		t.Fatal("schedule is not reported:", failure)
+	}
+
+	// the reported schedule reproduces the failure
+	failure = expectFailure(t, func(tb testing.TB) {
+		Replay(tb, m[1], lostUpdateScenario)
+	})
+	if !strings.Contains(failure, "lost update") {
+		t.Fatal("unexpected failure:", failure)
+	}
+
+	// exhaustive search finds it too
+	failure = expectFailure(t, func(tb testing.TB) {
+		ExploreAll(tb, 1000, lostUpdateScenario)
+	})
+	if !strings.Contains(failure, "lost update") {
+		t.Fatal("unexpected failure:", failure)
+	}
+}
+
+func TestSim_deadlock(t *testing.T) {
+	failure := expectFailure(t, func(tb testing.TB) {
+		Explore(tb, 1, 10, func(sim *Sim) {
+			sem := sim.New(1)
+			sim.Go(func() {
+				sem.Acquire(nil, 1)
+			})
+			sim.Go(func() {
+				sem.Acquire(nil, 1)
+				sem.Acquire(nil, 1)
+			})
+		})
+	})
+	if !strings.Contains(failure, "deadlock") || !strings.Contains(failure, "acquire.wait") {
+		t.Error("unexpected failure:", failure)
+	}
+}
+
+func TestSim_panic(t *testing.T) {
+	failure := expectFailure(t, func(tb testing.TB) {
+		Explore(tb, 1, 1, func(sim *Sim) {
+			sem := sim.New(1)
+			sim.Go(func() {
+				sem.Release(1)
+			})
+		})
+	})
+	if !strings.Contains(failure, "semaphore release without acquire") {
+		t.Error("unexpected failure:", failure)
+	}
+}
+
+func TestSim_virtual_time(t *testing.T) {
+	Explore(t, 1, 50, func(sim *Sim) {
+		sem := sim.New(1)
+		sem.Acquire(nil, 1)
+
+		sim.Go(func() {
+			start := sim.Now()
+			ctx, cancel := sim.WithTimeout(context.Background(), time.Hour)
+			defer cancel()
+			if err := sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+				sim.Errorf("context.DeadlineExceeded expected, got %v", err)
+			}
+			if d := sim.Now().Sub(start); d < time.Hour {
+				sim.Errorf("at least an hour must pass, got %v", d)
+			}
+		})
+		sim.Go(func() {
+			ctx, cancel := sim.WithCancel(context.Background())
+			child, cancelChild := sim.WithTimeout(ctx, time.Minute)
+			defer cancelChild()
+			cancel()
+			if err := sem.Acquire(child, 1); err != context.Canceled {
+				sim.Errorf("context.Canceled expected, got %v", err)
+			}
+		})
+		sim.Go(func() {
+			start := sim.Now()
+			sim.Sleep(2 * time.Hour)
+			if d := sim.Now().Sub(start); d < 2*time.Hour {
+				sim.Errorf("at least 2 hours must pass, got %v", d)
+			}
+		})
+	})
+}
@@ -0,0 +1,336 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheLineSize is used to keep shards in separate cache lines.
+const cacheLineSize = 64
+
+// NewSharded initializes a new instance of the Semaphore with the limit split between shards,
+// which reduces contention when many cores acquire and release the semaphore simultaneously.
+// Every shard keeps its own free entries and counts the entries acquired from it.
+// A goroutine acquires and releases entries of the shard of the processor it runs on,
+// and borrows free entries of other shards when its own shard runs dry,
+// so the limit is exact as with New. If shards is not positive, GOMAXPROCS shards are used.
+//
+// Borrowing, SetLimit, GetCount and releasing entries acquired from another shard lock all the shards,
+// so GetCount is exact. Release returns the previous count of the local shard only, which is a lower bound
+// of the previous count of the semaphore and at least n.
+func NewSharded(limit, shards int) Semaphore {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	s := &shardedSemaphore{
+		limit:       int64(limit),
+		shards:      make([]shard, shards),
+		broadcastCh: make(chan struct{}),
+	}
+	s.pool.New = func() interface{} {
+		i := int(atomic.AddUint32(&s.nextShard, 1)-1) % len(s.shards)
+		return &s.shards[i]
+	}
+	s.distribute(int64(limit))
+	return s
+}
+
+// shard holds free entries of the sharded semaphore and the count of the entries acquired from it.
+type shard struct {
+	mu    sync.Mutex
+	free  int64
+	count int64
+	_     [cacheLineSize - 24]byte
+}
+
+// shardedSemaphore impl Semaphore intf.
+//
+// Entries are either held or free, free entries are kept in shards.
+// When the limit is lowered below the number of held entries, the difference is recorded in debt
+// and paid off by the next releases, so held + free = limit + debt, and there are no free entries
+// while there is debt. The limit and the debt change only while all the shards are locked,
+// so the debt is read under the lock of any shard.
+type shardedSemaphore struct {
+	// 64-bit atomic fields go first for alignment
+	limit int64
+	debt  int64
+
+	// stats count waiting Acquire calls
+	stats waitStats
+
+	// waiters is the number of goroutines waiting for the broadcast
+	waiters int32
+
+	nextShard uint32
+	shards    []shard
+
+	// pool hands out shards, sync.Pool keeps them per processor
+	pool sync.Pool
+
+	// broadcast fields
+	lock        sync.RWMutex
+	broadcastCh chan struct{}
+}
+
+func (s *shardedSemaphore) Acquire(ctx context.Context, n int) error {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	var ctxDoneCh <-chan struct{}
+	if ctx != nil {
+		ctxDoneCh = ctx.Done()
+	}
+	var w waiting
+	for {
+		// check if context is done
+		select {
+		case <-ctxDoneCh:
+			w.done(&s.stats, true)
+			return ctx.Err()
+		default:
+		}
+
+		if s.tryAcquireLocal(int64(n)) {
+			// acquired
+			w.done(&s.stats, false)
+			return nil
+		}
+
+		// register as a waiter before the last check, so releasers will broadcast
+		atomic.AddInt32(&s.waiters, 1)
+		broadcastCh := s.getBroadcastCh()
+		if s.acquireSlow(int64(n)) {
+			atomic.AddInt32(&s.waiters, -1)
+			w.done(&s.stats, false)
+			return nil
+		}
+
+		w.park(&s.stats)
+		select {
+		// check if context is done
+		case <-ctxDoneCh:
+			atomic.AddInt32(&s.waiters, -1)
+			w.unpark(&s.stats)
+			w.done(&s.stats, true)
+			return ctx.Err()
+		// waiting for broadcast signal
+		case <-broadcastCh:
+			atomic.AddInt32(&s.waiters, -1)
+			w.unpark(&s.stats)
+		}
+	}
+}
+
+func (s *shardedSemaphore) TryAcquire(n int) bool {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	return s.tryAcquireLocal(int64(n)) || s.acquireSlow(int64(n))
+}
+
+// tryAcquireLocal takes n free entries of the local shard.
+func (s *shardedSemaphore) tryAcquireLocal(n int64) bool {
+	sh := s.pool.Get().(*shard)
+	sh.mu.Lock()
+	// there are no free entries while there is debt
+	acquired := sh.free >= n
+	if acquired {
+		sh.free -= n
+		sh.count += n
+	}
+	sh.mu.Unlock()
+	s.pool.Put(sh)
+	return acquired
+}
+
+// acquireSlow borrows n free entries from all the shards and counts them in the local shard.
+func (s *shardedSemaphore) acquireSlow(n int64) bool {
+	sh := s.pool.Get().(*shard)
+	defer s.pool.Put(sh)
+
+	s.lockShards()
+	defer s.unlockShards()
+
+	var free int64
+	for i := range s.shards {
+		free += s.shards[i].free
+	}
+	if free < n {
+		return false
+	}
+	taken := take(sh, n)
+	for i := range s.shards {
+		if taken == n {
+			break
+		}
+		taken += take(&s.shards[i], n-taken)
+	}
+	sh.count += n
+	return true
+}
+
+// take takes up to n free entries of the locked shard and returns the number taken.
+func take(sh *shard, n int64) int64 {
+	if n > sh.free {
+		n = sh.free
+	}
+	sh.free -= n
+	return n
+}
+
+// lockShards locks all the shards in order.
+func (s *shardedSemaphore) lockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+}
+
+func (s *shardedSemaphore) unlockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// distribute spreads n free entries between shards, the shards must be locked or not shared yet.
+func (s *shardedSemaphore) distribute(n int64) {
+	per, rest := n/int64(len(s.shards)), n%int64(len(s.shards))
+	for i := range s.shards {
+		s.shards[i].free += per
+		if int64(i) < rest {
+			s.shards[i].free++
+		}
+	}
+}
+
+func (s *shardedSemaphore) Release(n int) int {
+	if n <= 0 {
+		panic("n must be positive number")
+	}
+	sh := s.pool.Get().(*shard)
+	sh.mu.Lock()
+	var count int
+	if sh.count >= int64(n) && s.debt == 0 {
+		count = int(sh.count)
+		sh.count -= int64(n)
+		sh.free += int64(n)
+		sh.mu.Unlock()
+	} else {
+		sh.mu.Unlock()
+		count = s.releaseSlow(sh, int64(n))
+	}
+	s.pool.Put(sh)
+
+	if atomic.LoadInt32(&s.waiters) > 0 {
+		s.broadcast()
+	}
+	return count
+}
+
+// releaseSlow releases n entries acquired from any shards into sh, paying off the debt first,
+// and returns the previous count of the semaphore.
+func (s *shardedSemaphore) releaseSlow(sh *shard, n int64) int {
+	s.lockShards()
+	var count int64
+	for i := range s.shards {
+		count += s.shards[i].count
+	}
+	if count < n {
+		s.unlockShards()
+		panic("semaphore release without acquire")
+	}
+
+	uncounted := n
+	for i := -1; uncounted > 0; i++ {
+		// the local shard first
+		other := sh
+		if i >= 0 {
+			other = &s.shards[i]
+		}
+		part := uncounted
+		if part > other.count {
+			part = other.count
+		}
+		other.count -= part
+		uncounted -= part
+	}
+
+	paid := n
+	if paid > s.debt {
+		paid = s.debt
+	}
+	s.debt -= paid
+	sh.free += n - paid
+	s.unlockShards()
+	return int(count)
+}
+
+func (s *shardedSemaphore) SetLimit(limit int) {
+	if limit < 0 {
+		panic("semaphore limit must not be negative")
+	}
+	s.lockShards()
+	delta := int64(limit) - atomic.LoadInt64(&s.limit)
+	if delta > 0 {
+		// new entries pay off the debt first
+		paid := delta
+		if paid > s.debt {
+			paid = s.debt
+		}
+		s.debt -= paid
+		s.distribute(delta - paid)
+	} else if delta < 0 {
+		// free entries are removed, held ones are removed when released
+		removed := int64(0)
+		for i := range s.shards {
+			removed += take(&s.shards[i], -delta-removed)
+		}
+		s.debt += -delta - removed
+	}
+	atomic.StoreInt64(&s.limit, int64(limit))
+	s.unlockShards()
+
+	s.broadcast()
+}
+
+// broadcast wakes up all waiters, so they can check the state again.
+func (s *shardedSemaphore) broadcast() {
+	newBroadcastCh := make(chan struct{})
+	s.lock.Lock()
+	oldBroadcastCh := s.broadcastCh
+	s.broadcastCh = newBroadcastCh
+	s.lock.Unlock()
+
+	// send broadcast signal
+	close(oldBroadcastCh)
+}
+
+// getBroadcastCh returns the channel that will be closed on the next broadcast.
+func (s *shardedSemaphore) getBroadcastCh() chan struct{} {
+	s.lock.RLock()
+	broadcastCh := s.broadcastCh
+	s.lock.RUnlock()
+	return broadcastCh
+}
+
+func (s *shardedSemaphore) GetCount() int {
+	s.lockShards()
+	var count int64
+	for i := range s.shards {
+		count += s.shards[i].count
+	}
+	s.unlockShards()
+	return int(count)
+}
+
+func (s *shardedSemaphore) GetLimit() int {
+	return int(atomic.LoadInt64(&s.limit))
+}
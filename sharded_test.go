@@ -0,0 +1,322 @@
+package semaphore
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewSharded(t *testing.T) {
+	sem := NewSharded(10, 4)
+	checkLimitAndCount(t, sem, 10, 0)
+
+	sem = NewSharded(0, 0)
+	checkLimitAndCount(t, sem, 0, 0)
+	if len(sem.(*shardedSemaphore).shards) != runtime.GOMAXPROCS(0) {
+		t.Error("GOMAXPROCS shards expected")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Panic expected")
+			}
+		}()
+		NewSharded(-1, 4)
+	}()
+}
+
+func TestShardedSemaphore_Acquire_Release(t *testing.T) {
+	sem := NewSharded(5, 4)
+
+	if err := sem.Acquire(nil, 2); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 2)
+
+	if !(sem.TryAcquire(3) == true) {
+		t.Fail()
+	}
+	checkLimitAndCount(t, sem, 5, 5)
+
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+
+	oldCount := sem.Release(5)
+	if oldCount != 5 {
+		t.Error("semaphore must have old count = ", 5, ", but has ", oldCount)
+	}
+	checkLimitAndCount(t, sem, 5, 0)
+}
+
+func TestShardedSemaphore_borrowing(t *testing.T) {
+	// every shard has 1 free entry, taking all of them needs borrowing
+	sem := NewSharded(8, 8)
+
+	if !(sem.TryAcquire(8) == true) {
+		t.Fail()
+	}
+	checkLimitAndCount(t, sem, 8, 8)
+	sem.Release(8)
+
+	for i := 0; i < 8; i++ {
+		if !(sem.TryAcquire(1) == true) {
+			t.Fail()
+		}
+	}
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+	checkLimitAndCount(t, sem, 8, 8)
+	sem.Release(8)
+	checkLimitAndCount(t, sem, 8, 0)
+}
+
+func TestShardedSemaphore_Acquire_ctx_done(t *testing.T) {
+	sem := NewSharded(1, 2)
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+	if atomic.LoadInt32(&sem.(*shardedSemaphore).waiters) != 0 {
+		t.Error("no waiters expected")
+	}
+}
+
+func TestShardedSemaphore_Acquire_waits_for_Release(t *testing.T) {
+	sem := NewSharded(2, 2)
+	sem.Acquire(nil, 2)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.Acquire(nil, 2)
+		close(acquired)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("acquired over limit")
+	default:
+	}
+
+	sem.Release(1)
+	sem.Release(1)
+	<-acquired
+	checkLimitAndCount(t, sem, 2, 2)
+}
+
+func TestShardedSemaphore_SetLimit(t *testing.T) {
+	sem := NewSharded(4, 3)
+	sem.Acquire(nil, 3)
+
+	// lowering the limit below count keeps held entries
+	sem.SetLimit(1)
+	checkLimitAndCount(t, sem, 1, 3)
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+
+	sem.Release(1)
+	checkLimitAndCount(t, sem, 1, 2)
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+
+	sem.Release(2)
+	checkLimitAndCount(t, sem, 1, 0)
+	if !(sem.TryAcquire(1) == true) {
+		t.Fail()
+	}
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+
+	// raising the limit pays off the debt first
+	sem.SetLimit(0)
+	checkLimitAndCount(t, sem, 0, 1)
+	sem.SetLimit(3)
+	checkLimitAndCount(t, sem, 3, 1)
+	if !(sem.TryAcquire(2) == true) {
+		t.Fail()
+	}
+	if !(sem.TryAcquire(1) == false) {
+		t.Fail()
+	}
+	sem.Release(3)
+	checkLimitAndCount(t, sem, 3, 0)
+}
+
+func TestShardedSemaphore_GetCount_exact(t *testing.T) {
+	sem := NewSharded(4, 8)
+	sem.Acquire(nil, 2)
+
+	// failing acquisitions borrow entries from the shards, but they must not be counted
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if sem.TryAcquire(3) {
+					t.Error("acquired over limit")
+					sem.Release(3)
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	for i := 0; i < 10000; i++ {
+		if count := sem.GetCount(); count != 2 {
+			t.Fatal("semaphore must have count = 2, but has", count)
+		}
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+
+	if oldCount := sem.Release(2); oldCount != 2 {
+		t.Error("semaphore must have old count = 2, but has", oldCount)
+	}
+	checkLimitAndCount(t, sem, 4, 0)
+}
+
+func TestShardedSemaphore_SetLimit_increase_broadcast(t *testing.T) {
+	sem := NewSharded(0, 2)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.Acquire(nil, 1)
+		close(acquired)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	sem.SetLimit(1)
+	<-acquired
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func TestShardedSemaphore_panic_expected(t *testing.T) {
+	tests := []func(sem Semaphore){
+		func(sem Semaphore) { sem.Acquire(nil, 0) },
+		func(sem Semaphore) { sem.TryAcquire(0) },
+		func(sem Semaphore) { sem.Release(0) },
+		func(sem Semaphore) { sem.SetLimit(-1) },
+		func(sem Semaphore) { sem.Release(1) },
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			test(NewSharded(1, 2))
+		}()
+	}
+}
+
+func TestShardedSemaphore_Acquire_Release_SetLimit_random_limit(t *testing.T) {
+	sem := NewSharded(1, 4)
+	var holders, maxLimit int32 = 0, 1
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < 1000; j++ {
+				err := sem.Acquire(nil, 1)
+				if err != nil {
+					panic(err)
+				}
+				if atomic.AddInt32(&holders, 1) > atomic.LoadInt32(&maxLimit) {
+					t.Error("holders exceed the limit")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&holders, -1)
+				sem.Release(1)
+				runtime.Gosched()
+			}
+			wg.Done()
+		}()
+	}
+
+	c2 := make(chan struct{})
+	wg2 := sync.WaitGroup{}
+	wg2.Add(1)
+	go func() {
+		<-c
+		for {
+			select {
+			case <-c2:
+				sem.SetLimit(1)
+				wg2.Done()
+				return
+			default:
+			}
+			// limits only grow up to 50 so maxLimit bounds the holders
+			newLimit := rand.Intn(50) + 1 // range [1, 50]
+			if int32(newLimit) > atomic.LoadInt32(&maxLimit) {
+				atomic.StoreInt32(&maxLimit, int32(newLimit))
+			}
+			sem.SetLimit(newLimit)
+			runtime.Gosched()
+		}
+	}()
+
+	close(c) // start
+	wg.Wait()
+
+	close(c2) // stop 'set limit' goroutine
+	wg2.Wait()
+
+	checkLimitAndCount(t, sem, 1, 0)
+}
+
+func TestShardedSemaphore_exact_limit(t *testing.T) {
+	const limit = 3
+	sem := NewSharded(limit, 8)
+	var holders int32
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			<-c
+			for j := 0; j < 1000; j++ {
+				if err := sem.Acquire(nil, n); err != nil {
+					panic(err)
+				}
+				if atomic.AddInt32(&holders, int32(n)) > limit {
+					t.Error("holders exceed the limit")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&holders, -int32(n))
+				sem.Release(n)
+			}
+			wg.Done()
+		}(i%limit + 1)
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkLimitAndCount(t, sem, limit, 0)
+}
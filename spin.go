@@ -0,0 +1,77 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxSpin is the spin limit used by WithAdaptiveSpin(0).
+const DefaultMaxSpin = 20 * time.Microsecond
+
+// WithAdaptiveSpin makes Acquire on a full semaphore yield and retry for a while before parking,
+// which is much cheaper than parking when permits are held for microseconds.
+// The spin time is learned from recent wait times, which follow how long permits are held:
+// it's twice the average wait, and zero (park at once) if waits take longer than maxSpin.
+// Until wait times are learned, Acquire spins up to maxSpin.
+// If maxSpin is not positive, DefaultMaxSpin is used.
+func WithAdaptiveSpin(maxSpin time.Duration) Option {
+	if maxSpin <= 0 {
+		maxSpin = DefaultMaxSpin
+	}
+	return func(o *options) {
+		o.spinMax = maxSpin
+	}
+}
+
+// spinner tracks spinning of a single Acquire call.
+type spinner struct {
+	start time.Time
+	until time.Time
+}
+
+// spin reports if the caller should retry instead of parking.
+func (sp *spinner) spin(s *semaphore) bool {
+	if s.spinMax == 0 {
+		return false
+	}
+	now := time.Now()
+	if sp.start.IsZero() {
+		sp.start = now
+		sp.until = now.Add(s.spinBudget())
+	}
+	if !now.Before(sp.until) {
+		return false
+	}
+	runtime.Gosched()
+	return true
+}
+
+// done records the wait time of the call if it had to wait.
+func (sp *spinner) done(s *semaphore) {
+	if sp.start.IsZero() {
+		return
+	}
+	wait := int64(time.Since(sp.start))
+	// exponential moving average, concurrent updates may be lost
+	avg := atomic.LoadInt64(&s.waitAvg)
+	atomic.StoreInt64(&s.waitAvg, avg+(wait-avg)/8)
+}
+
+// spinBudget returns how long to spin before parking.
+func (s *semaphore) spinBudget() time.Duration {
+	avg := atomic.LoadInt64(&s.waitAvg)
+	if avg > s.spinMax {
+		// permits are held for long, spinning would only burn cpu
+		return 0
+	}
+	budget := 2 * avg
+	if budget > s.spinMax {
+		budget = s.spinMax
+	}
+	return time.Duration(budget)
+}
@@ -0,0 +1,118 @@
+package semaphore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// New must stay usable as a constructor value, options go to NewWithOptions.
+var _ func(limit int) Semaphore = New
+
+func TestWithAdaptiveSpin(t *testing.T) {
+	sem := NewWithOptions(1, WithAdaptiveSpin(0)).(*semaphore)
+	if time.Duration(sem.spinMax) != DefaultMaxSpin {
+		t.Error("default max spin expected, got", time.Duration(sem.spinMax))
+	}
+
+	if sem.spinBudget() != DefaultMaxSpin {
+		t.Error("first waiters must spin up to max spin, got", sem.spinBudget())
+	}
+
+	sem = New(1).(*semaphore)
+	if sem.spinMax != 0 {
+		t.Error("spinning must be disabled by default")
+	}
+}
+
+func TestSemaphore_spinBudget(t *testing.T) {
+	sem := NewWithOptions(1, WithAdaptiveSpin(100*time.Microsecond)).(*semaphore)
+
+	tests := []struct {
+		waitAvg time.Duration
+		budget  time.Duration
+	}{
+		{0, 0},
+		{10 * time.Microsecond, 20 * time.Microsecond},
+		{80 * time.Microsecond, 100 * time.Microsecond},
+		{time.Millisecond, 0},
+	}
+	for _, test := range tests {
+		atomic.StoreInt64(&sem.waitAvg, int64(test.waitAvg))
+		if budget := sem.spinBudget(); budget != test.budget {
+			t.Error("budget", test.budget, "expected for average wait", test.waitAvg, ", got", budget)
+		}
+	}
+}
+
+func TestSemaphore_Acquire_spin_learns_wait_time(t *testing.T) {
+	sem := NewWithOptions(1, WithAdaptiveSpin(time.Second)).(*semaphore)
+	sem.Acquire(nil, 1)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sem.Release(1)
+	}()
+	if err := sem.Acquire(nil, 1); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	if avg := time.Duration(atomic.LoadInt64(&sem.waitAvg)); avg < time.Millisecond {
+		t.Error("wait time is not learned, average is", avg)
+	}
+	if sem.spinBudget() == 0 {
+		t.Error("spinning expected")
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func TestSemaphore_Acquire_spin_ctx_done(t *testing.T) {
+	sem := NewWithOptions(1, WithAdaptiveSpin(time.Second)).(*semaphore)
+	atomic.StoreInt64(&sem.waitAvg, int64(time.Second/2))
+	sem.Acquire(nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Error("spinning ignores ctx, returned after", d)
+	}
+	checkLimitAndCount(t, sem, 1, 1)
+}
+
+func TestSemaphore_Acquire_Release_spin_over_limit(t *testing.T) {
+	const limit = 3
+	sem := NewWithOptions(limit, WithAdaptiveSpin(0))
+	var holders int32
+
+	c := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			<-c
+			for j := 0; j < 2000; j++ {
+				if err := sem.Acquire(nil, 1); err != nil {
+					panic(err)
+				}
+				if atomic.AddInt32(&holders, 1) > limit {
+					t.Error("holders exceed the limit")
+				}
+				runtime.Gosched()
+				atomic.AddInt32(&holders, -1)
+				sem.Release(1)
+			}
+			wg.Done()
+		}()
+	}
+
+	close(c) // start
+	wg.Wait()
+
+	checkLimitAndCount(t, sem, limit, 0)
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters of Acquire calls that had to wait and of preempted permits.
+type Stats struct {
+	// Waiters is the number of goroutines waiting in Acquire now.
+	Waiters int
+
+	// Waits is the number of Acquire calls that waited, Cancels is the number of them ended by the context.
+	Waits   uint64
+	Cancels uint64
+
+	// WaitTime is the total time spent waiting by finished Acquire calls.
+	WaitTime time.Duration
+
+	// Preemptions is the number of permits preempted by higher priority AcquirePermit calls,
+	// ForcedReleases is the number of them released by the semaphore after their grace period.
+	Preemptions    uint64
+	ForcedReleases uint64
+}
+
+// StatsReporter reports waiting statistics, it's implemented by semaphores created by New and NewSharded.
+// Only Acquire calls that wait are counted, so the statistics cost nothing while the semaphore isn't full.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// waitStats is updated by the waiting Acquire calls.
+// 64-bit fields go first for alignment of atomic operations.
+type waitStats struct {
+	waits    uint64
+	cancels  uint64
+	waitTime int64
+
+	// preemption counters, see Permit
+	preemptions    uint64
+	forcedReleases uint64
+
+	waiters int32
+}
+
+func (st *waitStats) get() Stats {
+	return Stats{
+		Waiters:        int(atomic.LoadInt32(&st.waiters)),
+		Waits:          atomic.LoadUint64(&st.waits),
+		Cancels:        atomic.LoadUint64(&st.cancels),
+		WaitTime:       time.Duration(atomic.LoadInt64(&st.waitTime)),
+		Preemptions:    atomic.LoadUint64(&st.preemptions),
+		ForcedReleases: atomic.LoadUint64(&st.forcedReleases),
+	}
+}
+
+// waiting tracks the waits of a single Acquire call.
+type waiting struct {
+	start time.Time
+}
+
+// park is called before the call blocks.
+func (w *waiting) park(st *waitStats) {
+	if w.start.IsZero() {
+		w.start = time.Now()
+		atomic.AddUint64(&st.waits, 1)
+	}
+	atomic.AddInt32(&st.waiters, 1)
+}
+
+// unpark is called when the call wakes up.
+func (w *waiting) unpark(st *waitStats) {
+	atomic.AddInt32(&st.waiters, -1)
+}
+
+// done is called when the call returns.
+func (w *waiting) done(st *waitStats, cancelled bool) {
+	if w.start.IsZero() {
+		return
+	}
+	atomic.AddInt64(&st.waitTime, int64(time.Since(w.start)))
+	if cancelled {
+		atomic.AddUint64(&st.cancels, 1)
+	}
+}
+
+func (s *semaphore) Stats() Stats {
+	return s.stats.get()
+}
+
+func (s *shardedSemaphore) Stats() Stats {
+	return s.stats.get()
+}
@@ -0,0 +1,67 @@
+package semaphore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func checkStats(t *testing.T, sem Semaphore, expectedWaiters int, expectedWaits, expectedCancels uint64) Stats {
+	t.Helper()
+	st := sem.(StatsReporter).Stats()
+	if st.Waiters != expectedWaiters || st.Waits != expectedWaits || st.Cancels != expectedCancels {
+		t.Errorf("semaphore must have %d waiters, %d waits and %d cancels, but has %d, %d and %d",
+			expectedWaiters, expectedWaits, expectedCancels, st.Waiters, st.Waits, st.Cancels)
+	}
+	return st
+}
+
+// waitWaiters waits until n goroutines wait in Acquire.
+func waitWaiters(t *testing.T, sem Semaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for sem.(StatsReporter).Stats().Waiters != n {
+		if time.Now().After(deadline) {
+			t.Fatal("waiters are not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testStats(t *testing.T, sem Semaphore) {
+	// acquisitions that don't wait are not counted
+	sem.Acquire(nil, 1)
+	checkStats(t, sem, 0, 0, 0)
+
+	done := make(chan error)
+	go func() {
+		done <- sem.Acquire(nil, 1)
+	}()
+	waitWaiters(t, sem, 1)
+	checkStats(t, sem, 1, 1, 0)
+
+	time.Sleep(10 * time.Millisecond)
+	sem.Release(1)
+	<-done
+	st := checkStats(t, sem, 0, 1, 0)
+	if st.WaitTime < 10*time.Millisecond {
+		t.Error("wait time must be counted, got", st.WaitTime)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- sem.Acquire(ctx, 1)
+	}()
+	waitWaiters(t, sem, 1)
+	cancel()
+	<-done
+	checkStats(t, sem, 0, 2, 1)
+}
+
+func TestSemaphore_Stats(t *testing.T) {
+	testStats(t, New(1))
+}
+
+func TestShardedSemaphore_Stats(t *testing.T) {
+	testStats(t, NewSharded(1, 2))
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Maru Sama. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrUpgradeConflict is returned by Upgrade when another upgrade or an exclusive acquisition is already waiting.
+// Two holders waiting to grow their holdings, or an exclusive acquisition waiting for the holding to be released,
+// could wait for each other forever, so the caller should release its holding and acquire it again.
+var ErrUpgradeConflict = errors.New("semaphore: another upgrade is waiting")
+
+// Upgrader is implemented by semaphores that can change the weight of a holding in place,
+// the Semaphore returned by New implements it.
+type Upgrader interface {
+	// Upgrade grows a holding of from entries to to entries, blocking only until ctx is done.
+	// The holding is never dropped while waiting: on success the caller holds to entries,
+	// on failure it still holds from entries.
+	// Only one upgrade may wait at a time, if the holding cannot be grown immediately
+	// while another upgrade is waiting, ErrUpgradeConflict is returned.
+	// ErrUpgradeConflict is returned too when an exclusive acquisition is queued, before or while waiting.
+	Upgrade(ctx context.Context, from, to int) error
+
+	// Downgrade shrinks a holding of from entries to to entries, wakes up the waiters
+	// and returns the previous count.
+	Downgrade(from, to int) int
+}
+
+func (s *semaphore) Upgrade(ctx context.Context, from, to int) error {
+	if from <= 0 || to < from {
+		panic("from must be positive number not greater than to")
+	}
+	if to == from {
+		return nil
+	}
+	delta := uint64(to - from)
+	if s.tryGrow(delta) {
+		return nil
+	}
+
+	// a queued exclusive acquisition waits for the holding to be released
+	if atomic.LoadInt32(&s.exclusive) != 0 {
+		return ErrUpgradeConflict
+	}
+
+	// only one upgrader may wait, otherwise they could wait for each other
+	select {
+	case s.upgradeCh <- struct{}{}:
+	default:
+		return ErrUpgradeConflict
+	}
+	defer func() {
+		<-s.upgradeCh
+	}()
+
+	var ctxDoneCh <-chan struct{}
+	if ctx != nil {
+		ctxDoneCh = ctx.Done()
+	}
+	for {
+		// check if context is done
+		select {
+		case <-ctxDoneCh:
+			return ctx.Err()
+		default:
+		}
+
+		if atomic.LoadInt32(&s.exclusive) != 0 {
+			return ErrUpgradeConflict
+		}
+
+		// get current semaphore count and limit
+		state := atomic.LoadUint64(&s.state)
+		count := state & 0xFFFFFFFF
+		limit := state >> 32
+
+		if count+delta <= limit {
+			if atomic.CompareAndSwapUint64(&s.state, state, limit<<32+count+delta) {
+				// upgraded
+				return nil
+			}
+
+			// CAS failed, try again
+			continue
+		}
+
+		// semaphore is full, let's wait
+		broadcastCh := s.getBroadcastCh()
+
+		// ensure that the state is the same as when we first checked; this
+		// ensures that the broadcastCh will eventually be closed by a Release
+		// or by an exclusive acquisition queued after the check.
+		if atomic.LoadUint64(&s.state) != state || atomic.LoadInt32(&s.exclusive) != 0 {
+			continue
+		}
+
+		select {
+		// check if context is done
+		case <-ctxDoneCh:
+			return ctx.Err()
+		// waiting for broadcast signal
+		case <-broadcastCh:
+		}
+	}
+}
+
+// tryGrow adds delta to the count if it stays within the limit and there is no exclusive acquisition.
+func (s *semaphore) tryGrow(delta uint64) bool {
+	for {
+		state := atomic.LoadUint64(&s.state)
+		count := state & 0xFFFFFFFF
+		limit := state >> 32
+		if count+delta > limit || atomic.LoadInt32(&s.exclusive) != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&s.state, state, limit<<32+count+delta) {
+			return true
+		}
+	}
+}
+
+func (s *semaphore) Downgrade(from, to int) int {
+	if to < 0 || to > from {
+		panic("to must not be negative or greater than from")
+	}
+	if to == from {
+		return s.GetCount()
+	}
+	return s.Release(from - to)
+}
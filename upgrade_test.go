@@ -0,0 +1,190 @@
+package semaphore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_Upgrade(t *testing.T) {
+	sem := New(5)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 2)
+
+	if err := up.Upgrade(nil, 2, 4); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 4)
+
+	if err := up.Upgrade(nil, 4, 4); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 5, 4)
+
+	oldCnt := up.Downgrade(4, 1)
+	if oldCnt != 4 {
+		t.Error("semaphore must have old count = ", 4, ", but has ", oldCnt)
+	}
+	checkLimitAndCount(t, sem, 5, 1)
+
+	sem.Release(1)
+	checkLimitAndCount(t, sem, 5, 0)
+}
+
+func TestSemaphore_Upgrade_waits(t *testing.T) {
+	sem := New(3)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 1)
+	sem.Acquire(nil, 2)
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- up.Upgrade(nil, 1, 2)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-upgraded:
+		t.Fatal("upgraded over limit")
+	default:
+	}
+
+	// holding is kept while waiting
+	checkLimitAndCount(t, sem, 3, 3)
+
+	up.Downgrade(2, 1)
+	if err := <-upgraded; err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 3, 3)
+}
+
+func TestSemaphore_Upgrade_ctx_done(t *testing.T) {
+	sem := New(2)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := up.Upgrade(ctx, 2, 3); err != context.DeadlineExceeded {
+		t.Error("Error is not context.DeadlineExceeded")
+	}
+	checkLimitAndCount(t, sem, 2, 2)
+}
+
+func TestSemaphore_Upgrade_exclusive_waiter(t *testing.T) {
+	sem := New(4)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 1)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.(ExclusiveAcquirer).AcquireExclusive(nil)
+		close(acquired)
+	}()
+	for atomic.LoadInt32(&sem.(*semaphore).exclusive) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// queued exclusive waiter waits for the holding, waiting for it would never end
+	if err := up.Upgrade(nil, 1, 4); err != ErrUpgradeConflict {
+		t.Error("ErrUpgradeConflict expected, got", err)
+	}
+	if err := up.Upgrade(context.Background(), 1, 4); err != ErrUpgradeConflict {
+		t.Error("ErrUpgradeConflict expected, got", err)
+	}
+	checkLimitAndCount(t, sem, 4, 1)
+
+	sem.Release(1)
+	<-acquired
+	checkLimitAndCount(t, sem, 4, 4)
+}
+
+func TestSemaphore_Upgrade_exclusive_waiter_while_waiting(t *testing.T) {
+	sem := New(4)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 1)
+	sem.Acquire(nil, 3)
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- up.Upgrade(nil, 1, 2)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.(ExclusiveAcquirer).AcquireExclusive(nil)
+		close(acquired)
+	}()
+
+	// the waiting upgrade gives way to the exclusive waiter queued after it
+	select {
+	case err := <-upgraded:
+		if err != ErrUpgradeConflict {
+			t.Error("ErrUpgradeConflict expected, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upgrade and exclusive acquisition wait for each other")
+	}
+	checkLimitAndCount(t, sem, 4, 4)
+
+	sem.Release(1)
+	sem.Release(3)
+	<-acquired
+	checkLimitAndCount(t, sem, 4, 4)
+}
+
+func TestSemaphore_Upgrade_conflict(t *testing.T) {
+	sem := New(10)
+	up := sem.(Upgrader)
+	sem.Acquire(nil, 5)
+	sem.Acquire(nil, 5)
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- up.Upgrade(nil, 5, 7)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the second upgrader would wait for the first one forever
+	if err := up.Upgrade(nil, 5, 7); err != ErrUpgradeConflict {
+		t.Error("ErrUpgradeConflict expected, got", err)
+	}
+	checkLimitAndCount(t, sem, 10, 10)
+
+	// conflicting upgrader gives its holding back
+	sem.Release(5)
+	if err := <-upgraded; err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 10, 7)
+
+	// the waiting slot is free again
+	if err := up.Upgrade(nil, 7, 9); err != nil {
+		t.Error("Error returned:", err.Error())
+	}
+	checkLimitAndCount(t, sem, 10, 9)
+}
+
+func TestSemaphore_Upgrade_panic_expected(t *testing.T) {
+	tests := []func(up Upgrader){
+		func(up Upgrader) { up.Upgrade(nil, 0, 1) },
+		func(up Upgrader) { up.Upgrade(nil, 2, 1) },
+		func(up Upgrader) { up.Downgrade(1, 2) },
+		func(up Upgrader) { up.Downgrade(1, -1) },
+		func(up Upgrader) { up.Downgrade(3, 1) },
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Panic expected")
+				}
+			}()
+			sem := New(5)
+			sem.Acquire(nil, 1)
+			test(sem.(Upgrader))
+		}()
+	}
+}